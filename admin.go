@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/untillpro/goutils/logger"
+	coreutils "github.com/voedger/voedger/pkg/utils"
+)
+
+func (s *httpService) prepareAdmin() (err error) {
+	if len(s.AdminAddress) == 0 {
+		return nil
+	}
+	if s.n10n != nil && len(s.N10NUpdateSecret) == 0 && !isLoopbackAddress(s.AdminAddress) {
+		return fmt.Errorf("n10n update secret must be specified for the non-loopback admin address %s", s.AdminAddress)
+	}
+	s.admin.router = mux.NewRouter()
+	if s.n10n != nil {
+		s.admin.router.Handle("/n10n/update", s.adminSecretHandler(s.updateHandler())).Methods(http.MethodPost)
+	}
+	s.admin.router.HandleFunc("/metrics", s.metricsHandler).Methods(http.MethodGet)
+	s.admin.router.HandleFunc("/upstreams", s.upstreamsHandler).Methods(http.MethodGet)
+	if s.admin.listener, err = net.Listen("tcp", s.AdminAddress); err != nil {
+		return err
+	}
+	// the same timeouts as the main server: idle connections are closed after the read timeout
+	s.admin.server = &http.Server{
+		Handler:      s.admin.router,
+		ReadTimeout:  time.Duration(s.RouterParams.ReadTimeout) * time.Second,
+		WriteTimeout: time.Duration(s.RouterParams.WriteTimeout) * time.Second,
+		IdleTimeout:  time.Duration(s.RouterParams.ReadTimeout) * time.Second,
+	}
+	return nil
+}
+
+// empty host -> all interfaces -> not loopback
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s *httpService) runAdmin(ctx context.Context) {
+	if s.admin.server == nil {
+		return
+	}
+	s.admin.server.BaseContext = func(l net.Listener) context.Context {
+		return ctx
+	}
+	logger.Info("Starting admin HTTP server on", s.admin.listener.Addr().String())
+	go func() {
+		if err := s.admin.server.Serve(s.admin.listener); err != http.ErrServerClosed {
+			log.Println("admin HTTP server failure: " + err.Error())
+		}
+	}()
+}
+
+func (s *httpService) stopAdmin() {
+	if s.admin.server == nil {
+		return
+	}
+	if err := s.admin.server.Shutdown(context.Background()); err != nil {
+		log.Println("admin http server Shutdown() failed: " + err.Error())
+		s.admin.server.Close()
+	}
+}
+
+// N10NUpdateSecret is empty -> the admin listener is trusted, allowed on the loopback address only
+func (s *httpService) adminSecretHandler(h http.Handler) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if len(s.N10NUpdateSecret) > 0 {
+			expected := coreutils.BearerPrefix + s.N10NUpdateSecret
+			if subtle.ConstantTimeCompare([]byte(req.Header.Get(coreutils.Authorization)), []byte(expected)) != 1 {
+				s.metrics.n10nUpdateRejectedRequests.Add(1)
+				writeUnauthorized(rw)
+				return
+			}
+		}
+		h.ServeHTTP(rw, req)
+	}
+}
+
+func (s *httpService) metricsHandler(rw http.ResponseWriter, req *http.Request) {
+	metrics := map[string]int64{
+		"n10nUpdateRequests":         s.metrics.n10nUpdateRequests.Load(),
+		"n10nUpdateRejectedRequests": s.metrics.n10nUpdateRejectedRequests.Load(),
+		"n10nUpdates":                s.metrics.n10nUpdates.Load(),
+		"n10nDroppedEvents":          s.metrics.n10nDroppedEvents.Load(),
+	}
+	if s.n10n != nil {
+		metrics["n10nChannels"] = int64(s.n10n.MetricNumChannels())
+		metrics["n10nSubscriptions"] = int64(s.n10n.MetricNumSubcriptions())
+	}
+	metrics["healthCheckFailures"] = s.metrics.healthCheckFailures.Load()
+	for _, status := range s.upstreamStatuses() {
+		if status.Healthy {
+			metrics["upstreamsHealthy"]++
+		} else {
+			metrics["upstreamsUnhealthy"]++
+		}
+	}
+	data, _ := json.Marshal(metrics) // error impossible
+	rw.Header().Set(coreutils.ContentType, coreutils.ApplicationJSON)
+	writeResponse(rw, string(data))
+}
+
+// reverse proxy targets health
+func (s *httpService) upstreamsHandler(rw http.ResponseWriter, req *http.Request) {
+	data, _ := json.Marshal(s.upstreamStatuses()) // error impossible
+	rw.Header().Set(coreutils.ContentType, coreutils.ApplicationJSON)
+	writeResponse(rw, string(data))
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+	"github.com/voedger/voedger/pkg/appdef"
+	"github.com/voedger/voedger/pkg/in10n"
+	istructs "github.com/voedger/voedger/pkg/istructs"
+)
+
+func TestAdminN10NUpdate(t *testing.T) {
+	require := require.New(t)
+	broker := newTestN10NBroker()
+	s := &httpService{n10n: broker, RouterParams: RouterParams{AdminAddress: "127.0.0.1:0", N10NUpdateSecret: "secret"}}
+	require.NoError(s.prepareAdmin())
+	ctx, cancel := context.WithCancel(context.Background())
+	s.runAdmin(ctx)
+	defer func() {
+		cancel()
+		s.stopAdmin()
+	}()
+	adminURL := "http://" + s.admin.listener.Addr().String()
+
+	post := func(secret string, body string) int {
+		req, err := http.NewRequest(http.MethodPost, adminURL+"/n10n/update", strings.NewReader(body))
+		require.NoError(err)
+		if len(secret) > 0 {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	validBatch := `[
+		{"Projection":{"App":"untill/airs-bp","Projection":"paa.price","WS":1},"Offset":13},
+		{"Projection":{"App":"untill/airs-bp","Projection":"paa.wine_price","WS":2},"Offset":14}
+	]`
+	require.Equal(http.StatusUnauthorized, post("", validBatch))
+	require.Equal(http.StatusUnauthorized, post("wrong", validBatch))
+	require.Equal(http.StatusNoContent, post("secret", validBatch))
+	app := istructs.NewAppQName("untill", "airs-bp")
+	require.Equal([]UpdateUnit{
+		{Projection: in10n.ProjectionKey{App: app, Projection: appdef.NewQName("paa", "price"), WS: 1}, Offset: 13},
+		{Projection: in10n.ProjectionKey{App: app, Projection: appdef.NewQName("paa", "wine_price"), WS: 2}, Offset: 14},
+	}, broker.updates)
+
+	t.Run("invalid batch is not applied", func(t *testing.T) {
+		broker.updates = nil
+		require.Equal(http.StatusBadRequest, post("secret", `wrong`))
+		require.Equal(http.StatusBadRequest, post("secret", `[]`))
+		require.Equal(http.StatusBadRequest, post("secret", `[
+			{"Projection":{"App":"untill/airs-bp","Projection":"paa.price","WS":1},"Offset":13},
+			{"Projection":{"App":"untill/airs-bp","Projection":"paa.price","WS":1},"Offset":0}
+		]`))
+		require.Equal(http.StatusBadRequest, post("secret", `[{"Projection":{"App":"untill/airs-bp","Projection":"paa.price"},"Offset":1}]`))
+		require.Empty(broker.updates)
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		resp, err := http.Get(adminURL + "/metrics")
+		require.NoError(err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(err)
+		metrics := map[string]int64{}
+		require.NoError(json.Unmarshal(body, &metrics))
+		require.Equal(int64(5), metrics["n10nUpdateRequests"])
+		require.Equal(int64(6), metrics["n10nUpdateRejectedRequests"])
+		require.Equal(int64(2), metrics["n10nUpdates"])
+	})
+}
+
+func TestAdminN10NUpdateBodyReadErrors(t *testing.T) {
+	require := require.New(t)
+	s := &httpService{n10n: newTestN10NBroker()}
+	post := func(body io.Reader) int {
+		rec := httptest.NewRecorder()
+		s.updateHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/n10n/update", body))
+		return rec.Code
+	}
+	require.Equal(http.StatusRequestEntityTooLarge, post(strings.NewReader(strings.Repeat(" ", n10nUpdateMaxBodySize+1))))
+	require.Equal(http.StatusBadRequest, post(iotest.ErrReader(errors.New("client disconnected"))))
+}
+
+func TestAdminN10NUpdateSecretRequired(t *testing.T) {
+	require := require.New(t)
+	for _, address := range []string{":0", "0.0.0.0:0"} {
+		s := &httpService{n10n: newTestN10NBroker(), RouterParams: RouterParams{AdminAddress: address}}
+		require.Error(s.prepareAdmin(), address)
+	}
+	for _, address := range []string{"127.0.0.1:0", "localhost:0", "[::1]:0"} {
+		require.True(isLoopbackAddress(address), address)
+	}
+	s := &httpService{n10n: newTestN10NBroker(), RouterParams: RouterParams{AdminAddress: "127.0.0.1:0"}}
+	require.NoError(s.prepareAdmin())
+	s.admin.listener.Close()
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/untillpro/goutils/logger"
+	istructs "github.com/voedger/voedger/pkg/istructs"
+	coreutils "github.com/voedger/voedger/pkg/utils"
+)
+
+var authPolicies = map[string]authPolicy{
+	authPolicyNameRequired:  authPolicyRequired,
+	authPolicyNameOptional:  authPolicyOptional,
+	authPolicyNameForbidden: authPolicyForbidden,
+}
+
+// principal token sources in priority order: Authorization header, Authorization cookie, principalToken query param
+// cookie is accepted on cookieTokenMethods only: it is sent by the browser on cross-site requests too, so it must not authorize commands (CSRF)
+// err != nil -> the request has malformed credentials
+func extractPrincipalToken(req *http.Request, cookieTokenMethods []string, allowQueryToken bool) (token string, source principalTokenSource, err error) {
+	if authHeader := req.Header.Get(coreutils.Authorization); len(authHeader) > 0 {
+		if !strings.HasPrefix(authHeader, coreutils.BearerPrefix) {
+			return "", principalTokenSourceNone, errors.New("Authorization header must have Bearer prefix")
+		}
+		return authHeader[bearerPrefixLen:], principalTokenSourceHeader, nil
+	}
+	if cookie, err := req.Cookie(coreutils.Authorization); err == nil && isCookieTokenMethod(req.Method, cookieTokenMethods) {
+		val, err := url.QueryUnescape(cookie.Value)
+		if err != nil {
+			return "", principalTokenSourceNone, fmt.Errorf("%w '%s'", errCookieUnescape, cookie.Value)
+		}
+		if !strings.HasPrefix(val, coreutils.BearerPrefix) {
+			return "", principalTokenSourceNone, errors.New("Authorization cookie must have Bearer prefix")
+		}
+		return val[bearerPrefixLen:], principalTokenSourceCookie, nil
+	}
+	if allowQueryToken {
+		// EventSource can not send headers
+		if token := req.URL.Query().Get(bp3PrincipalToken); len(token) > 0 {
+			return token, principalTokenSourceQuery, nil
+		}
+	}
+	return "", principalTokenSourceNone, nil
+}
+
+func isCookieTokenMethod(method string, cookieTokenMethods []string) bool {
+	for _, m := range cookieTokenMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// resolves the route auth policy: RouterParams.AuthPolicies by the route name, defaultPolicy otherwise
+func (s *httpService) routeAuthPolicy(routeName string, defaultPolicy authPolicy) (authPolicy, error) {
+	policyName, ok := s.AuthPolicies[routeName]
+	if !ok {
+		return defaultPolicy, nil
+	}
+	policy, ok := authPolicies[policyName]
+	if !ok {
+		return defaultPolicy, fmt.Errorf("route %s: unknown auth policy %s", routeName, policyName)
+	}
+	return policy, nil
+}
+
+// extracts the principal token, validates it at the edge if enabled and attaches the principal to the request context
+// token from cookie or query param is put to the Authorization header because the apps expect it there
+// cookieTokenMethods: nil -> the cookie is ignored
+func (s *httpService) authHandler(h http.Handler, policy authPolicy, cookieTokenMethods []string, allowQueryToken bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, source, err := extractPrincipalToken(r, cookieTokenMethods, allowQueryToken)
+		if err != nil {
+			status := http.StatusUnauthorized
+			if errors.Is(err, errCookieUnescape) {
+				status = http.StatusBadRequest
+			}
+			writeTextResponse(w, err.Error(), status)
+			return
+		}
+		switch {
+		case len(token) == 0 && policy == authPolicyRequired:
+			writeUnauthorized(w)
+			return
+		case len(token) > 0 && policy == authPolicyForbidden:
+			writeTextResponse(w, "principal token must not be provided", http.StatusBadRequest)
+			return
+		case len(token) == 0:
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		p := principal{token: token, source: source}
+		if s.EdgeAuth && s.AppKeysProvider != nil {
+			vars := mux.Vars(r)
+			expectedApp := istructs.NullAppQName
+			if len(vars[bp3AppOwner]) > 0 {
+				expectedApp = istructs.NewAppQName(vars[bp3AppOwner], vars[bp3AppName])
+			}
+			claims, err := s.validatePrincipalToken(r.Context(), token, expectedApp)
+			switch {
+			case errors.Is(err, errAppKeysUnavailable):
+				// the app will validate the token itself
+				logger.Error(err)
+			case err != nil:
+				if logger.IsVerbose() {
+					logger.Verbose("principal token rejected on ", r.URL.Path, ": ", err)
+				}
+				writeTextResponse(w, "principal token is invalid: "+err.Error(), http.StatusUnauthorized)
+				return
+			default:
+				p.claims = &claims
+			}
+		}
+
+		switch source {
+		case principalTokenSourceCookie, principalTokenSourceQuery:
+			r.Header.Set(coreutils.Authorization, coreutils.BearerPrefix+token)
+			if source == principalTokenSourceQuery {
+				// avoid passing the token further, e.g. to the bus request query
+				query := r.URL.Query()
+				query.Del(bp3PrincipalToken)
+				r.URL.RawQuery = query.Encode()
+			}
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey, p)))
+	}
+}
+
+// ok == false -> the request is anonymous
+func principalFromContext(ctx context.Context) (p principal, ok bool) {
+	p, ok = ctx.Value(principalKey).(principal)
+	return p, ok
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthHandler(t *testing.T) {
+	s := &httpService{}
+	var (
+		handledPrincipal principal
+		isAuthenticated  bool
+		handledRequest   *http.Request
+	)
+	newHandler := func(policy authPolicy, cookieTokenMethods []string, allowQueryToken bool) http.Handler {
+		return s.authHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handledRequest = r
+			handledPrincipal, isAuthenticated = principalFromContext(r.Context())
+		}), policy, cookieTokenMethods, allowQueryToken)
+	}
+	send := func(h http.Handler, req *http.Request) int {
+		handledRequest = nil
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	t.Run("header", func(t *testing.T) {
+		require := require.New(t)
+		req := httptest.NewRequest(http.MethodGet, "/n10n/channel", http.NoBody)
+		req.Header.Set("Authorization", "Bearer token")
+		require.Equal(http.StatusOK, send(newHandler(authPolicyRequired, nil, false), req))
+		require.True(isAuthenticated)
+		require.Equal("token", handledPrincipal.token)
+		require.Nil(handledPrincipal.claims)
+	})
+
+	t.Run("cookie", func(t *testing.T) {
+		require := require.New(t)
+		req := httptest.NewRequest(http.MethodGet, "/blob/untill/airs-bp/1/2", http.NoBody)
+		req.AddCookie(&http.Cookie{Name: "Authorization", Value: "Bearer%20token"})
+		require.Equal(http.StatusOK, send(newHandler(authPolicyRequired, []string{http.MethodGet}, false), req))
+		require.Equal("token", handledPrincipal.token)
+		// apps expect the token in the header
+		require.Equal("Bearer token", handledRequest.Header.Get("Authorization"))
+
+		// cross-site requests carry the cookie too -> ignored on other routes and methods
+		req = httptest.NewRequest(http.MethodGet, "/api/untill/airs-bp/1/c.sys.Init", http.NoBody)
+		req.AddCookie(&http.Cookie{Name: "Authorization", Value: "Bearer%20token"})
+		require.Equal(http.StatusUnauthorized, send(newHandler(authPolicyRequired, nil, false), req))
+		require.Nil(handledRequest)
+		req = httptest.NewRequest(http.MethodPost, "/n10n/channel", http.NoBody)
+		req.AddCookie(&http.Cookie{Name: "Authorization", Value: "Bearer%20token"})
+		require.Equal(http.StatusUnauthorized, send(newHandler(authPolicyRequired, []string{http.MethodGet}, false), req))
+		require.Nil(handledRequest)
+
+		// POST blob read accepts the cookie as before
+		req = httptest.NewRequest(http.MethodPost, "/blob/untill/airs-bp/1/2", http.NoBody)
+		req.AddCookie(&http.Cookie{Name: "Authorization", Value: "Bearer%20token"})
+		require.Equal(http.StatusOK, send(newHandler(authPolicyRequired, []string{http.MethodGet, http.MethodPost}, false), req))
+		require.Equal("Bearer token", handledRequest.Header.Get("Authorization"))
+	})
+
+	t.Run("query", func(t *testing.T) {
+		require := require.New(t)
+		req := httptest.NewRequest(http.MethodGet, "/n10n/channel?payload=1&principalToken=token", http.NoBody)
+		require.Equal(http.StatusOK, send(newHandler(authPolicyRequired, []string{http.MethodGet}, true), req))
+		require.Equal("token", handledPrincipal.token)
+		require.Equal("Bearer token", handledRequest.Header.Get("Authorization"))
+		require.Equal("payload=1", handledRequest.URL.RawQuery)
+
+		// query token is not allowed
+		req = httptest.NewRequest(http.MethodGet, "/n10n/channel?principalToken=token", http.NoBody)
+		require.Equal(http.StatusUnauthorized, send(newHandler(authPolicyRequired, nil, false), req))
+		require.Nil(handledRequest)
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		require := require.New(t)
+		req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+		req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+		require.Equal(http.StatusUnauthorized, send(newHandler(authPolicyOptional, nil, false), req))
+		require.Nil(handledRequest)
+
+		req = httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+		req.AddCookie(&http.Cookie{Name: "Authorization", Value: "Bearer%zztoken"})
+		require.Equal(http.StatusBadRequest, send(newHandler(authPolicyOptional, []string{http.MethodGet}, false), req))
+		require.Nil(handledRequest)
+	})
+
+	t.Run("policies", func(t *testing.T) {
+		require := require.New(t)
+		anonymous := func() *http.Request { return httptest.NewRequest(http.MethodGet, "/", http.NoBody) }
+		authenticated := func() *http.Request {
+			req := anonymous()
+			req.Header.Set("Authorization", "Bearer token")
+			return req
+		}
+		require.Equal(http.StatusUnauthorized, send(newHandler(authPolicyRequired, nil, false), anonymous()))
+		require.Equal(http.StatusOK, send(newHandler(authPolicyOptional, nil, false), anonymous()))
+		require.False(isAuthenticated)
+		require.Equal(http.StatusOK, send(newHandler(authPolicyForbidden, nil, false), anonymous()))
+		require.Equal(http.StatusBadRequest, send(newHandler(authPolicyForbidden, nil, false), authenticated()))
+	})
+}
+
+func TestRouteAuthPolicy(t *testing.T) {
+	require := require.New(t)
+	s := &httpService{RouterParams: RouterParams{AuthPolicies: map[string]string{
+		routeNameN10NChannel: "required",
+		routeNameAPI:         "wrong",
+	}}}
+	policy, err := s.routeAuthPolicy(routeNameN10NChannel, authPolicyOptional)
+	require.NoError(err)
+	require.Equal(authPolicyRequired, policy)
+
+	policy, err = s.routeAuthPolicy(routeNameBLOBRead, authPolicyRequired)
+	require.NoError(err)
+	require.Equal(authPolicyRequired, policy)
+
+	_, err = s.routeAuthPolicy(routeNameAPI, authPolicyOptional)
+	require.Error(err)
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// targets: http://10.0.0.3:3000;http://10.0.0.4:3000
+func newUpstreamPool(targets string, balancing string) (pool *upstreamPool, err error) {
+	pool = &upstreamPool{}
+	for _, target := range strings.Split(targets, routeTargetsSeparator) {
+		target = strings.TrimSpace(target)
+		if len(target) == 0 {
+			continue
+		}
+		u := &upstream{}
+		if placeholderRegexp.MatchString(target) {
+			// url.Parse does not accept {} in the host -> the template is parsed by the placeholder stub to check the rest
+			u.template = target
+			target = placeholderRegexp.ReplaceAllString(target, "placeholder")
+		}
+		if u.targetURL, err = parseURL(target); err != nil {
+			return nil, err
+		}
+		pool.upstreams = append(pool.upstreams, u)
+	}
+	if len(pool.upstreams) == 0 {
+		return nil, fmt.Errorf("no targets in %s", targets)
+	}
+	switch {
+	case len(balancing) == 0, balancing == balancingNameRoundRobin:
+		pool.strategy = balancingRoundRobin
+	case balancing == balancingNameLeastConn:
+		pool.strategy = balancingLeastConn
+	case balancing == balancingNameHashIP:
+		pool.strategy = balancingHashIP
+	case strings.HasPrefix(balancing, balancingNameHashHeader) && len(balancing) > len(balancingNameHashHeader):
+		pool.strategy = balancingHashHeader
+		pool.hashKey = balancing[len(balancingNameHashHeader):]
+	case strings.HasPrefix(balancing, balancingNameHashCookie) && len(balancing) > len(balancingNameHashCookie):
+		pool.strategy = balancingHashCookie
+		pool.hashKey = balancing[len(balancingNameHashCookie):]
+	default:
+		return nil, fmt.Errorf("unknown balancing strategy %s", balancing)
+	}
+	return pool, nil
+}
+
+// nil -> no healthy targets
+func (p *upstreamPool) pick(req *http.Request) *upstream {
+	upstreams := p.available()
+	switch len(upstreams) {
+	case 0:
+		return nil
+	case 1:
+		return upstreams[0]
+	}
+	switch p.strategy {
+	case balancingLeastConn:
+		return p.leastConn(upstreams)
+	case balancingHashIP, balancingHashHeader, balancingHashCookie:
+		if key := p.hashValue(req); len(key) > 0 {
+			return consistentHash(upstreams, key)
+		}
+		// nothing to hash -> round-robin
+	}
+	return p.roundRobin(upstreams)
+}
+
+// healthy targets
+func (p *upstreamPool) available() []*upstream {
+	if p.healthCheck == nil {
+		return p.upstreams
+	}
+	res := make([]*upstream, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if !u.unhealthy.Load() {
+			res = append(res, u)
+		}
+	}
+	return res
+}
+
+func (p *upstreamPool) roundRobin(upstreams []*upstream) *upstream {
+	return upstreams[(p.next.Add(1)-1)%uint64(len(upstreams))]
+}
+
+// ties are resolved round-robin
+func (p *upstreamPool) leastConn(upstreams []*upstream) (res *upstream) {
+	start := p.next.Add(1) - 1
+	minActive := int64(math.MaxInt64)
+	for i := range upstreams {
+		u := upstreams[(start+uint64(i))%uint64(len(upstreams))]
+		if active := u.active.Load(); active < minActive {
+			minActive = active
+			res = u
+		}
+	}
+	return res
+}
+
+// rendezvous hashing: the target is changed for the keys of the removed target only
+func consistentHash(upstreams []*upstream, key string) (res *upstream) {
+	var maxWeight uint64
+	for _, u := range upstreams {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))        // error impossible
+		_, _ = h.Write([]byte(u.target())) // error impossible
+		if weight := h.Sum64(); res == nil || weight > maxWeight {
+			maxWeight = weight
+			res = u
+		}
+	}
+	return res
+}
+
+func (p *upstreamPool) hashValue(req *http.Request) string {
+	switch p.strategy {
+	case balancingHashHeader:
+		return req.Header.Get(p.hashKey)
+	case balancingHashCookie:
+		if cookie, err := req.Cookie(p.hashKey); err == nil {
+			return cookie.Value
+		}
+		return ""
+	}
+	return clientIPFromRequest(req)
+}
+
+// prefix is the matched path prefix of the route
+// must be called before the request is redirected to the target
+func (p *upstreamPool) handler(u *upstream, req *http.Request, prefix string) http.Handler {
+	return proxyRequestHandler(req, prefix, u.handler(p.proxy))
+}
+
+// counts requests in progress for least-conn
+func (u *upstream) handler(h http.Handler) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		u.active.Add(1)
+		defer u.active.Add(-1)
+		h.ServeHTTP(rw, req)
+	}
+}
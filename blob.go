@@ -13,7 +13,6 @@ import (
 	"mime"
 	"mime/multipart"
 	"net/http"
-	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -272,14 +271,6 @@ func (s *httpService) blobRequestHandler(resp http.ResponseWriter, req *http.Req
 		},
 		blobDetails: details,
 	}
-	if _, ok := mes.blobBaseMessage.header[coreutils.Authorization]; !ok {
-		if cookie, err := req.Cookie(coreutils.Authorization); err == nil {
-			if val, err := url.QueryUnescape(cookie.Value); err == nil {
-				// authorization token in cookies -> c.sys.DownloadBLOBHelper requires it in headers
-				mes.blobBaseMessage.header[coreutils.Authorization] = []string{val}
-			}
-		}
-	}
 	if !s.BlobberParams.procBus.Submit(0, 0, mes) {
 		resp.WriteHeader(http.StatusServiceUnavailable)
 		resp.Header().Add("Retry-After", fmt.Sprint(s.BlobberParams.RetryAfterSecondsOn503))
@@ -300,10 +291,6 @@ func (s *httpService) blobReadRequestHandler() http.HandlerFunc {
 			// notest
 			panic(err)
 		}
-		principalToken := headerOrCookieAuth(resp, req)
-		if len(principalToken) == 0 {
-			return
-		}
 		blobReadDetails := blobReadDetails{
 			blobID: istructs.RecordID(blobID),
 		}
@@ -313,14 +300,6 @@ func (s *httpService) blobReadRequestHandler() http.HandlerFunc {
 
 func (s *httpService) blobWriteRequestHandler() http.HandlerFunc {
 	return func(resp http.ResponseWriter, req *http.Request) {
-		principalToken, isHandled := headerAuth(resp, req)
-		if len(principalToken) == 0 {
-			if !isHandled {
-				writeUnauthorized(resp)
-			}
-			return
-		}
-
 		queryParamName, queryParamMimeType, boundary, ok := getBlobParams(resp, req)
 		if !ok {
 			return
@@ -339,44 +318,6 @@ func (s *httpService) blobWriteRequestHandler() http.HandlerFunc {
 	}
 }
 
-func headerAuth(rw http.ResponseWriter, req *http.Request) (principalToken string, isHandled bool) {
-	authHeader := req.Header.Get(coreutils.Authorization)
-	if len(authHeader) > 0 {
-		if len(authHeader) < bearerPrefixLen || authHeader[:bearerPrefixLen] != coreutils.BearerPrefix {
-			writeUnauthorized(rw)
-			return "", true
-		}
-		return authHeader[bearerPrefixLen:], false
-	}
-	return "", false
-}
-
-func headerOrCookieAuth(rw http.ResponseWriter, req *http.Request) (principalToken string) {
-	principalToken, isHandled := headerAuth(rw, req)
-	if isHandled {
-		return ""
-	}
-	if len(principalToken) > 0 {
-		return principalToken
-	}
-	for _, c := range req.Cookies() {
-		if c.Name == coreutils.Authorization {
-			val, err := url.QueryUnescape(c.Value)
-			if err != nil {
-				writeTextResponse(rw, "failed to unescape cookie '"+c.Value+"'", http.StatusBadRequest)
-				return ""
-			}
-			if len(val) < bearerPrefixLen || val[:bearerPrefixLen] != coreutils.BearerPrefix {
-				writeUnauthorized(rw)
-				return ""
-			}
-			return val[bearerPrefixLen:]
-		}
-	}
-	writeUnauthorized(rw)
-	return ""
-}
-
 // determines BLOBs write kind: name+mimeType in query params -> single BLOB, body is BLOB content, otherwise -> body is multipart/form-data
 // (is multipart/form-data) == len(boundary) > 0
 func getBlobParams(rw http.ResponseWriter, req *http.Request) (name, mimeType, boundary string, ok bool) {
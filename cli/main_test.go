@@ -6,6 +6,7 @@ package main
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -13,6 +14,14 @@ import (
 	router "github.com/untillpro/airs-router2"
 )
 
+var defaultSecurityHeaders = router.SecurityHeadersParams{
+	HSTSMaxAge: router.DefaultHSTSMaxAge,
+	Default: router.SecurityHeaders{
+		FrameOptions:   router.DefaultFrameOptions,
+		ReferrerPolicy: router.DefaultReferrerPolicy,
+	},
+}
+
 func TestCLI(t *testing.T) {
 	initialArgs := os.Args
 	defer func() {
@@ -29,6 +38,44 @@ func TestCLI(t *testing.T) {
 		Verbose:              true,
 		CertDir:              ".",
 		HTTP01ChallengeHosts: []string{},
+		N10NResumeTimeout:    router.DefaultN10NResumeTimeout,
+		SSERetry:             router.DefaultSSERetry,
+		SSEHeartbeatInterval: router.DefaultSSEHeartbeatInterval,
+		N10NChannelTTL:       router.DefaultN10NChannelTTL,
+		SecurityHeaders:      defaultSecurityHeaders,
+	}
+	require.Equal(t, expectedRP, actualRP)
+}
+
+func TestCLIConfigFile(t *testing.T) {
+	initialArgs := os.Args
+	defer func() {
+		os.Args = initialArgs
+	}()
+	configFile := filepath.Join(t.TempDir(), "router.json")
+	config := `{"Port": 8824, "WriteTimeout": 42, "CORS": {"AllowedOrigins": ["https://*.untill.com"], "AllowCredentials": true}}`
+	require.NoError(t, os.WriteFile(configFile, []byte(config), 0600))
+
+	// flags override config file values
+	os.Args = []string{"appPath", "--config", configFile, "--wt", "43", "--cors-max-age", "600"}
+	actualRP := router.ProvideRouterParamsFromCmdLine()
+	expectedRP := router.RouterParams{
+		Port:                 8824,
+		WriteTimeout:         43,
+		ReadTimeout:          router.DefaultRouterReadTimeout,
+		ConnectionsLimit:     router.DefaultRouterConnectionsLimit,
+		CertDir:              ".",
+		HTTP01ChallengeHosts: []string{},
+		N10NResumeTimeout:    router.DefaultN10NResumeTimeout,
+		SSERetry:             router.DefaultSSERetry,
+		SSEHeartbeatInterval: router.DefaultSSEHeartbeatInterval,
+		N10NChannelTTL:       router.DefaultN10NChannelTTL,
+		SecurityHeaders:      defaultSecurityHeaders,
+		CORS: router.CORSParams{
+			AllowedOrigins:   []string{"https://*.untill.com"},
+			AllowCredentials: true,
+			MaxAge:           600,
+		},
 	}
 	require.Equal(t, expectedRP, actualRP)
 }
@@ -5,6 +5,8 @@
 package router2
 
 import (
+	"errors"
+	"regexp"
 	"time"
 
 	coreutils "github.com/voedger/voedger/pkg/utils"
@@ -18,6 +20,147 @@ const (
 	localhost                       = "127.0.0.1"
 	parseInt64Base                  = 10
 	parseInt64Bits                  = 64
+	idempotencyKeyHeader            = "Idempotency-Key"
+	idempotentReplayedHeader        = "Idempotent-Replayed"
+	maxIdempotencyKeyLen            = 255
+	idempotencySweepInterval        = time.Minute
+	maxIdempotentResponseSize       = 1 << 20 // bigger responses are not remembered
+	maxIdempotentRequestBodySize    = 1 << 20 // bigger requests with Idempotency-Key -> 413
+	idempotencyStoreMemMaxSize      = 64 << 20
+	DefaultCORSAllowedHeaders       = "Accept, Content-Type, Content-Length, Accept-Encoding, Authorization"
+	corsAnyOrigin                   = "*"
+	DefaultHSTSMaxAge               = 365 * 24 * 60 * 60 // seconds
+	DefaultFrameOptions             = "SAMEORIGIN"
+	DefaultReferrerPolicy           = "strict-origin-when-cross-origin"
+	routeNameBLOBRead               = "blob read"
+	routeNameBLOBWrite              = "blob write"
+	routeNameReverseProxy           = "reverse proxy"
+	domainWildcardPrefix            = "*."
+	domainRegexPrefix               = "~"
+	routeTargetsSeparator           = ";"
+	balancingNameRoundRobin         = "round-robin"
+	balancingNameLeastConn          = "least-conn"
+	balancingNameHashIP             = "hash-ip"
+	balancingNameHashHeader         = "hash-header:"               // hash-header:<header name>
+	balancingNameHashCookie         = "hash-cookie:"               // hash-cookie:<cookie name>
+	proxyErrorConnection            = proxyErrorKind("connection") // connection refused and other transport errors
+	proxyErrorTimeout               = proxyErrorKind("timeout")
+	proxyError5xx                   = proxyErrorKind("5xx")
+	defaultProxyErrorContentType    = "text/html; charset=utf-8"
+	defaultProxyKeepAlive           = 30 * time.Second // as http.DefaultTransport
+	DefaultHealthCheckInterval      = 10               // seconds
+	DefaultHealthCheckTimeout       = 2                // seconds
+	DefaultHealthyThreshold         = 2
+	DefaultUnhealthyThreshold       = 3
+	n10nUpdateMaxBatchSize          = 1000
+	n10nUpdateMaxBodySize           = 1 << 20
+	n10nRequestMaxBodySize          = 1 << 20
+	n10nMaxBatchProjections         = 1000
+	appKeysMinRefreshInterval       = time.Minute
+	appKeysFailureTTL               = 10 * time.Second
+	appKeysMaxCachedFailures        = 1000
+	jwtLeeway                       = 30 * time.Second
+	routeNameAPI                    = "api"
+	routeNameRouterCheck            = "router check"
+	routeNameQueuesNames            = "queues names"
+	routeNameN10NChannel            = "n10n channel"
+	routeNameN10NSubscribe          = "n10n subscribe"
+	routeNameN10NUnsubscribe        = "n10n unsubscribe"
+	routeNameN10NWebSocket          = "n10n ws"
+	routeNameN10NPollChannel        = "n10n poll channel"
+	routeNameN10NPoll               = "n10n poll"
+	n10nPollWriteTimeout            = 10 * time.Second
+	DefaultN10NPollTimeout          = 30           // seconds
+	n10nMaxPollTimeout              = 120          // seconds
+	DefaultN10NChannelTTL           = 24 * 60 * 60 // seconds
+	n10nQuotaRetryAfter             = 30           // seconds
+	DefaultN10NResumeTimeout        = 60           // seconds
+	DefaultSSERetry                 = 3000         // milliseconds
+	lastEventIDHeader               = "Last-Event-ID"
+	DefaultSSEHeartbeatInterval     = 20 // seconds
+	sseHeartbeatComment             = ": heartbeat\n\n"
+	sseWriteTimeout                 = 10 * time.Second
+	sseHeartbeatEvent               = "event: heartbeat\ndata: \n\n"
+	sseShutdownEvent                = "event: shutdown\ndata: \n\n"
+	sseFormatParam                  = "format"
+	sseFormatV2                     = "v2" // event: update, data: sseUpdateData JSON
+	wsPingInterval                  = 30 * time.Second
+	wsReadTimeout                   = 2 * wsPingInterval // no frames from the client -> the connection is closed
+	wsWriteTimeout                  = 10 * time.Second
+	wsSendBufferSize                = 64 // overflow -> the client is too slow, the connection is closed
+	wsMessageSubscribe              = "subscribe"
+	wsMessageUnsubscribe            = "unsubscribe"
+	wsMessagePing                   = "ping"
+	wsMessagePong                   = "pong"
+	wsMessageChannel                = "channel"
+	wsMessageUpdate                 = "update"
+	wsMessageAck                    = "ack"
+	wsMessageError                  = "error"
+	authPolicyNameRequired          = "required"
+	authPolicyNameOptional          = "optional"
+	authPolicyNameForbidden         = "forbidden"
+	principalKey                    = principalKeyType("principal")
+	proxyHeaderVarsKey              = proxyHeaderVarsKeyType("proxy header vars")
+	clientKey                       = clientKeyType("client")
+	proxyInboundKey                 = proxyInboundKeyType("proxy inbound")
+	DefaultRedirectStatus           = 301
+	defaultStaticIndex              = "index.html"
+	defaultStaticIndexCacheControl  = "no-cache"
+	redirectVarScheme               = "scheme"
+	redirectVarHost                 = "host"
+	redirectVarPath                 = "path"
+	redirectVarRest                 = "rest"
+	redirectVarQuery                = "query"
+	headerVarClientIP               = "client_ip"
+	headerVarHost                   = "host"
+	headerVarPrefix                 = "prefix"
 )
 
-var bearerPrefixLen = len(coreutils.BearerPrefix)
+const (
+	// no token -> anonymous request
+	authPolicyOptional authPolicy = iota
+	// no token -> 401
+	authPolicyRequired
+	// token provided -> 400
+	authPolicyForbidden
+)
+
+const (
+	principalTokenSourceNone principalTokenSource = iota
+	principalTokenSourceHeader
+	principalTokenSourceCookie
+	principalTokenSourceQuery
+)
+
+const (
+	balancingRoundRobin balancingStrategy = iota
+	balancingLeastConn
+	balancingHashIP
+	balancingHashHeader
+	balancingHashCookie
+)
+
+const (
+	redirectHostExact redirectHostRank = iota
+	redirectHostWildcard
+	redirectHostRegex
+	redirectHostAny
+)
+
+const (
+	routeTypeAPI routeType = iota
+	routeTypeBLOB
+	routeTypeProxy
+)
+
+var (
+	errQuotaExceededProjectionsPerChannel = errors.New("quota exceeded: number of projections per channel")
+	errQuotaExceededChannelsPerSubject    = errors.New("quota exceeded: number of channels per subject")
+	bearerPrefixLen                       = len(coreutils.BearerPrefix)
+	errAppKeysUnavailable                 = errors.New("principal token keys are unavailable")
+	errCookieUnescape                     = errors.New("failed to unescape cookie")
+	placeholderRegexp                     = regexp.MustCompile(`\{([A-Za-z0-9_]+)\}`) // {sub} or {1} of the route domain target, {client_ip} of the route header value
+
+	// preferred first
+	staticPrecompressed = []staticPrecompressedVariant{{ext: ".br", encoding: "br"}, {ext: ".gz", encoding: "gzip"}}
+)
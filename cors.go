@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type corsPolicy struct {
+	anyOrigin        bool
+	origins          map[string]bool
+	originPatterns   []*regexp.Regexp
+	allowHeaders     string
+	exposeHeaders    string
+	allowCredentials bool
+	maxAge           string
+	routeMethods     map[string][]string
+}
+
+// zero CORSParams -> any origin is allowed, default headers list
+func newCORSPolicy(params CORSParams) (*corsPolicy, error) {
+	p := &corsPolicy{
+		origins:          map[string]bool{},
+		allowHeaders:     strings.Join(params.AllowedHeaders, ", "),
+		exposeHeaders:    strings.Join(params.ExposedHeaders, ", "),
+		allowCredentials: params.AllowCredentials,
+		routeMethods:     map[string][]string{},
+	}
+	for routeName, methods := range params.RouteMethods {
+		p.routeMethods[routeName] = strings.Fields(strings.ToUpper(methods))
+		if len(p.routeMethods[routeName]) == 0 {
+			return nil, fmt.Errorf("route %s: CORS methods are empty", routeName)
+		}
+	}
+	if params.MaxAge > 0 {
+		p.maxAge = strconv.Itoa(params.MaxAge)
+	}
+	if len(params.AllowedHeaders) == 0 {
+		p.allowHeaders = DefaultCORSAllowedHeaders
+	}
+	allowedOrigins := params.AllowedOrigins
+	if len(allowedOrigins) == 0 {
+		allowedOrigins = []string{corsAnyOrigin}
+	}
+	for _, origin := range allowedOrigins {
+		switch {
+		case origin == corsAnyOrigin:
+			p.anyOrigin = true
+		case strings.Contains(origin, "*"):
+			// https://*.untill.com, http://localhost:*
+			pattern := strings.ReplaceAll(regexp.QuoteMeta(strings.ToLower(origin)), `\*`, `[a-z0-9.-]+`)
+			re, err := regexp.Compile("^" + pattern + "$")
+			if err != nil {
+				return nil, fmt.Errorf("wrong CORS allowed origin %s: %w", origin, err)
+			}
+			p.originPatterns = append(p.originPatterns, re)
+		default:
+			p.origins[strings.ToLower(origin)] = true
+		}
+	}
+	if p.anyOrigin && p.allowCredentials {
+		// any site could make credentialed requests on behalf of the user
+		return nil, errors.New("CORS credentials require explicit allowed origins")
+	}
+	return p, nil
+}
+
+func (p *corsPolicy) isOriginAllowed(origin string) bool {
+	return p.anyOrigin || p.isOriginListed(origin)
+}
+
+// the origin is in AllowedOrigins explicitly or by the wildcard pattern, * is not considered
+func (p *corsPolicy) isOriginListed(origin string) bool {
+	origin = strings.ToLower(origin)
+	if p.origins[origin] {
+		return true
+	}
+	for _, re := range p.originPatterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns false if the origin is not allowed
+func (p *corsPolicy) writeHeaders(w http.ResponseWriter, origin string) bool {
+	if len(origin) == 0 {
+		// not a CORS request. Headers are kept for backward compatibility
+		if p.anyOrigin && !p.allowCredentials {
+			w.Header().Set("Access-Control-Allow-Origin", corsAnyOrigin)
+			w.Header().Set("Access-Control-Allow-Headers", p.allowHeaders)
+		}
+		return true
+	}
+	if !p.isOriginAllowed(origin) {
+		return false
+	}
+	if p.anyOrigin && !p.allowCredentials {
+		w.Header().Set("Access-Control-Allow-Origin", corsAnyOrigin)
+	} else {
+		// "*" is not allowed by browsers if credentials are allowed
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+	}
+	w.Header().Set("Access-Control-Allow-Headers", p.allowHeaders)
+	if p.allowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(p.exposeHeaders) > 0 {
+		w.Header().Set("Access-Control-Expose-Headers", p.exposeHeaders)
+	}
+	return true
+}
+
+// resolves the route CORS methods: CORSParams.RouteMethods by the route name, methods otherwise
+// methods are the route methods, the configured ones must be among them. Empty -> any
+func (p *corsPolicy) routeMethodsOf(routeName string, methods []string) ([]string, error) {
+	configured, ok := p.routeMethods[routeName]
+	if !ok {
+		return methods, nil
+	}
+	if len(methods) > 0 {
+		for _, method := range configured {
+			if !containsString(methods, method) {
+				return methods, fmt.Errorf("route %s: CORS method %s is not allowed by the route", routeName, method)
+			}
+		}
+	}
+	return configured, nil
+}
+
+// methods are the route methods, reported in Access-Control-Allow-Methods on preflight
+// empty -> the requested method is allowed
+func (p *corsPolicy) handler(h http.Handler, methods ...string) http.HandlerFunc {
+	allowMethods := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		isOriginAllowed := p.writeHeaders(w, origin)
+		requestMethod := r.Header.Get("Access-Control-Request-Method")
+		if r.Method == http.MethodOptions && len(origin) > 0 && len(requestMethod) > 0 {
+			// preflight
+			if !isOriginAllowed {
+				writeTextResponse(w, "origin "+origin+" is not allowed", http.StatusForbidden)
+				return
+			}
+			if len(methods) > 0 && !containsString(methods, requestMethod) {
+				writeTextResponse(w, "method "+requestMethod+" is not allowed", http.StatusForbidden)
+				return
+			}
+			if len(allowMethods) > 0 {
+				w.Header().Set("Access-Control-Allow-Methods", allowMethods)
+			} else {
+				w.Header().Set("Access-Control-Allow-Methods", requestMethod)
+			}
+			if len(p.maxAge) > 0 {
+				w.Header().Set("Access-Control-Max-Age", p.maxAge)
+			}
+			return
+		}
+		if r.Method == http.MethodOptions {
+			return
+		}
+		h.ServeHTTP(w, r)
+	}
+}
+
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCORSDefault(t *testing.T) {
+	require := require.New(t)
+	p, err := newCORSPolicy(CORSParams{})
+	require.NoError(err)
+	h := p.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "POST")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/check", http.NoBody))
+	require.Equal("*", rec.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(DefaultCORSAllowedHeaders, rec.Header().Get("Access-Control-Allow-Headers"))
+
+	req := httptest.NewRequest(http.MethodOptions, "/api/check", http.NoBody)
+	req.Header.Set("Origin", "https://any.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(http.StatusOK, rec.Code)
+	require.Equal("*", rec.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal("POST", rec.Header().Get("Access-Control-Allow-Methods"))
+}
+
+func TestCORSConfigured(t *testing.T) {
+	require := require.New(t)
+	p, err := newCORSPolicy(CORSParams{
+		AllowedOrigins:   []string{"https://web.untill.com", "https://*.dev.untill.com", "http://localhost:*"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		ExposedHeaders:   []string{"Content-Disposition"},
+		AllowCredentials: true,
+		MaxAge:           600,
+	})
+	require.NoError(err)
+	handled := false
+	h := p.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handled = true }), "POST", "GET")
+
+	preflight := func(origin, method string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "/blob/untill/airs-bp/1/2", http.NoBody)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("allowed origins", func(t *testing.T) {
+		for _, origin := range []string{"https://web.untill.com", "https://alpha.dev.untill.com", "HTTP://localhost:3000"} {
+			rec := preflight(origin, "GET")
+			require.Equal(http.StatusOK, rec.Code, origin)
+			require.Equal(origin, rec.Header().Get("Access-Control-Allow-Origin"))
+			require.Equal("true", rec.Header().Get("Access-Control-Allow-Credentials"))
+			require.Equal("POST, GET", rec.Header().Get("Access-Control-Allow-Methods"))
+			require.Equal("Authorization, Content-Type", rec.Header().Get("Access-Control-Allow-Headers"))
+			require.Equal("Content-Disposition", rec.Header().Get("Access-Control-Expose-Headers"))
+			require.Equal("600", rec.Header().Get("Access-Control-Max-Age"))
+			require.Equal("Origin", rec.Header().Get("Vary"))
+		}
+	})
+
+	t.Run("disallowed origins", func(t *testing.T) {
+		for _, origin := range []string{"https://evil.com", "https://dev.untill.com", "https://web.untill.com.evil.com"} {
+			rec := preflight(origin, "GET")
+			require.Equal(http.StatusForbidden, rec.Code, origin)
+			require.Empty(rec.Header().Get("Access-Control-Allow-Origin"))
+		}
+	})
+
+	t.Run("disallowed method", func(t *testing.T) {
+		require.Equal(http.StatusForbidden, preflight("https://web.untill.com", "DELETE").Code)
+	})
+
+	t.Run("actual request", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/blob/untill/airs-bp/1/2", http.NoBody)
+		req.Header.Set("Origin", "https://evil.com")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		require.True(handled)
+		require.Empty(rec.Header().Get("Access-Control-Allow-Origin"))
+	})
+}
+
+func TestCORSCredentialsForAnyOrigin(t *testing.T) {
+	require := require.New(t)
+	_, err := newCORSPolicy(CORSParams{AllowCredentials: true})
+	require.Error(err)
+	_, err = newCORSPolicy(CORSParams{AllowedOrigins: []string{"https://web.untill.com", corsAnyOrigin}, AllowCredentials: true})
+	require.Error(err)
+}
+
+func TestCORSRouteMethods(t *testing.T) {
+	require := require.New(t)
+	p, err := newCORSPolicy(CORSParams{RouteMethods: map[string]string{
+		routeNameBLOBRead: "get",
+		routeNameAPI:      "POST DELETE",
+	}})
+	require.NoError(err)
+
+	blobReadMethods, err := p.routeMethodsOf(routeNameBLOBRead, []string{"POST", "GET"})
+	require.NoError(err)
+	require.Equal([]string{"GET"}, blobReadMethods)
+
+	methods, err := p.routeMethodsOf(routeNameN10NPoll, []string{"GET"})
+	require.NoError(err)
+	require.Equal([]string{"GET"}, methods)
+
+	// not allowed by the route
+	_, err = p.routeMethodsOf(routeNameAPI, []string{"POST", "PATCH"})
+	require.Error(err)
+
+	// POST blob read is not allowed cross-origin
+	h := p.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), blobReadMethods...)
+	req := httptest.NewRequest(http.MethodOptions, "/blob/untill/airs-bp/1/2", http.NoBody)
+	req.Header.Set("Origin", "https://web.untill.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(http.StatusForbidden, rec.Code)
+
+	_, err = newCORSPolicy(CORSParams{RouteMethods: map[string]string{routeNameAPI: " "}})
+	require.Error(err)
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/untillpro/goutils/logger"
+)
+
+// resellerportal.dev.untill.ru      : exact host, O(1)
+// *.dev.untill.ru                   : one label, captured as {1}
+// ~(?P<sub>[a-z0-9-]+)\.untill\.ru  : regex over the whole host, captured as {sub} or {1}
+// precedence: exact, wildcards by the longest suffix, regexes in the lexicographic order
+func (s *httpService) parseDomainRoutes() (res *domainRoutes, err error) {
+	res = &domainRoutes{exact: map[string]*upstreamPool{}}
+	for domain, targets := range s.RouteDomains {
+		pool, err := s.newRoutePool(domain, targets)
+		if err != nil {
+			return nil, err
+		}
+		re, wildcard, err := compileHostPattern(domain)
+		if err != nil {
+			return nil, fmt.Errorf("route domain %s: %w", domain, err)
+		}
+		if re == nil {
+			res.exact[domain] = pool
+		} else {
+			res.patterns = append(res.patterns, domainPattern{key: domain, re: re, pool: pool, wildcard: wildcard})
+		}
+		if err := checkTargetTemplates(pool, re); err != nil {
+			return nil, fmt.Errorf("route domain %s: %w", domain, err)
+		}
+		logger.Info("reverse proxy route domain registered: ", domain, " -> ", targets)
+	}
+	sort.Slice(res.patterns, func(i, j int) bool {
+		pi, pj := res.patterns[i], res.patterns[j]
+		if pi.wildcard != pj.wildcard {
+			return pi.wildcard
+		}
+		if pi.wildcard && len(pi.key) != len(pj.key) {
+			return len(pi.key) > len(pj.key)
+		}
+		return pi.key < pj.key
+	})
+	return res, nil
+}
+
+// re == nil -> exact host
+func compileHostPattern(host string) (re *regexp.Regexp, wildcard bool, err error) {
+	switch {
+	case strings.HasPrefix(host, domainRegexPrefix):
+		re, err = regexp.Compile("^(?:" + host[len(domainRegexPrefix):] + ")$")
+		return re, false, err
+	case strings.HasPrefix(host, domainWildcardPrefix):
+		suffix := host[len(domainWildcardPrefix):]
+		if len(suffix) == 0 || strings.Contains(suffix, "*") {
+			return nil, false, errors.New("only the leading *. wildcard is allowed")
+		}
+		return regexp.MustCompile(`^([^.]+)\.` + regexp.QuoteMeta(suffix) + "$"), true, nil
+	case strings.Contains(host, "*"):
+		return nil, false, errors.New("only the leading *. wildcard is allowed")
+	}
+	return nil, false, nil
+}
+
+// placeholders must refer to the groups of the host pattern. re == nil -> exact host, no placeholders
+func checkTargetTemplates(pool *upstreamPool, re *regexp.Regexp) error {
+	for _, u := range pool.upstreams {
+		if len(u.template) == 0 {
+			continue
+		}
+		if pool.healthCheck != nil {
+			return fmt.Errorf("health check is not supported for the target template %s", u.template)
+		}
+		for _, placeholder := range placeholderRegexp.FindAllStringSubmatch(u.template, -1) {
+			name := placeholder[1]
+			if re == nil {
+				return fmt.Errorf("placeholder {%s} is not allowed for the exact host", name)
+			}
+			if n, err := strconv.Atoi(name); err == nil {
+				if n < 1 || n > re.NumSubexp() {
+					return fmt.Errorf("no group %d for placeholder {%s}", n, name)
+				}
+			} else if re.SubexpIndex(name) < 0 {
+				return fmt.Errorf("no group named %s for placeholder {%s}", name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// nil -> no route for the host
+func (d *domainRoutes) match(host string) (pool *upstreamPool, re *regexp.Regexp, groups []string) {
+	if pool, ok := d.exact[host]; ok {
+		return pool, nil, nil
+	}
+	for _, p := range d.patterns {
+		if groups = p.re.FindStringSubmatch(host); groups != nil {
+			return p.pool, p.re, groups
+		}
+	}
+	return nil, nil, nil
+}
+
+func (d *domainRoutes) isKnown(domain string) bool {
+	if _, ok := d.exact[domain]; ok {
+		return true
+	}
+	for _, p := range d.patterns {
+		if p.key == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// {sub}.internal:8080 -> tenant1.internal:8080
+func (u *upstream) resolve(re *regexp.Regexp, groups []string) (*url.URL, error) {
+	if len(u.template) == 0 {
+		return u.targetURL, nil
+	}
+	target := placeholderRegexp.ReplaceAllStringFunc(u.template, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		if n, err := strconv.Atoi(name); err == nil {
+			return groups[n] // checked on start
+		}
+		return groups[re.SubexpIndex(name)]
+	})
+	return parseURL(target)
+}
+
+// template or url
+func (u *upstream) target() string {
+	if len(u.template) > 0 {
+		return u.template
+	}
+	return u.targetURL.String()
+}
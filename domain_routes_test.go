@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDomainRoutes(t *testing.T) {
+	require := require.New(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(req.Host + " " + req.URL.Path))
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(err)
+
+	s := &httpService{RouterParams: RouterParams{
+		RouteDomains: map[string]string{
+			"exact.dev.untill.ru":             "http://exact",
+			"*.dev.untill.ru":                 "http://{1}.wildcard",
+			"*.eu.dev.untill.ru":              "http://{1}.eu",
+			"~(?P<sub>[a-z]+)-portal\\..+":    "http://{sub}.regex-b",
+			"~(?P<sub>[a-z]+)-portal\\.test":  "http://{sub}.regex-a",
+			"~(?P<ip>[0-9.]+)\\.local\\.test": "http://{ip}:" + upstreamURL.Port(),
+		},
+	}}
+
+	t.Run("precedence", func(t *testing.T) {
+		domains, err := s.parseDomainRoutes()
+		require.NoError(err)
+		resolve := func(host string) string {
+			pool, re, groups := domains.match(host)
+			if pool == nil {
+				return ""
+			}
+			targetURL, err := pool.upstreams[0].resolve(re, groups)
+			require.NoError(err)
+			return targetURL.Host
+		}
+		require.Equal("exact", resolve("exact.dev.untill.ru"))
+		require.Equal("tenant1.wildcard", resolve("tenant1.dev.untill.ru"))
+		require.Equal("tenant1.eu", resolve("tenant1.eu.dev.untill.ru"))
+		require.Equal("eu.wildcard", resolve("eu.dev.untill.ru"))
+		// both regexes match, lexicographically first wins
+		require.Equal("reseller.regex-b", resolve("reseller-portal.test"))
+		require.Equal("reseller.regex-b", resolve("reseller-portal.untill.ru"))
+		require.Empty(resolve("reseller-portal"))
+		require.Empty(resolve("dev.untill.ru"))
+		require.Empty(resolve("a.b.c.untill.ru"))
+	})
+
+	t.Run("proxied to the resolved target", func(t *testing.T) {
+		redirectMatcher, err := s.getRedirectMatcher()
+		require.NoError(err)
+		router := mux.NewRouter()
+		router.MatcherFunc(redirectMatcher)
+		server := httptest.NewServer(router)
+		defer server.Close()
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/foo", http.NoBody)
+		require.NoError(err)
+		req.Host = "127.0.0.1.local.test"
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(err)
+		require.Equal(http.StatusOK, resp.StatusCode)
+		require.Equal(upstreamURL.Host+" /foo", string(body))
+	})
+
+	t.Run("wrong config", func(t *testing.T) {
+		for name, rp := range map[string]RouterParams{
+			"placeholder of the exact host": {RouteDomains: map[string]string{"exact.untill.ru": "http://{1}.internal"}},
+			"unknown group number":          {RouteDomains: map[string]string{"*.untill.ru": "http://{2}.internal"}},
+			"unknown group name":            {RouteDomains: map[string]string{"~(?P<sub>.+)\\.untill\\.ru": "http://{tenant}.internal"}},
+			"wrong regex":                   {RouteDomains: map[string]string{"~(.+\\.untill\\.ru": "http://internal"}},
+			"wildcard in the middle":        {RouteDomains: map[string]string{"portal.*.untill.ru": "http://internal"}},
+			"placeholder of the path route": {Routes: map[string]string{"/grafana": "http://{1}.internal"}},
+			"health check of the template": {
+				RouteDomains:      map[string]string{"*.untill.ru": "http://{1}.internal"},
+				RouteHealthChecks: map[string]HealthCheckParams{"*.untill.ru": {Path: "/health"}},
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				_, err := (&httpService{RouterParams: rp}).getRedirectMatcher()
+				require.Error(err)
+			})
+		}
+	})
+
+	t.Run("route params by pattern", func(t *testing.T) {
+		_, err := (&httpService{RouterParams: RouterParams{
+			RouteDomains:   map[string]string{"*.untill.ru": "http://{1}.internal;http://{1}.internal2"},
+			RouteBalancing: map[string]string{"*.untill.ru": balancingNameLeastConn},
+		}}).getRedirectMatcher()
+		require.NoError(err)
+	})
+}
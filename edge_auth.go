@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	ibus "github.com/untillpro/airs-ibus"
+	"github.com/untillpro/goutils/logger"
+	istructs "github.com/voedger/voedger/pkg/istructs"
+)
+
+type appKeysCacheEntry struct {
+	keys      []AppKey
+	fetchedAt time.Time
+	err       error // the last fetch failed, cached for appKeysFailureTTL
+	failedAt  time.Time
+	fetching  chan struct{} // not nil -> the fetch is in progress, closed when finished
+}
+
+// fetches the app keys via the bus once and caches them
+// concurrent requests of the same app wait for the single fetch, failures are cached for appKeysFailureTTL
+// up to appKeysMaxCachedFailures apps, expired failures are evicted
+type implIAppKeysProviderBus struct {
+	sync.Mutex
+	bus          ibus.IBus
+	busTimeout   time.Duration
+	keysResource string
+	cache        map[istructs.AppQName]*appKeysCacheEntry
+	now          func() time.Time
+}
+
+func (p *implIAppKeysProviderBus) GetKeys(ctx context.Context, app istructs.AppQName, refresh bool) (keys []AppKey, err error) {
+	for {
+		p.Lock()
+		entry, ok := p.cache[app]
+		if !ok {
+			entry = &appKeysCacheEntry{}
+			p.cache[app] = entry
+		}
+		if fetching := entry.fetching; fetching != nil {
+			p.Unlock()
+			select {
+			case <-fetching:
+				p.Lock()
+				removed, err := p.cache[app] != entry, entry.err
+				p.Unlock()
+				if removed && err != nil {
+					// the failure is not cached -> the waiters share it anyway
+					return nil, err
+				}
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		now := p.now()
+		switch {
+		case len(entry.keys) > 0 && (!refresh || now.Sub(entry.fetchedAt) < appKeysMinRefreshInterval):
+			p.Unlock()
+			return entry.keys, nil
+		case entry.err != nil && now.Sub(entry.failedAt) < appKeysFailureTTL:
+			p.Unlock()
+			return nil, entry.err
+		}
+		fetching := make(chan struct{})
+		entry.fetching = fetching
+		p.Unlock()
+
+		keys, err = p.fetchKeys(ctx, app)
+
+		p.Lock()
+		entry.fetching = nil
+		close(fetching)
+		switch {
+		case err == nil:
+			entry.keys, entry.fetchedAt, entry.err = keys, p.now(), nil
+		case ctx.Err() == nil:
+			// the client disconnect is not the app failure
+			entry.err, entry.failedAt = err, p.now()
+		}
+		if len(entry.keys) == 0 && (entry.err == nil || p.evictFailures(p.now()) > appKeysMaxCachedFailures) {
+			// e.g. the app does not exist -> the cache must not grow by any app name
+			delete(p.cache, app)
+		}
+		p.Unlock()
+		if err == nil {
+			logger.Info("principal token keys fetched for ", app, ": ", len(keys))
+		}
+		return keys, err
+	}
+}
+
+// removes expired failures of the apps the keys were never fetched for
+// returns the amount of the remaining ones
+func (p *implIAppKeysProviderBus) evictFailures(now time.Time) (failures int) {
+	for app, entry := range p.cache {
+		if len(entry.keys) > 0 || entry.err == nil {
+			continue
+		}
+		if now.Sub(entry.failedAt) >= appKeysFailureTTL {
+			delete(p.cache, app)
+			continue
+		}
+		failures++
+	}
+	return failures
+}
+
+func (p *implIAppKeysProviderBus) fetchKeys(ctx context.Context, app istructs.AppQName) (keys []AppKey, err error) {
+	req := ibus.Request{
+		Method:   ibus.HTTPMethodPOST,
+		WSID:     int64(istructs.NewWSID(istructs.MainClusterID, istructs.FirstBaseAppWSID)),
+		AppQName: app.String(),
+		Resource: p.keysResource,
+		Body:     []byte(`{}`),
+		Host:     localhost,
+	}
+	resp, _, _, err := p.bus.SendRequest2(ctx, req, p.busTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec %s: %w", p.keysResource, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned error: %s", p.keysResource, string(resp.Data))
+	}
+	return parseJWKS(resp.Data)
+}
+
+func (s *httpService) validatePrincipalToken(ctx context.Context, token string, expectedApp istructs.AppQName) (claims principalTokenClaims, err error) {
+	app := expectedApp
+	if app == istructs.NullAppQName {
+		// e.g. n10n: the app is not in the url -> the app the token is issued for
+		if claims, err = unverifiedTokenClaims(token); err != nil {
+			return claims, err
+		}
+		app = claims.AppQName
+	}
+	// otherwise any app name could be used to make the router fetch its keys
+	// no apps list, e.g. BP2 -> any app, the keys cache is limited by appKeysMaxCachedFailures
+	if s.appsWSAmount != nil {
+		if _, ok := s.appsWSAmount[app]; !ok {
+			return claims, fmt.Errorf("app %s is not served", app)
+		}
+	}
+	keys, err := s.AppKeysProvider.GetKeys(ctx, app, false)
+	if err != nil {
+		return claims, fmt.Errorf("%w: %s", errAppKeysUnavailable, err)
+	}
+	claims, err = verifyJWT(token, keys, time.Now())
+	if errors.Is(err, errUnknownKeyID) || errors.Is(err, errInvalidTokenSignature) {
+		// keys rotated? Refresh frequency is limited by the provider
+		if keys, err = s.AppKeysProvider.GetKeys(ctx, app, true); err != nil {
+			return claims, fmt.Errorf("%w: %s", errAppKeysUnavailable, err)
+		}
+		claims, err = verifyJWT(token, keys, time.Now())
+	}
+	if err != nil {
+		return claims, err
+	}
+	if claims.AppQName != app {
+		return claims, fmt.Errorf("token is issued for %s but %s is requested", claims.AppQName, app)
+	}
+	return claims, nil
+}
@@ -0,0 +1,355 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	ibus "github.com/untillpro/airs-ibus"
+	istructs "github.com/voedger/voedger/pkg/istructs"
+)
+
+var testSecret = []byte("secret")
+
+func issueTestToken(t *testing.T, alg string, kid string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(crypto.SHA256.New, k)
+		_, _ = mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		h := crypto.SHA256.New()
+		_, _ = h.Write([]byte(signed))
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, h.Sum(nil))
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		h := crypto.SHA256.New()
+		_, _ = h.Write([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, k, h.Sum(nil))
+		require.NoError(t, err)
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func testClaims(app string, exp time.Time) map[string]interface{} {
+	return map[string]interface{}{"AppQName": app, "exp": exp.Unix(), "Login": "paa"}
+}
+
+type testAppKeysProvider struct {
+	keys    map[istructs.AppQName][]AppKey
+	refresh int
+}
+
+func (p *testAppKeysProvider) GetKeys(ctx context.Context, app istructs.AppQName, refresh bool) (keys []AppKey, err error) {
+	if refresh {
+		p.refresh++
+	}
+	keys, ok := p.keys[app]
+	if !ok {
+		return nil, fmt.Errorf("unknown app %s", app)
+	}
+	return keys, nil
+}
+
+func TestVerifyJWT(t *testing.T) {
+	require := require.New(t)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	keys := []AppKey{
+		{KeyID: "hs", Algorithm: "HS256", Key: testSecret},
+		{KeyID: "es", Key: &ecKey.PublicKey},
+	}
+	now := time.Now()
+
+	claims, err := verifyJWT(issueTestToken(t, "HS256", "hs", testSecret, testClaims("untill/airs-bp", now.Add(time.Hour))), keys, now)
+	require.NoError(err)
+	require.Equal(istructs.NewAppQName("untill", "airs-bp"), claims.AppQName)
+
+	_, err = verifyJWT(issueTestToken(t, "ES256", "es", ecKey, testClaims("untill/airs-bp", now.Add(time.Hour))), keys, now)
+	require.NoError(err)
+
+	_, err = verifyJWT(issueTestToken(t, "HS256", "hs", []byte("wrong"), testClaims("untill/airs-bp", now.Add(time.Hour))), keys, now)
+	require.ErrorContains(err, "signature")
+
+	_, err = verifyJWT(issueTestToken(t, "HS256", "hs", testSecret, testClaims("untill/airs-bp", now.Add(-time.Hour))), keys, now)
+	require.ErrorContains(err, "expired")
+
+	_, err = verifyJWT(issueTestToken(t, "HS256", "unknown", testSecret, testClaims("untill/airs-bp", now.Add(time.Hour))), keys, now)
+	require.ErrorIs(err, errUnknownKeyID)
+
+	_, err = verifyJWT(issueTestToken(t, "HS256", "hs", testSecret, map[string]interface{}{"AppQName": "untill/airs-bp"}), keys, now)
+	require.ErrorContains(err, "exp claim is required")
+
+	_, err = verifyJWT(issueTestToken(t, "HS256", "hs", testSecret, map[string]interface{}{"AppQName": "untill/airs-bp",
+		"exp": now.Add(2 * time.Hour).Unix(), "nbf": now.Add(time.Hour).Unix()}), keys, now)
+	require.ErrorContains(err, "not valid yet")
+}
+
+func TestVerifyJWTAlgorithms(t *testing.T) {
+	require := require.New(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(err)
+	keys := []AppKey{{KeyID: "rs", Key: &rsaKey.PublicKey}}
+	now := time.Now()
+	claims := testClaims("untill/airs-bp", now.Add(time.Hour))
+
+	_, err = verifyJWT(issueTestToken(t, "RS256", "rs", rsaKey, claims), keys, now)
+	require.NoError(err)
+
+	t.Run("alg none", func(t *testing.T) {
+		token := issueTestToken(t, "none", "rs", nil, claims)
+		_, err := verifyJWT(token, keys, now)
+		require.ErrorContains(err, "signing method none is invalid")
+		// must not cause the keys refresh
+		require.NotErrorIs(err, errInvalidTokenSignature)
+		require.NotErrorIs(err, errUnknownKeyID)
+
+		// signed by a known secret anyway
+		_, err = verifyJWT(issueTestToken(t, "none", "hs", testSecret, claims), []AppKey{{KeyID: "hs", Key: testSecret}}, now)
+		require.ErrorContains(err, "signing method none is invalid")
+	})
+
+	t.Run("alg confusion", func(t *testing.T) {
+		// HS token signed by the RSA public key used as the HMAC secret
+		for _, secret := range [][]byte{x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey), rsaKey.PublicKey.N.Bytes()} {
+			_, err := verifyJWT(issueTestToken(t, "HS256", "rs", secret, claims), keys, now)
+			require.ErrorIs(err, errUnknownKeyID)
+		}
+
+		// the key algorithm is fixed
+		_, err = verifyJWT(issueTestToken(t, "HS256", "", testSecret, claims), []AppKey{{Algorithm: "HS512", Key: testSecret}}, now)
+		require.ErrorIs(err, errUnknownKeyID)
+	})
+}
+
+func TestEdgeAuthHandler(t *testing.T) {
+	require := require.New(t)
+	keysProvider := &testAppKeysProvider{keys: map[istructs.AppQName][]AppKey{
+		istructs.NewAppQName("untill", "airs-bp"): {{Key: testSecret}},
+		istructs.NewAppQName("untill", "other"):   {{Key: []byte("other secret")}},
+		istructs.NewAppQName("untill", "alien"):   {{Key: []byte("alien secret")}},
+	}}
+	s := &httpService{
+		RouterParams: RouterParams{EdgeAuth: true, AppKeysProvider: keysProvider},
+		appsWSAmount: map[istructs.AppQName]istructs.AppWSAmount{
+			istructs.NewAppQName("untill", "airs-bp"): 1,
+			istructs.NewAppQName("untill", "other"):   1,
+			istructs.NewAppQName("untill", "unknown"): 1,
+		},
+	}
+	handled := false
+	h := s.authHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handled = true }), authPolicyOptional, nil, false)
+	send := func(token string, app string) int {
+		handled = false
+		req := httptest.NewRequest(http.MethodPost, "/api/untill/airs-bp/1/c.sys.Init", http.NoBody)
+		if len(app) > 0 {
+			owner, name, _ := strings.Cut(app, "/")
+			req = mux.SetURLVars(req, map[string]string{bp3AppOwner: owner, bp3AppName: name})
+		}
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	validToken := issueTestToken(t, "HS256", "", testSecret, testClaims("untill/airs-bp", time.Now().Add(time.Hour)))
+
+	require.Equal(http.StatusOK, send(validToken, "untill/airs-bp"))
+	require.True(handled)
+
+	// no token -> the app decides
+	require.Equal(http.StatusOK, send("", "untill/airs-bp"))
+	require.True(handled)
+
+	// app from the token claims, e.g. n10n
+	require.Equal(http.StatusOK, send(validToken, ""))
+	require.True(handled)
+
+	// app from the token claims is not served by the router
+	alienToken := issueTestToken(t, "HS256", "", []byte("alien secret"), testClaims("untill/alien", time.Now().Add(time.Hour)))
+	require.Equal(http.StatusUnauthorized, send(alienToken, ""))
+	require.False(handled)
+
+	// app from the url is not served by the router -> keys are not fetched
+	require.Equal(http.StatusUnauthorized, send(alienToken, "untill/alien"))
+	require.False(handled)
+	require.Equal(0, keysProvider.refresh)
+
+	expiredToken := issueTestToken(t, "HS256", "", testSecret, testClaims("untill/airs-bp", time.Now().Add(-time.Hour)))
+	require.Equal(http.StatusUnauthorized, send(expiredToken, "untill/airs-bp"))
+	require.False(handled)
+
+	// token of another app
+	require.Equal(http.StatusUnauthorized, send(validToken, "untill/other"))
+	require.False(handled)
+	require.Equal(1, keysProvider.refresh)
+
+	// keys are unavailable -> the app validates the token itself
+	require.Equal(http.StatusOK, send(validToken, "untill/unknown"))
+	require.True(handled)
+
+	// no apps list, e.g. BP2 -> any app
+	s.appsWSAmount = nil
+	require.Equal(http.StatusOK, send(validToken, ""))
+	require.True(handled)
+	require.Equal(http.StatusOK, send(alienToken, "untill/alien"))
+	require.True(handled)
+
+	// no keys provider, e.g. keys resource is not specified -> edge auth is disabled
+	s.AppKeysProvider = nil
+	require.Equal(http.StatusOK, send(expiredToken, "untill/airs-bp"))
+	require.True(handled)
+}
+
+type testKeysBus struct {
+	implIBusBP2
+	calls   int32
+	jwks    string
+	failed  bool
+	release chan struct{} // not nil -> requests wait for it
+}
+
+func (b *testKeysBus) SendRequest2(ctx context.Context, request ibus.Request, timeout time.Duration) (res ibus.Response, sections <-chan ibus.ISection, secError *error, err error) {
+	atomic.AddInt32(&b.calls, 1)
+	if b.release != nil {
+		<-b.release
+	}
+	if b.failed {
+		return res, nil, nil, errors.New("no app")
+	}
+	return ibus.Response{StatusCode: http.StatusOK, Data: []byte(b.jwks)}, nil, nil, nil
+}
+
+func TestAppKeysProviderBus(t *testing.T) {
+	require := require.New(t)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	jwks := fmt.Sprintf(`{"keys":[{"kty":"oct","kid":"1","k":%q},{"kty":"EC","kid":"2","crv":"P-256","x":%q,"y":%q}]}`,
+		base64.RawURLEncoding.EncodeToString(testSecret),
+		base64.RawURLEncoding.EncodeToString(ecKey.X.Bytes()),
+		base64.RawURLEncoding.EncodeToString(ecKey.Y.Bytes()))
+	bus := &testKeysBus{jwks: jwks}
+	now := time.Now()
+	provider := ProvideAppKeysProviderBus(bus, time.Second, "q.sys.TestKeys").(*implIAppKeysProviderBus)
+	provider.now = func() time.Time { return now }
+	app := istructs.NewAppQName("untill", "airs-bp")
+
+	keys, err := provider.GetKeys(context.Background(), app, false)
+	require.NoError(err)
+	require.Len(keys, 2)
+	require.Equal(testSecret, keys[0].Key)
+	require.Zero(new(big.Int).Sub(ecKey.X, keys[1].Key.(*ecdsa.PublicKey).X).Sign())
+
+	// cached
+	_, err = provider.GetKeys(context.Background(), app, false)
+	require.NoError(err)
+	require.Equal(int32(1), bus.calls)
+
+	// refresh is limited
+	_, err = provider.GetKeys(context.Background(), app, true)
+	require.NoError(err)
+	require.Equal(int32(1), bus.calls)
+	now = now.Add(appKeysMinRefreshInterval)
+	_, err = provider.GetKeys(context.Background(), app, true)
+	require.NoError(err)
+	require.Equal(int32(2), bus.calls)
+}
+
+func TestAppKeysProviderBusFailures(t *testing.T) {
+	require := require.New(t)
+	bus := &testKeysBus{jwks: `{"keys":[{"kty":"oct","kid":"1","k":"c2VjcmV0"}]}`, failed: true, release: make(chan struct{})}
+	now := time.Now()
+	provider := ProvideAppKeysProviderBus(bus, time.Second, "q.sys.TestKeys").(*implIAppKeysProviderBus)
+	provider.now = func() time.Time { return now }
+	app := istructs.NewAppQName("untill", "unknown")
+
+	// concurrent requests -> single fetch
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := provider.GetKeys(context.Background(), app, false)
+			require.Error(err)
+		}()
+	}
+	for atomic.LoadInt32(&bus.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(bus.release)
+	wg.Wait()
+	require.Equal(int32(1), atomic.LoadInt32(&bus.calls))
+
+	// failure is cached
+	_, err := provider.GetKeys(context.Background(), app, true)
+	require.Error(err)
+	require.Equal(int32(1), atomic.LoadInt32(&bus.calls))
+
+	// fetched again after the failure TTL
+	bus.failed = false
+	now = now.Add(appKeysFailureTTL)
+	keys, err := provider.GetKeys(context.Background(), app, false)
+	require.NoError(err)
+	require.Len(keys, 1)
+	require.Equal(int32(2), atomic.LoadInt32(&bus.calls))
+}
+
+func TestAppKeysProviderBusFailuresLimit(t *testing.T) {
+	require := require.New(t)
+	bus := &testKeysBus{failed: true}
+	now := time.Now()
+	provider := ProvideAppKeysProviderBus(bus, time.Second, "q.sys.TestKeys").(*implIAppKeysProviderBus)
+	provider.now = func() time.Time { return now }
+
+	for i := 0; i < appKeysMaxCachedFailures+10; i++ {
+		_, err := provider.GetKeys(context.Background(), istructs.NewAppQName("untill", fmt.Sprint("app", i)), false)
+		require.Error(err)
+	}
+	require.Len(provider.cache, appKeysMaxCachedFailures)
+
+	// expired failures are evicted
+	now = now.Add(appKeysFailureTTL)
+	_, err := provider.GetKeys(context.Background(), istructs.NewAppQName("untill", "another"), false)
+	require.Error(err)
+	require.Len(provider.cache, 1)
+
+	// cancelled fetch is not cached
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = provider.GetKeys(ctx, istructs.NewAppQName("untill", "cancelled"), false)
+	require.Error(err)
+	require.Len(provider.cache, 1)
+}
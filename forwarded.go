@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// 10.0.0.0/8 or 10.0.0.1
+func parseTrustedProxies(proxies []string) (res []*net.IPNet, err error) {
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %s is not an IP or CIDR", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %s: %w", proxy, err)
+		}
+		res = append(res, ipNet)
+	}
+	return res, nil
+}
+
+// client info is resolved before the routes are matched
+func (s *httpService) clientHandler(h http.Handler) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		client := resolveClient(req, s.trustedProxies)
+		h.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), clientKey, client)))
+	}
+}
+
+// X-Forwarded-* are accepted from the trusted proxies only
+// X-Forwarded-For is walked from the right, the first untrusted address is the client
+func resolveClient(req *http.Request, trustedProxies []*net.IPNet) clientInfo {
+	client := clientInfo{
+		ip:           remoteIP(req),
+		host:         req.Host,
+		proto:        "http",
+		requestHost:  req.Host,
+		requestProto: "http",
+	}
+	if req.TLS != nil {
+		client.proto = "https"
+		client.requestProto = "https"
+	}
+	client.peer = client.ip
+	if !isTrustedProxy(client.peer, trustedProxies) {
+		return client
+	}
+	client.trustedPeer = true
+	forwardedFor := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwardedFor[i])
+		if net.ParseIP(ip) == nil {
+			break
+		}
+		client.ip = ip
+		if !isTrustedProxy(ip, trustedProxies) {
+			break
+		}
+	}
+	if host := firstHeaderValue(req, "X-Forwarded-Host"); len(host) > 0 {
+		client.host = host
+	}
+	if proto := strings.ToLower(firstHeaderValue(req, "X-Forwarded-Proto")); proto == "http" || proto == "https" {
+		client.proto = proto
+	}
+	return client
+}
+
+func isTrustedProxy(ip string, trustedProxies []*net.IPNet) bool {
+	if len(trustedProxies) == 0 {
+		return false
+	}
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return false
+	}
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(parsedIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// a, b -> a
+func firstHeaderValue(req *http.Request, name string) string {
+	value, _, _ := strings.Cut(req.Header.Get(name), ",")
+	return strings.TrimSpace(value)
+}
+
+// resolved by clientHandler. Not resolved, e.g. the matcher is used without the service -> no trusted proxies
+func clientFromRequest(req *http.Request) clientInfo {
+	if client, ok := req.Context().Value(clientKey).(clientInfo); ok {
+		return client
+	}
+	return resolveClient(req, nil)
+}
+
+// the real client IP, e.g. for logging and rate limiting
+func clientIPFromRequest(req *http.Request) string {
+	return clientFromRequest(req).ip
+}
+
+// client info and header vars are captured before the request is redirected to the target
+// the inbound request is kept for the fallback: the ReverseProxy error handler gets the directed outbound one
+func proxyRequestHandler(req *http.Request, prefix string, next http.Handler) http.HandlerFunc {
+	client := clientFromRequest(req)
+	vars := proxyHeaderVars{clientIP: client.ip, host: client.host, prefix: prefix}
+	return func(rw http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), clientKey, client)
+		ctx = context.WithValue(ctx, proxyHeaderVarsKey, vars)
+		inbound := &proxyInbound{}
+		req = req.WithContext(context.WithValue(ctx, proxyInboundKey, inbound))
+		inbound.req = req
+		next.ServeHTTP(rw, req)
+	}
+}
+
+// ok == false -> the request is not handled by proxyRequestHandler
+func inboundFromRequest(req *http.Request) (inbound *http.Request, ok bool) {
+	holder, ok := req.Context().Value(proxyInboundKey).(*proxyInbound)
+	if !ok {
+		return nil, false
+	}
+	return holder.req, true
+}
+
+// applied to the request sent to the target
+// untrusted peer -> incoming X-Forwarded-* and Forwarded are replaced, otherwise appended
+// X-Forwarded-For is appended by the ReverseProxy
+func setForwardedHeaders(outreq *http.Request) {
+	client := clientFromRequest(outreq)
+	if !client.trustedPeer {
+		outreq.Header.Del("X-Forwarded-For")
+		outreq.Header.Del("Forwarded")
+	}
+	outreq.Header.Set("X-Forwarded-Host", client.host)
+	outreq.Header.Set("X-Forwarded-Proto", client.proto)
+	forwarded := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(client.peer), forwardedValue(client.requestHost), client.requestProto)
+	if prior := outreq.Header.Values("Forwarded"); len(prior) > 0 {
+		forwarded = strings.Join(prior, ", ") + ", " + forwarded
+	}
+	outreq.Header.Set("Forwarded", forwarded)
+}
+
+// RFC 7239: IPv6 is quoted and bracketed
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// host with the port is quoted
+func forwardedValue(value string) string {
+	if strings.ContainsAny(value, ":[]") {
+		return `"` + value + `"`
+	}
+	return value
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveClient(t *testing.T) {
+	require := require.New(t)
+	trustedProxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.0.1"})
+	require.NoError(err)
+	resolve := func(remoteAddr string, forwardedFor ...string) clientInfo {
+		req := httptest.NewRequest(http.MethodGet, "http://alpha.untill.ru/foo", http.NoBody)
+		req.RemoteAddr = remoteAddr
+		for _, v := range forwardedFor {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+		req.Header.Set("X-Forwarded-Host", "spoofed.untill.ru")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		return resolveClient(req, trustedProxies)
+	}
+
+	t.Run("untrusted peer", func(t *testing.T) {
+		client := resolve("1.2.3.4:1234", "5.6.7.8")
+		require.Equal("1.2.3.4", client.ip)
+		require.Equal("alpha.untill.ru", client.host)
+		require.Equal("http", client.proto)
+		require.False(client.trustedPeer)
+	})
+
+	t.Run("trusted peer", func(t *testing.T) {
+		client := resolve("10.0.0.1:1234", "6.6.6.6, 5.6.7.8", "192.168.0.1")
+		require.Equal("5.6.7.8", client.ip)
+		require.Equal("10.0.0.1", client.peer)
+		require.Equal("spoofed.untill.ru", client.host)
+		require.Equal("alpha.untill.ru", client.requestHost)
+		require.Equal("https", client.proto)
+		require.True(client.trustedPeer)
+	})
+
+	t.Run("all trusted -> the leftmost", func(t *testing.T) {
+		require.Equal("10.0.0.2", resolve("10.0.0.1:1234", "10.0.0.2, 10.0.0.3").ip)
+	})
+
+	t.Run("malformed address stops the walk", func(t *testing.T) {
+		require.Equal("10.0.0.3", resolve("10.0.0.1:1234", "5.6.7.8, unknown, 10.0.0.3").ip)
+	})
+
+	t.Run("no forwarded for", func(t *testing.T) {
+		require.Equal("10.0.0.1", resolve("10.0.0.1:1234").ip)
+	})
+
+	t.Run("wrong trusted proxy", func(t *testing.T) {
+		_, err := parseTrustedProxies([]string{"10.0.0.0/33"})
+		require.Error(err)
+		_, err = parseTrustedProxies([]string{"localhost"})
+		require.Error(err)
+	})
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	require := require.New(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(rw).Encode(map[string]interface{}{"Host": req.Host, "Header": req.Header})
+	}))
+	defer upstream.Close()
+	newServer := func(trustedProxies ...string) *httptest.Server {
+		s := &httpService{RouterParams: RouterParams{
+			Routes:         map[string]string{"/grafana": upstream.URL, "/portal": upstream.URL},
+			RouteHeaders:   map[string]ProxyHeadersParams{"/portal": {PreserveHost: true}},
+			TrustedProxies: trustedProxies,
+		}}
+		var err error
+		s.trustedProxies, err = parseTrustedProxies(s.TrustedProxies)
+		require.NoError(err)
+		redirectMatcher, err := s.getRedirectMatcher()
+		require.NoError(err)
+		router := mux.NewRouter()
+		router.MatcherFunc(redirectMatcher)
+		server := httptest.NewServer(s.clientHandler(router))
+		t.Cleanup(server.Close)
+		return server
+	}
+	type proxied struct {
+		Host   string
+		Header http.Header
+	}
+	do := func(server *httptest.Server, path string) (res proxied) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, http.NoBody)
+		require.NoError(err)
+		req.Host = "alpha.untill.ru"
+		req.Header.Set("X-Forwarded-For", "5.6.7.8")
+		req.Header.Set("X-Forwarded-Host", "lb.untill.ru")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("Forwarded", "for=5.6.7.8")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(err)
+		defer resp.Body.Close()
+		require.NoError(json.NewDecoder(resp.Body).Decode(&res))
+		return res
+	}
+
+	t.Run("untrusted peer -> replaced", func(t *testing.T) {
+		res := do(newServer(), "/grafana/foo")
+		require.Equal("127.0.0.1", res.Header.Get("X-Forwarded-For"))
+		require.Equal("alpha.untill.ru", res.Header.Get("X-Forwarded-Host"))
+		require.Equal("http", res.Header.Get("X-Forwarded-Proto"))
+		require.Equal("for=127.0.0.1;host=alpha.untill.ru;proto=http", res.Header.Get("Forwarded"))
+		require.NotEqual("alpha.untill.ru", res.Host)
+	})
+
+	t.Run("trusted peer -> appended", func(t *testing.T) {
+		res := do(newServer("127.0.0.0/8"), "/grafana/foo")
+		require.Equal("5.6.7.8, 127.0.0.1", res.Header.Get("X-Forwarded-For"))
+		require.Equal("lb.untill.ru", res.Header.Get("X-Forwarded-Host"))
+		require.Equal("https", res.Header.Get("X-Forwarded-Proto"))
+		require.Equal("for=5.6.7.8, for=127.0.0.1;host=alpha.untill.ru;proto=http", res.Header.Get("Forwarded"))
+	})
+
+	t.Run("preserve host", func(t *testing.T) {
+		require.Equal("alpha.untill.ru", do(newServer(), "/portal/foo").Host)
+	})
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/untillpro/goutils/logger"
+)
+
+func newHealthCheck(params HealthCheckParams) (*HealthCheckParams, error) {
+	if !strings.HasPrefix(params.Path, "/") {
+		return nil, fmt.Errorf("health check path %s must have a leading slash", params.Path)
+	}
+	if params.Interval == 0 {
+		params.Interval = DefaultHealthCheckInterval
+	}
+	if params.Timeout == 0 {
+		params.Timeout = DefaultHealthCheckTimeout
+	}
+	if params.HealthyThreshold == 0 {
+		params.HealthyThreshold = DefaultHealthyThreshold
+	}
+	if params.UnhealthyThreshold == 0 {
+		params.UnhealthyThreshold = DefaultUnhealthyThreshold
+	}
+	if params.Interval < 0 || params.Timeout < 0 || params.HealthyThreshold < 0 || params.UnhealthyThreshold < 0 {
+		return nil, fmt.Errorf("health check %s: negative values are not allowed", params.Path)
+	}
+	return &params, nil
+}
+
+// checks are stopped when the router is stopped
+func (s *httpService) runHealthChecks(ctx context.Context) {
+	for _, pool := range s.upstreams {
+		if pool.healthCheck == nil {
+			continue
+		}
+		go func(pool *upstreamPool) {
+			ticker := time.NewTicker(time.Duration(pool.healthCheck.Interval) * time.Second)
+			defer ticker.Stop()
+			for {
+				s.checkUpstreams(ctx, pool)
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				case <-s.stopping:
+					return
+				}
+			}
+		}(pool)
+	}
+}
+
+func (s *httpService) checkUpstreams(ctx context.Context, pool *upstreamPool) {
+	client := &http.Client{
+		Timeout: time.Duration(pool.healthCheck.Timeout) * time.Second,
+		// redirect is a response of the alive target
+		CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	if pool.transport != nil {
+		// the same TLS settings as for the proxied requests
+		client.Transport = pool.transport
+	}
+	for _, u := range pool.upstreams {
+		err := checkUpstream(ctx, client, u, pool.healthCheck.Path)
+		if err != nil {
+			s.metrics.healthCheckFailures.Add(1)
+		}
+		u.reportHealth(pool.route, err, pool.healthCheck)
+	}
+}
+
+func checkUpstream(ctx context.Context, client *http.Client, u *upstream, path string) error {
+	checkURL := *u.targetURL
+	checkURL.Path = path
+	checkURL.RawQuery = ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checkURL.String(), http.NoBody)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("%s returned %d", checkURL.String(), resp.StatusCode)
+	}
+	return nil
+}
+
+// the status is flipped after the threshold of consecutive results
+func (u *upstream) reportHealth(route string, err error, params *HealthCheckParams) {
+	if err == nil {
+		u.failures = 0
+		u.successes++
+		if u.unhealthy.Load() && u.successes >= params.HealthyThreshold {
+			u.unhealthy.Store(false)
+			logger.Info("reverse proxy route ", route, " target ", u.targetURL, " is healthy")
+		}
+		return
+	}
+	u.successes = 0
+	u.failures++
+	if logger.IsVerbose() {
+		logger.Verbose("reverse proxy route ", route, " target ", u.targetURL, " health check failed: ", err)
+	}
+	if !u.unhealthy.Load() && u.failures >= params.UnhealthyThreshold {
+		u.unhealthy.Store(true)
+		logger.Error("reverse proxy route ", route, " target ", u.targetURL, " is unhealthy: ", err)
+	}
+}
+
+func (s *httpService) upstreamStatuses() []upstreamStatus {
+	res := []upstreamStatus{}
+	for _, pool := range s.upstreams {
+		for _, u := range pool.upstreams {
+			res = append(res, upstreamStatus{
+				Route:   pool.route,
+				Target:  u.target(),
+				Healthy: !u.unhealthy.Load(),
+				Active:  u.active.Load(),
+			})
+		}
+	}
+	return res
+}
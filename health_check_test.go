@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthChecks(t *testing.T) {
+	require := require.New(t)
+	var targets []string
+	var healthy [2]atomic.Bool
+	for i := range healthy {
+		i := i
+		healthy[i].Store(true)
+		upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/health" && !healthy[i].Load() {
+				rw.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = rw.Write([]byte(fmt.Sprintf("upstream%d", i)))
+		}))
+		defer upstream.Close()
+		targets = append(targets, upstream.URL)
+	}
+	s := &httpService{RouterParams: RouterParams{
+		Routes:            map[string]string{"/app": targets[0] + ";" + targets[1], "/unchecked": targets[0]},
+		RouteHealthChecks: map[string]HealthCheckParams{"/app": {Path: "/health", HealthyThreshold: 1, UnhealthyThreshold: 2}},
+	}}
+	redirectMatcher, err := s.getRedirectMatcher()
+	require.NoError(err)
+	router := mux.NewRouter()
+	router.MatcherFunc(redirectMatcher)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	var pool *upstreamPool
+	for _, p := range s.upstreams {
+		if p.route == "/app" {
+			pool = p
+		}
+	}
+	require.NotNil(pool.healthCheck)
+	require.Equal(DefaultHealthCheckInterval, pool.healthCheck.Interval)
+	get := func() (status int, body string) {
+		resp, err := http.Get(server.URL + "/app/foo")
+		require.NoError(err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(err)
+		return resp.StatusCode, string(data)
+	}
+	upstreams := func() (res []upstreamStatus) {
+		rec := httptest.NewRecorder()
+		s.upstreamsHandler(rec, httptest.NewRequest(http.MethodGet, "/upstreams", http.NoBody))
+		require.NoError(json.Unmarshal(rec.Body.Bytes(), &res))
+		return res
+	}
+	ctx := context.Background()
+
+	// one failure is below the threshold
+	healthy[0].Store(false)
+	s.checkUpstreams(ctx, pool)
+	require.False(pool.upstreams[0].unhealthy.Load())
+	s.checkUpstreams(ctx, pool)
+	require.True(pool.upstreams[0].unhealthy.Load())
+	for i := 0; i < 4; i++ {
+		status, body := get()
+		require.Equal(http.StatusOK, status)
+		require.Equal("upstream1", body)
+	}
+	require.Contains(upstreams(), upstreamStatus{Route: "/app", Target: targets[0], Healthy: false})
+	require.Contains(upstreams(), upstreamStatus{Route: "/app", Target: targets[1], Healthy: true})
+
+	// no healthy targets -> 503
+	healthy[1].Store(false)
+	s.checkUpstreams(ctx, pool)
+	s.checkUpstreams(ctx, pool)
+	status, _ := get()
+	require.Equal(http.StatusServiceUnavailable, status)
+
+	// back to rotation
+	healthy[0].Store(true)
+	s.checkUpstreams(ctx, pool)
+	status, body := get()
+	require.Equal(http.StatusOK, status)
+	require.Equal("upstream0", body)
+
+	rec := httptest.NewRecorder()
+	s.metricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody))
+	metrics := map[string]int64{}
+	require.NoError(json.Unmarshal(rec.Body.Bytes(), &metrics))
+	require.Equal(int64(7), metrics["healthCheckFailures"])
+	require.Equal(int64(2), metrics["upstreamsHealthy"])
+	require.Equal(int64(1), metrics["upstreamsUnhealthy"])
+
+	t.Run("errors", func(t *testing.T) {
+		s := &httpService{RouterParams: RouterParams{
+			Routes:            map[string]string{"/app": targets[0]},
+			RouteHealthChecks: map[string]HealthCheckParams{"/unknown": {Path: "/health"}},
+		}}
+		_, err := s.getRedirectMatcher()
+		require.Error(err)
+		s.RouteHealthChecks = map[string]HealthCheckParams{"/app": {Path: "health"}}
+		_, err = s.getRedirectMatcher()
+		require.Error(err)
+	})
+}
@@ -0,0 +1,263 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/untillpro/goutils/logger"
+	coreutils "github.com/voedger/voedger/pkg/utils"
+)
+
+// idempotencyKeyScope returns the store key: the Idempotency-Key is scoped per app, WSID and principal
+// principal is the login verified at the edge, otherwise the token. Hashed to avoid keeping tokens in the store
+func idempotencyKeyScope(req *http.Request, p principal, idempotencyKey string) string {
+	vars := mux.Vars(req)
+	principalID := "token:" + p.token
+	if p.claims != nil {
+		principalID = "login:" + p.claims.Login
+	}
+	principalHash := sha256.Sum256([]byte(principalID))
+	return vars[bp3AppOwner] + "/" + vars[bp3AppName] + "/" + vars[queueAliasVar] + "/" + vars[wSIDVar] + "/" +
+		hex.EncodeToString(principalHash[:]) + "/" + idempotencyKey
+}
+
+// requestFingerprint is used to detect the same Idempotency-Key reused for a different request
+func requestFingerprint(req *http.Request, body []byte) string {
+	h := sha256.New()
+	_, _ = h.Write([]byte(req.Method + " " + req.URL.Path + "\n")) // error impossible
+	_, _ = h.Write(body)                                           // error impossible
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// honors Idempotency-Key header on POST and PATCH: the first response is stored for ttl and replayed on retries
+// concurrent duplicates wait for the in-flight request
+// anonymous requests are not idempotent: nothing to scope the key by
+func idempotencyHandler(store IIdempotencyStore, ttl time.Duration, h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		idempotencyKey := r.Header.Get(idempotencyKeyHeader)
+		p, authenticated := principalFromContext(r.Context())
+		if len(idempotencyKey) == 0 || (r.Method != http.MethodPost && r.Method != http.MethodPatch) || !authenticated {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if len(idempotencyKey) > maxIdempotencyKeyLen {
+			writeTextResponse(w, "Idempotency-Key header is too long", http.StatusBadRequest)
+			return
+		}
+		// the body is buffered to be hashed -> limited like the stored responses
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentRequestBodySize))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				writeTextResponse(w, "request body is too large for Idempotency-Key", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "failed to read body", http.StatusInternalServerError)
+			return
+		}
+		key := idempotencyKeyScope(r, p, idempotencyKey)
+		fingerprint := requestFingerprint(r, body)
+		stored, err := store.Acquire(r.Context(), key)
+		if err != nil {
+			// client disconnected while waiting for the in-flight request
+			return
+		}
+		if stored != nil {
+			if stored.RequestFingerprint != fingerprint {
+				writeTextResponse(w, "Idempotency-Key is already used for a different request", http.StatusUnprocessableEntity)
+				return
+			}
+			if logger.IsVerbose() {
+				logger.Verbose("idempotent replay: ", key)
+			}
+			w.Header().Set(idempotentReplayedHeader, "true")
+			if len(stored.ContentType) > 0 {
+				w.Header().Set(coreutils.ContentType, stored.ContentType)
+			}
+			w.WriteHeader(stored.StatusCode)
+			writeResponse(w, string(stored.Data))
+			return
+		}
+
+		// key acquired -> handle the request and remember the response
+		rec := &idempotencyRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		r.Body = http.NoBody
+		if len(body) > 0 {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		completed := false
+		defer func() {
+			// do not remember server failures, let the client retry
+			// client disconnected or failed to write -> the recorded body could be truncated
+			// too big response -> not remembered to limit the store memory
+			if !completed || rec.statusCode >= http.StatusInternalServerError || rec.writeErr != nil || r.Context().Err() != nil ||
+				rec.tooBig {
+				store.Release(key)
+				return
+			}
+			store.Store(key, IdempotentResponse{
+				StatusCode:         rec.statusCode,
+				ContentType:        rec.Header().Get(coreutils.ContentType),
+				Data:               rec.body.Bytes(),
+				RequestFingerprint: fingerprint,
+			}, ttl)
+		}()
+		h.ServeHTTP(rec, r)
+		completed = true
+	}
+}
+
+// writes the response through to the client and keeps a copy up to maxIdempotentResponseSize
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+	tooBig     bool
+	writeErr   error
+}
+
+func (r *idempotencyRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *idempotencyRecorder) Write(data []byte) (int, error) {
+	if !r.tooBig {
+		if r.body.Len()+len(data) > maxIdempotentResponseSize {
+			r.tooBig = true
+			r.body = bytes.Buffer{}
+		} else {
+			_, _ = r.body.Write(data) // error impossible
+		}
+	}
+	n, err := r.ResponseWriter.Write(data)
+	if err != nil && r.writeErr == nil {
+		r.writeErr = err
+	}
+	return n, err
+}
+
+func (r *idempotencyRecorder) Flush() {
+	if err := http.NewResponseController(r.ResponseWriter).Flush(); err != nil && r.writeErr == nil {
+		r.writeErr = err
+	}
+}
+
+// used by http.ResponseController
+func (r *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+type idempotencyEntry struct {
+	resp      *IdempotentResponse // nil -> in-flight
+	expiresAt time.Time
+	done      chan struct{} // closed when in-flight request is finished
+	size      int
+	stored    *list.Element // position in the eviction order, nil -> in-flight
+}
+
+type implIIdempotencyStoreMem struct {
+	sync.Mutex
+	entries   map[string]*idempotencyEntry
+	stored    *list.List // keys of the stored responses, oldest first
+	size      int        // bytes of the stored responses
+	maxSize   int        // exceeded -> the oldest responses are evicted
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func (s *implIIdempotencyStoreMem) Acquire(ctx context.Context, key string) (stored *IdempotentResponse, err error) {
+	for {
+		s.Lock()
+		e, ok := s.entries[key]
+		if ok && e.resp != nil && !s.now().Before(e.expiresAt) {
+			s.drop(key, e)
+			ok = false
+		}
+		if !ok {
+			s.entries[key] = &idempotencyEntry{done: make(chan struct{})}
+			s.Unlock()
+			return nil, nil
+		}
+		if e.resp != nil {
+			s.Unlock()
+			return e.resp, nil
+		}
+		s.Unlock()
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *implIIdempotencyStoreMem) Store(key string, resp IdempotentResponse, ttl time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	now := s.now()
+	s.sweep(now)
+	e, ok := s.entries[key]
+	switch {
+	case !ok:
+		e = &idempotencyEntry{done: make(chan struct{})}
+		s.entries[key] = e
+	case e.resp == nil:
+		defer close(e.done)
+	default:
+		s.size -= e.size
+		s.stored.Remove(e.stored)
+	}
+	e.resp = &resp
+	e.expiresAt = now.Add(ttl)
+	e.size = len(key) + len(resp.ContentType) + len(resp.Data) + len(resp.RequestFingerprint)
+	e.stored = s.stored.PushBack(key)
+	s.size += e.size
+	for s.size > s.maxSize {
+		// the oldest responses expire first, the ttl is the same
+		oldest := s.stored.Front().Value.(string)
+		s.drop(oldest, s.entries[oldest])
+	}
+}
+
+func (s *implIIdempotencyStoreMem) Release(key string) {
+	s.Lock()
+	defer s.Unlock()
+	if e, ok := s.entries[key]; ok && e.resp == nil {
+		delete(s.entries, key)
+		close(e.done)
+	}
+}
+
+// must be called under lock
+func (s *implIIdempotencyStoreMem) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < idempotencySweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, e := range s.entries {
+		if e.resp != nil && !now.Before(e.expiresAt) {
+			s.drop(key, e)
+		}
+	}
+}
+
+// stored response only, must be called under lock
+func (s *implIIdempotencyStoreMem) drop(key string, e *idempotencyEntry) {
+	delete(s.entries, key)
+	s.stored.Remove(e.stored)
+	s.size -= e.size
+}
@@ -0,0 +1,247 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotencyStoreMem(t *testing.T) {
+	require := require.New(t)
+	now := time.Now()
+	store := ProvideIdempotencyStoreMem().(*implIIdempotencyStoreMem)
+	store.now = func() time.Time { return now }
+
+	// first request acquires the key
+	stored, err := store.Acquire(context.Background(), "key")
+	require.NoError(err)
+	require.Nil(stored)
+
+	// concurrent duplicate waits for the in-flight request
+	duplicateDone := make(chan *IdempotentResponse)
+	go func() {
+		stored, err := store.Acquire(context.Background(), "key")
+		require.NoError(err)
+		duplicateDone <- stored
+	}()
+	store.Store("key", IdempotentResponse{StatusCode: http.StatusOK, Data: []byte("resp")}, time.Minute)
+	stored = <-duplicateDone
+	require.Equal([]byte("resp"), stored.Data)
+
+	// expired -> acquired again
+	now = now.Add(time.Minute)
+	stored, err = store.Acquire(context.Background(), "key")
+	require.NoError(err)
+	require.Nil(stored)
+
+	// released -> acquired again
+	store.Release("key")
+	stored, err = store.Acquire(context.Background(), "key")
+	require.NoError(err)
+	require.Nil(stored)
+
+	// ctx done while waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = store.Acquire(ctx, "key")
+	require.ErrorIs(err, context.Canceled)
+}
+
+func TestIdempotencyStoreMemMaxSize(t *testing.T) {
+	require := require.New(t)
+	store := ProvideIdempotencyStoreMem().(*implIIdempotencyStoreMem)
+	store.maxSize = 30
+	put := func(key string) {
+		stored, err := store.Acquire(context.Background(), key)
+		require.NoError(err)
+		require.Nil(stored)
+		store.Store(key, IdempotentResponse{StatusCode: http.StatusOK, Data: []byte("0123456789")}, time.Minute)
+	}
+	isStored := func(key string) bool {
+		store.Lock()
+		defer store.Unlock()
+		e, ok := store.entries[key]
+		return ok && e.resp != nil
+	}
+
+	put("key1")
+	put("key2")
+	require.True(isStored("key1"))
+
+	// 3 * (4 + 10) > 30 -> the oldest is evicted
+	put("key3")
+	require.False(isStored("key1"))
+	require.True(isStored("key2"))
+	require.True(isStored("key3"))
+	require.Equal(28, store.size)
+
+	// in-flight requests are not evicted
+	stored, err := store.Acquire(context.Background(), "key4")
+	require.NoError(err)
+	require.Nil(stored)
+	put("key5")
+	require.False(isStored("key2"))
+	_, inFlight := store.entries["key4"]
+	require.True(inFlight)
+	store.Release("key4")
+	require.Equal(2, store.stored.Len())
+}
+
+func TestIdempotencyHandler(t *testing.T) {
+	require := require.New(t)
+	var handled int32
+	h := idempotencyHandler(ProvideIdempotencyStoreMem(), time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&handled, 1)
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"body":"` + string(body) + `"}`))
+	}))
+	sendAs := func(idempotencyKey string, p *principal, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/untill/airs-bp/1/c.sys.Init", strings.NewReader(body))
+		req = mux.SetURLVars(req, map[string]string{bp3AppOwner: "untill", bp3AppName: "airs-bp", wSIDVar: "1"})
+		req.Header.Set(idempotencyKeyHeader, idempotencyKey)
+		if p != nil {
+			req = req.WithContext(context.WithValue(req.Context(), principalKey, *p))
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	send := func(idempotencyKey, token, body string) *httptest.ResponseRecorder {
+		return sendAs(idempotencyKey, &principal{token: token}, body)
+	}
+
+	t.Run("replay", func(t *testing.T) {
+		atomic.StoreInt32(&handled, 0)
+		resp := send("key1", "1", "order")
+		require.Equal(http.StatusCreated, resp.Code)
+		require.Empty(resp.Header().Get(idempotentReplayedHeader))
+
+		resp = send("key1", "1", "order")
+		require.Equal(http.StatusCreated, resp.Code)
+		require.Equal(`{"body":"order"}`, resp.Body.String())
+		require.Equal("application/json", resp.Header().Get("Content-Type"))
+		require.Equal("true", resp.Header().Get(idempotentReplayedHeader))
+		require.Equal(int32(1), atomic.LoadInt32(&handled))
+	})
+
+	t.Run("scoped per principal", func(t *testing.T) {
+		atomic.StoreInt32(&handled, 0)
+		send("key2", "1", "order")
+		resp := send("key2", "2", "order")
+		require.Empty(resp.Header().Get(idempotentReplayedHeader))
+		require.Equal(int32(2), atomic.LoadInt32(&handled))
+	})
+
+	t.Run("scoped per verified login", func(t *testing.T) {
+		atomic.StoreInt32(&handled, 0)
+		sendAs("key5", &principal{token: "1", claims: &principalTokenClaims{Login: "paa"}}, "order")
+		// refreshed token of the same login
+		resp := sendAs("key5", &principal{token: "2", claims: &principalTokenClaims{Login: "paa"}}, "order")
+		require.Equal("true", resp.Header().Get(idempotentReplayedHeader))
+		resp = sendAs("key5", &principal{token: "1", claims: &principalTokenClaims{Login: "other"}}, "order")
+		require.Empty(resp.Header().Get(idempotentReplayedHeader))
+		require.Equal(int32(2), atomic.LoadInt32(&handled))
+	})
+
+	t.Run("anonymous", func(t *testing.T) {
+		atomic.StoreInt32(&handled, 0)
+		sendAs("key6", nil, "order")
+		resp := sendAs("key6", nil, "order")
+		require.Empty(resp.Header().Get(idempotentReplayedHeader))
+		require.Equal(int32(2), atomic.LoadInt32(&handled))
+	})
+
+	t.Run("different request with the same key", func(t *testing.T) {
+		send("key3", "1", "order")
+		resp := send("key3", "1", "another order")
+		require.Equal(http.StatusUnprocessableEntity, resp.Code)
+	})
+
+	t.Run("concurrent duplicates", func(t *testing.T) {
+		atomic.StoreInt32(&handled, 0)
+		wg := sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				require.Equal(`{"body":"order"}`, send("key4", "1", "order").Body.String())
+			}()
+		}
+		wg.Wait()
+		require.Equal(int32(1), atomic.LoadInt32(&handled))
+	})
+}
+
+func TestIdempotencyHandlerNotRemembered(t *testing.T) {
+	require := require.New(t)
+	var handled int32
+	h := idempotencyHandler(ProvideIdempotencyStoreMem(), time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&handled, 1)
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(err)
+		if string(body) == "big" {
+			_, _ = w.Write([]byte(strings.Repeat("x", maxIdempotentResponseSize)))
+		}
+		_, _ = w.Write([]byte("ok"))
+		w.(http.Flusher).Flush()
+	}))
+	send := func(ctx context.Context, w http.ResponseWriter, idempotencyKey, body string) {
+		req := httptest.NewRequest(http.MethodPost, "/api/untill/airs-bp/1/c.sys.Init", strings.NewReader(body)).
+			WithContext(context.WithValue(ctx, principalKey, principal{token: "1"}))
+		req.Header.Set(idempotencyKeyHeader, idempotencyKey)
+		h.ServeHTTP(w, req)
+	}
+	requireHandledTwice := func(send func()) {
+		atomic.StoreInt32(&handled, 0)
+		send()
+		send()
+		require.Equal(int32(2), atomic.LoadInt32(&handled))
+	}
+
+	t.Run("too big", func(t *testing.T) {
+		requireHandledTwice(func() { send(context.Background(), httptest.NewRecorder(), "key1", "big") })
+	})
+
+	t.Run("client disconnected", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		requireHandledTwice(func() { send(ctx, httptest.NewRecorder(), "key2", "order") })
+	})
+
+	t.Run("write failed", func(t *testing.T) {
+		requireHandledTwice(func() { send(context.Background(), failingWriter{httptest.NewRecorder()}, "key3", "order") })
+	})
+
+	t.Run("request body too large", func(t *testing.T) {
+		atomic.StoreInt32(&handled, 0)
+		rec := httptest.NewRecorder()
+		send(context.Background(), rec, "key4", strings.Repeat("x", maxIdempotentRequestBodySize+1))
+		require.Equal(http.StatusRequestEntityTooLarge, rec.Code)
+		require.Zero(atomic.LoadInt32(&handled))
+	})
+}
+
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	istructs "github.com/voedger/voedger/pkg/istructs"
+)
+
+// principal token claims checked by the router
+type principalTokenClaims struct {
+	jwt.RegisteredClaims
+	AppQName istructs.AppQName `json:"AppQName"`
+	Login    string            `json:"Login"`
+}
+
+// JSON Web Key Set, reply of the app keys query function
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	K   string `json:"k"`   // oct
+	N   string `json:"n"`   // RSA
+	E   string `json:"e"`   // RSA
+	Crv string `json:"crv"` // EC
+	X   string `json:"x"`   // EC
+	Y   string `json:"y"`   // EC
+}
+
+var (
+	errUnknownKeyID          = errors.New("token key is unknown")
+	errInvalidTokenSignature = errors.New("token signature is invalid")
+)
+
+// "none" and any other algorithm are rejected
+var jwtAlgorithms = []string{"HS256", "HS384", "HS512", "RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}
+
+func parseJWKS(data []byte) (keys []AppKey, err error) {
+	set := jwks{}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+	for _, k := range set.Keys {
+		key := AppKey{KeyID: k.Kid, Algorithm: k.Alg}
+		switch k.Kty {
+		case "oct":
+			key.Key, err = base64.RawURLEncoding.DecodeString(k.K)
+		case "RSA":
+			key.Key, err = parseRSAPublicKey(k)
+		case "EC":
+			key.Key, err = parseECPublicKey(k)
+		default:
+			err = fmt.Errorf("unsupported key type %s", k.Kty)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key %s: %w", k.Kid, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func parseRSAPublicKey(k jwk) (*rsa.PublicKey, error) {
+	n, err := decodeBigInt(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeBigInt(k.E)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func parseECPublicKey(k jwk) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+	}
+	x, err := decodeBigInt(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeBigInt(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// errUnknownKeyID, errInvalidTokenSignature -> keys could be rotated
+func verifyJWT(token string, keys []AppKey, now time.Time) (claims principalTokenClaims, err error) {
+	parser := jwt.NewParser(jwt.WithValidMethods(jwtAlgorithms), jwt.WithExpirationRequired(), jwt.WithLeeway(jwtLeeway),
+		jwt.WithTimeFunc(func() time.Time { return now }))
+	keysMatched := false
+	_, err = parser.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		set := jwt.VerificationKeySet{}
+		for _, key := range keys {
+			if (len(kid) > 0 && len(key.KeyID) > 0 && kid != key.KeyID) ||
+				(len(key.Algorithm) > 0 && key.Algorithm != t.Method.Alg()) ||
+				!keyMatchesMethod(key.Key, t.Method) {
+				continue
+			}
+			set.Keys = append(set.Keys, key.Key)
+		}
+		if len(set.Keys) == 0 {
+			return nil, errUnknownKeyID
+		}
+		keysMatched = true
+		return set, nil
+	})
+	if keysMatched && errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+		// not the algorithm rejected before the keys are chosen
+		return claims, errInvalidTokenSignature
+	}
+	return claims, err
+}
+
+// e.g. HS token must not be verified by the RSA public key used as the HMAC secret
+func keyMatchesMethod(key interface{}, method jwt.SigningMethod) (ok bool) {
+	switch method.(type) {
+	case *jwt.SigningMethodHMAC:
+		_, ok = key.([]byte)
+	case *jwt.SigningMethodRSA:
+		_, ok = key.(*rsa.PublicKey)
+	case *jwt.SigningMethodECDSA:
+		_, ok = key.(*ecdsa.PublicKey)
+	}
+	return ok
+}
+
+// claims are not verified. Used to choose the keys to verify the token with
+func unverifiedTokenClaims(token string) (claims principalTokenClaims, err error) {
+	if _, _, err = jwt.NewParser().ParseUnverified(token, &claims); err != nil {
+		return claims, fmt.Errorf("failed to parse token claims: %w", err)
+	}
+	return claims, nil
+}
@@ -5,15 +5,15 @@
 package router2
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
-	"strconv"
 	"time"
 
-	"github.com/gorilla/mux"
 	"github.com/untillpro/goutils/logger"
 	"github.com/voedger/voedger/pkg/in10n"
 	istructs "github.com/voedger/voedger/pkg/istructs"
@@ -21,170 +21,429 @@ import (
 
 /*
 curl -G --data-urlencode "payload={\"SubjectLogin\": \"paa\", \"ProjectionKey\":[{\"App\":\"Application\",\"Projection\":\"paa.price\",\"WS\":1}, {\"App\":\"Application\",\"Projection\":\"paa.wine_price\",\"WS\":1}]}" https://alpha2.dev.untill.ru/n10n/channel -H "Content-Type: application/json"
+or POST with the payload in the body
 */
 func (s *httpService) subscribeAndWatchHandler() http.HandlerFunc {
 	return func(rw http.ResponseWriter, req *http.Request) {
 		var (
 			urlParams createChannelParamsType
-			channel   in10n.ChannelID
+			ch        *n10nChannel
 			flusher   http.Flusher
 			err       error
 		)
 		rw.Header().Set("Content-Type", "text/event-stream")
 		rw.Header().Set("Cache-Control", "no-cache")
 		rw.Header().Set("Connection", "keep-alive")
-		jsonParam, ok := req.URL.Query()["payload"]
-		if !ok || len(jsonParam[0]) < 1 {
-			err = errors.New("query parameter with payload (SubjectLogin id and ProjectionKey) is missing")
-			logger.Error(err)
-			http.Error(rw, err.Error(), http.StatusBadRequest)
+		if err = getJsonPayload(req, &urlParams); err != nil {
+			writeN10NError(rw, err, http.StatusBadRequest)
 			return
 		}
-		err = json.Unmarshal([]byte(jsonParam[0]), &urlParams)
-		if err != nil {
-			err = fmt.Errorf("cannot unmarshal input payload %w", err)
-			logger.Error(err)
-			http.Error(rw, err.Error(), http.StatusBadRequest)
+		logger.Info("n10n subscribeAndWatch: ", urlParams)
+		var v2 bool
+		switch format := req.URL.Query().Get(sseFormatParam); format {
+		case "":
+		case sseFormatV2:
+			v2 = true
+		default:
+			writeN10NError(rw, fmt.Errorf("unknown format %s", format), http.StatusBadRequest)
+			return
+		}
+		login, ok := s.authorizeN10N(rw, req, urlParams.ProjectionKey)
+		if !ok {
+			return
+		}
+		if len(urlParams.SubjectLogin) > 0 && urlParams.SubjectLogin != login {
+			writeN10NError(rw, errors.New("SubjectLogin does not match the principal login"), http.StatusForbidden)
 			return
 		}
-		logger.Info("n10n subscribeAndWatch: ", urlParams)
 		flusher, ok = rw.(http.Flusher)
 		if !ok {
-			http.Error(rw, "Streaming unsupported!", http.StatusInternalServerError)
+			writeN10NError(rw, errors.New("streaming unsupported"), http.StatusInternalServerError)
 			return
 		}
-		channel, err = s.n10n.NewChannel(urlParams.SubjectLogin, 24*time.Hour)
-		if err != nil {
+		var lastSeq uint64
+		if lastEventID := req.Header.Get(lastEventIDHeader); len(lastEventID) > 0 {
+			// reconnect -> reattach to the channel if it is still alive
+			channelID, seq, err := parseEventID(lastEventID)
+			if err != nil {
+				writeN10NError(rw, err, http.StatusBadRequest)
+				return
+			}
+			var status int
+			if ch, status, err = s.n10nChannels.get(channelID, login); err != nil && status != http.StatusNotFound {
+				writeN10NError(rw, err, status)
+				return
+			}
+			lastSeq = seq
+		}
+		isNewChannel := ch == nil
+		if isNewChannel {
+			if ch, err = s.openN10NChannel(login, urlParams.ProjectionKey); err != nil {
+				logger.Error(err)
+				writeN10NError(rw, err, n10nErrorStatus(err))
+				return
+			}
+			lastSeq = 0
+		}
+		// reattach -> the projections the channel has already are not subscribed again
+		if err = ch.subscribe(s.n10n, urlParams.ProjectionKey, s.N10NMaxProjectionsPerChannel); err != nil {
 			logger.Error(err)
-			http.Error(rw, "Error create new channel", http.StatusTooManyRequests)
+			if isNewChannel {
+				ch.cancel()
+			}
+			writeN10NError(rw, err, n10nErrorStatus(err))
 			return
 		}
-		if _, err = fmt.Fprintf(rw, "event: channelId\ndata: %s\n\n", channel); err != nil {
+		stream, replay := ch.attach(lastSeq)
+		// write failure -> the stream is detached, the channel is kept for N10NResumeTimeout to be resumed by Last-Event-ID
+		defer ch.detach(stream, time.Duration(s.N10NResumeTimeout)*time.Second)
+		rc := http.NewResponseController(rw)
+		// the server WriteTimeout is less than the stream lifetime -> the deadline is extended per write
+		extendWriteDeadline := func() {
+			_ = rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout)) // not supported -> the server WriteTimeout is kept
+		}
+		extendWriteDeadline()
+		if s.SSERetry > 0 {
+			if _, err = fmt.Fprintf(rw, "retry: %d\n", s.SSERetry); err != nil {
+				logger.Error("failed to write retry to client:", err)
+				return
+			}
+		}
+		if _, err = fmt.Fprintf(rw, "event: channelId\nid: %s\ndata: %s\n\n", ch.eventID(lastSeq), ch.id); err != nil {
 			logger.Error("failed to write created channel id to client:", err)
 			return
 		}
 		flusher.Flush()
-		for _, projection := range urlParams.ProjectionKey {
-			err = s.n10n.Subscribe(channel, projection)
-			if err != nil {
-				logger.Error(err)
-				http.Error(rw, err.Error(), http.StatusInternalServerError)
+		for _, event := range replay {
+			if err = writeSSEEvent(rw, ch, event, v2); err != nil {
 				return
 			}
 		}
-		ch := make(chan UpdateUnit)
-		go func() {
-			defer close(ch)
-			s.n10n.WatchChannel(req.Context(), channel, func(projection in10n.ProjectionKey, offset istructs.Offset) {
-				var unit = UpdateUnit{
-					Projection: projection,
-					Offset:     offset,
+		var heartbeat <-chan time.Time
+		if s.SSEHeartbeatInterval > 0 {
+			ticker := time.NewTicker(time.Duration(s.SSEHeartbeatInterval) * time.Second)
+			defer ticker.Stop()
+			heartbeat = ticker.C
+		}
+		// flush error -> the client is gone
+		for err = rc.Flush(); err == nil; err = rc.Flush() {
+			select {
+			case <-stream.ready:
+				extendWriteDeadline()
+				for _, event := range ch.coalesce(req.Context(), stream, s.n10nCoalesceWindow()) {
+					if err = writeSSEEvent(rw, ch, event, v2); err != nil {
+						break
+					}
 				}
-				ch <- unit
-			})
-		}()
-		for req.Context().Err() == nil {
-			var (
-				projection, offset []byte
-			)
-			result, ok := <-ch
-			if !ok {
+			case <-heartbeat:
+				extendWriteDeadline()
+				err = s.writeSSEHeartbeat(rw)
+			case <-stream.detached:
+				logger.Info("n10n stream is attached to another connection: ", ch.id)
+				return
+			case <-ch.watchDone:
 				logger.Info("watch done")
-				break
-			}
-			projection, err = json.Marshal(&result.Projection)
-			if err == nil {
-				if _, err = fmt.Fprintf(rw, "event: %s\n", projection); err != nil {
-					logger.Error("failed to write projection key event to client:", err)
-				}
+				extendWriteDeadline()
+				s.writeSSEShutdown(rw, rc)
+				return
+			case <-s.stopping:
+				extendWriteDeadline()
+				s.writeSSEShutdown(rw, rc)
+				ch.cancel()
+				return
+			case <-req.Context().Done():
+				s.writeSSEShutdown(rw, rc)
+				return
 			}
-			offset, _ = json.Marshal(&result.Offset) // error impossible
-			if _, err = fmt.Fprintf(rw, "data: %s\n\n", offset); err != nil {
-				logger.Error("failed to write projection key offset to client:", err)
+			if err != nil {
+				break
 			}
-			flusher.Flush()
 		}
+		logger.Error("failed to write to n10n SSE client, stream is detached: ", err)
+	}
+}
+
+func (s *httpService) writeSSEHeartbeat(rw http.ResponseWriter) (err error) {
+	heartbeat := sseHeartbeatComment
+	if s.SSEHeartbeatEvent {
+		heartbeat = sseHeartbeatEvent
+	}
+	_, err = fmt.Fprint(rw, heartbeat)
+	return err
+}
+
+// router is stopping -> clients should reconnect to another instance
+func (s *httpService) writeSSEShutdown(rw http.ResponseWriter, rc *http.ResponseController) {
+	select {
+	case <-s.stopping:
+	default:
+		if s.ctx == nil || s.ctx.Err() == nil {
+			// client disconnected or the channel is closed
+			return
+		}
+	}
+	if _, err := fmt.Fprint(rw, sseShutdownEvent); err == nil {
+		_ = rc.Flush()
+	}
+}
+
+// v2: event: update, data: {"App":"untill/airs-bp","Projection":"paa.price","WS":1,"Offset":13,"Timestamp":1683024000000}
+// otherwise event is the projection key, data is the offset
+func writeSSEEvent(rw http.ResponseWriter, ch *n10nChannel, event n10nEvent, v2 bool) (err error) {
+	if v2 {
+		data, _ := json.Marshal(sseUpdateData{ // error impossible
+			App:        event.Projection.App,
+			Projection: event.Projection.Projection,
+			WS:         event.Projection.WS,
+			Offset:     event.Offset,
+			Timestamp:  event.timestamp,
+		})
+		if _, err = fmt.Fprintf(rw, "event: update\nid: %s\ndata: %s\n\n", ch.eventID(event.seq), data); err != nil {
+			logger.Error("failed to write update event to client:", err)
+		}
+		return err
 	}
+	projection, err := json.Marshal(&event.Projection)
+	if err == nil {
+		if _, err = fmt.Fprintf(rw, "event: %s\nid: %s\n", projection, ch.eventID(event.seq)); err != nil {
+			logger.Error("failed to write projection key event to client:", err)
+			return err
+		}
+	}
+	offset, _ := json.Marshal(&event.Offset) // error impossible
+	if _, err = fmt.Fprintf(rw, "data: %s\n\n", offset); err != nil {
+		logger.Error("failed to write projection key offset to client:", err)
+	}
+	return err
 }
 
 /*
 curl -G --data-urlencode "payload={\"Channel\": \"a23b2050-b90c-4ed1-adb7-1ecc4f346f2b\", \"ProjectionKey\":[{\"App\":\"Application\",\"Projection\":\"paa.wine_price\",\"WS\":1}]}" https://alpha2.dev.untill.ru/n10n/subscribe -H "Content-Type: application/json"
+POST -> batch, see subscriptionBatchHandler
 */
 func (s *httpService) subscribeHandler() http.HandlerFunc {
+	return s.subscriptionHandler("subscribe", func(ch *n10nChannel, projections []in10n.ProjectionKey) error {
+		return ch.subscribe(s.n10n, projections, s.N10NMaxProjectionsPerChannel)
+	})
+}
+
+/*
+curl -G --data-urlencode "payload={\"Channel\": \"a23b2050-b90c-4ed1-adb7-1ecc4f346f2b\", \"ProjectionKey\":[{\"App\":\"Application\",\"Projection\":\"paa.wine_price\",\"WS\":1}]}" https://alpha2.dev.untill.ru/n10n/unsubscribe -H "Content-Type: application/json"
+POST -> batch, see subscriptionBatchHandler
+*/
+func (s *httpService) unSubscribeHandler() http.HandlerFunc {
+	return s.subscriptionHandler("unsubscribe", func(ch *n10nChannel, projections []in10n.ProjectionKey) error {
+		return ch.unsubscribe(s.n10n, projections)
+	})
+}
+
+func (s *httpService) subscriptionHandler(opName string, op func(ch *n10nChannel, projections []in10n.ProjectionKey) error) http.HandlerFunc {
 	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPost {
+			s.subscriptionBatchHandler(rw, req, opName, op)
+			return
+		}
 		var parameters subscriberParamsType
 		err := getJsonPayload(req, &parameters)
 		if err != nil {
-			http.Error(rw, err.Error(), http.StatusBadRequest)
+			writeN10NError(rw, err, http.StatusBadRequest)
+			return
 		}
-		logger.Info("n10n subscribe: ", parameters)
-		for _, projection := range parameters.ProjectionKey {
-			err = s.n10n.Subscribe(parameters.Channel, projection)
-			if err != nil {
-				logger.Error(err)
-				http.Error(rw, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		logger.Info("n10n "+opName+": ", parameters)
+		login, ok := s.authorizeN10N(rw, req, parameters.ProjectionKey)
+		if !ok {
+			return
+		}
+		ch, ok := s.n10nChannels.checkOwner(rw, parameters.Channel, login)
+		if !ok {
+			return
+		}
+		if err = op(ch, parameters.ProjectionKey); err != nil {
+			logger.Error(err)
+			writeN10NError(rw, err, n10nErrorStatus(err))
 		}
 	}
 }
 
 /*
-curl -G --data-urlencode "payload={\"Channel\": \"a23b2050-b90c-4ed1-adb7-1ecc4f346f2b\", \"ProjectionKey\":[{\"App\":\"Application\",\"Projection\":\"paa.wine_price\",\"WS\":1}]}" https://alpha2.dev.untill.ru/n10n/unsubscribe -H "Content-Type: application/json"
+curl -X POST https://alpha2.dev.untill.ru/n10n/subscribe -H "Authorization: Bearer <token>" -d "[{\"Channel\":\"a23b2050-b90c-4ed1-adb7-1ecc4f346f2b\",\"ProjectionKey\":[{\"App\":\"untill/airs-bp\",\"Projection\":\"paa.price\",\"WS\":1}]}]"
+single object or array of objects across the channels of the principal. 200 -> result per projection:
+{"Results":[{"Channel":"a23b2050-b90c-4ed1-adb7-1ecc4f346f2b","Projection":{"App":"untill/airs-bp","Projection":"paa.price","WS":1},"Status":200}]}
 */
-func (s *httpService) unSubscribeHandler() http.HandlerFunc {
-	return func(rw http.ResponseWriter, req *http.Request) {
-		var parameters subscriberParamsType
-		err := getJsonPayload(req, &parameters)
-		if err != nil {
-			http.Error(rw, err.Error(), http.StatusBadRequest)
+func (s *httpService) subscriptionBatchHandler(rw http.ResponseWriter, req *http.Request, opName string, op func(ch *n10nChannel, projections []in10n.ProjectionKey) error) {
+	batch, err := readN10NBatch(rw, req)
+	if err != nil {
+		writeN10NError(rw, err, http.StatusBadRequest)
+		return
+	}
+	logger.Info("n10n "+opName+" batch: ", batch)
+	p, ok := principalFromContext(req.Context())
+	if !ok {
+		writeN10NError(rw, errors.New("not authorized"), http.StatusUnauthorized)
+		return
+	}
+	res := n10nBatchResponse{Results: []n10nProjectionResult{}}
+	checked := map[n10nWorkspace]n10nAccess{}
+	for _, item := range batch {
+		if len(item.ProjectionKey) == 0 {
+			res.Results = append(res.Results, newN10NProjectionResult(item.Channel, nil, http.StatusBadRequest, errors.New("ProjectionKey is empty")))
+			continue
 		}
-		logger.Info("n10n unsubscribe: ", parameters)
-		for _, projection := range parameters.ProjectionKey {
-			err = s.n10n.Unsubscribe(parameters.Channel, projection)
+		// the login is taken from the token after the token is accepted by the access check
+		// otherwise the channel owner could be checked by an unverified login
+		accessResults := make([]n10nProjectionResult, 0, len(item.ProjectionKey))
+		accessed := false
+		for _, projection := range item.ProjectionKey {
+			projection := projection
+			status, err := http.StatusBadRequest, validateProjectionKey(projection)
+			if err == nil {
+				status, err = s.n10nProjectionAccess(req.Context(), p, projection, checked)
+			}
+			accessResults = append(accessResults, newN10NProjectionResult(item.Channel, &projection, status, err))
+			accessed = accessed || err == nil
+		}
+		var ch *n10nChannel
+		if accessed {
+			login, status, err := principalLogin(p)
+			if err == nil {
+				ch, status, err = s.n10nChannels.get(item.Channel, login)
+			}
 			if err != nil {
-				logger.Error(err)
-				http.Error(rw, err.Error(), http.StatusInternalServerError)
-				return
+				res.Results = append(res.Results, newN10NProjectionResult(item.Channel, nil, status, err))
+				continue
+			}
+		}
+		for _, result := range accessResults {
+			if result.Status == http.StatusOK {
+				if err := op(ch, []in10n.ProjectionKey{*result.Projection}); err != nil {
+					logger.Error(err)
+					result = newN10NProjectionResult(item.Channel, result.Projection, n10nErrorStatus(err), err)
+				}
 			}
+			res.Results = append(res.Results, result)
 		}
 	}
+	writeN10NJSON(rw, res)
 }
 
-// curl -X POST "http://localhost:3001/n10n/update" -H "Content-Type: application/json" -d "{\"App\":\"Application\",\"Projection\":\"paa.price\",\"WS\":1}"
-// TODO: eliminate after airs-bp3 integration tests implementation
+func newN10NProjectionResult(channelID in10n.ChannelID, projection *in10n.ProjectionKey, status int, err error) n10nProjectionResult {
+	res := n10nProjectionResult{Channel: channelID, Projection: projection, Status: http.StatusOK}
+	if err != nil {
+		res.Status = status
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// single object or array
+func readN10NBatch(rw http.ResponseWriter, req *http.Request) (batch []subscriberParamsType, err error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, n10nRequestMaxBodySize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		err = json.Unmarshal(body, &batch)
+	} else {
+		var item subscriberParamsType
+		if err = json.Unmarshal(body, &item); err == nil {
+			batch = append(batch, item)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse request body: %w", err)
+	}
+	projections := 0
+	for _, item := range batch {
+		projections += len(item.ProjectionKey)
+	}
+	switch {
+	case len(batch) == 0:
+		return nil, errors.New("batch is empty")
+	case projections > n10nMaxBatchProjections:
+		return nil, fmt.Errorf("too many projections %d, max %d", projections, n10nMaxBatchProjections)
+	}
+	return batch, nil
+}
+
+/*
+curl -X POST "http://127.0.0.1:8081/n10n/update" -H "Authorization: Bearer <secret>" -d "[{\"Projection\":{\"App\":\"untill/airs-bp\",\"Projection\":\"paa.price\",\"WS\":1},\"Offset\":13}]"
+served on the admin listener only
+*/
 func (s *httpService) updateHandler() http.HandlerFunc {
 	return func(resp http.ResponseWriter, req *http.Request) {
-		var p in10n.ProjectionKey
-		body, err := ioutil.ReadAll(req.Body)
+		s.metrics.n10nUpdateRequests.Add(1)
+		var updates []UpdateUnit
+		body, err := ioutil.ReadAll(http.MaxBytesReader(resp, req.Body, n10nUpdateMaxBodySize))
 		if err != nil {
-			logger.Error(err)
-			http.Error(resp, "Error when read request body", http.StatusInternalServerError)
+			s.metrics.n10nUpdateRejectedRequests.Add(1)
+			status := http.StatusBadRequest
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			writeTextResponse(resp, "failed to read request body: "+err.Error(), status)
 			return
 		}
-		err = json.Unmarshal(body, &p)
-		if err != nil {
-			logger.Error(err)
-			http.Error(resp, "Error when parse request body", http.StatusBadRequest)
+		if err := json.Unmarshal(body, &updates); err != nil {
+			s.metrics.n10nUpdateRejectedRequests.Add(1)
+			writeTextResponse(resp, "failed to parse request body: "+err.Error(), http.StatusBadRequest)
 			return
 		}
+		if err := validateUpdates(updates); err != nil {
+			s.metrics.n10nUpdateRejectedRequests.Add(1)
+			writeTextResponse(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, update := range updates {
+			s.n10n.Update(update.Projection, update.Offset)
+		}
+		s.metrics.n10nUpdates.Add(int64(len(updates)))
+		resp.WriteHeader(http.StatusNoContent)
+	}
+}
 
-		params := mux.Vars(req)
-		offset := params["offset"]
-		if off, err := strconv.ParseInt(offset, parseInt64Base, parseInt64Bits); err == nil {
-			s.n10n.Update(p, istructs.Offset(off))
+// the batch is applied entirely or is not applied at all
+func validateUpdates(updates []UpdateUnit) error {
+	if len(updates) == 0 {
+		return errors.New("updates are not provided")
+	}
+	if len(updates) > n10nUpdateMaxBatchSize {
+		return fmt.Errorf("too many updates %d, max %d", len(updates), n10nUpdateMaxBatchSize)
+	}
+	for i, update := range updates {
+		if err := validateProjectionKey(update.Projection); err != nil {
+			return fmt.Errorf("update %d: %w", i, err)
+		}
+		if update.Offset == istructs.NullOffset {
+			return fmt.Errorf("update %d: Offset is not specified", i)
 		}
 	}
+	return nil
 }
 
-func getJsonPayload(req *http.Request, payload *subscriberParamsType) (err error) {
-	jsonParam, ok := req.URL.Query()["payload"]
-	if !ok || len(jsonParam[0]) < 1 {
-		err = errors.New("url parameter with payload (channel id and projection key) is missing")
-		logger.Error(err)
-		return err
+// POST -> the body, otherwise the payload query parameter. Body in POST keeps channel ids and projection keys out of the access logs
+func getJsonPayload(req *http.Request, payload interface{}) (err error) {
+	var jsonPayload []byte
+	if req.Method == http.MethodPost {
+		if jsonPayload, err = ioutil.ReadAll(io.LimitReader(req.Body, n10nRequestMaxBodySize+1)); err != nil {
+			err = fmt.Errorf("failed to read request body: %w", err)
+			logger.Error(err)
+			return err
+		}
+		if len(jsonPayload) > n10nRequestMaxBodySize {
+			return fmt.Errorf("request body is too large, max %d bytes", n10nRequestMaxBodySize)
+		}
+	} else {
+		jsonParam, ok := req.URL.Query()["payload"]
+		if !ok || len(jsonParam[0]) < 1 {
+			err = errors.New("url parameter with payload (channel id and projection key) is missing")
+			logger.Error(err)
+			return err
+		}
+		jsonPayload = []byte(jsonParam[0])
 	}
-	err = json.Unmarshal([]byte(jsonParam[0]), payload)
+	err = json.Unmarshal(jsonPayload, payload)
 	if err != nil {
 		err = fmt.Errorf("cannot unmarshal input payload %w", err)
 		logger.Error(err)
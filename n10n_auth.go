@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	ibus "github.com/untillpro/airs-ibus"
+	"github.com/untillpro/goutils/logger"
+	"github.com/voedger/voedger/pkg/in10n"
+	istructs "github.com/voedger/voedger/pkg/istructs"
+	coreutils "github.com/voedger/voedger/pkg/utils"
+)
+
+// false -> the error response is written already
+func (s *httpService) authorizeN10N(rw http.ResponseWriter, req *http.Request, projections []in10n.ProjectionKey) (login istructs.SubjectLogin, ok bool) {
+	p, ok := principalFromContext(req.Context())
+	if !ok {
+		writeN10NError(rw, errors.New("not authorized"), http.StatusUnauthorized)
+		return "", false
+	}
+	login, status, err := s.authorizeN10NProjections(req.Context(), p, projections)
+	if err != nil {
+		writeN10NError(rw, err, status)
+		return "", false
+	}
+	return login, true
+}
+
+// checks the principal has access to each workspace of the projections and returns the principal login
+// the token is verified by the app via the bus or by the router if EdgeAuth is enabled
+// err != nil -> status is the response status
+func (s *httpService) authorizeN10NProjections(ctx context.Context, p principal, projections []in10n.ProjectionKey) (login istructs.SubjectLogin, status int, err error) {
+	if len(projections) == 0 {
+		return "", http.StatusBadRequest, errors.New("ProjectionKey is empty")
+	}
+	for i, projection := range projections {
+		if err := validateProjectionKey(projection); err != nil {
+			return "", http.StatusBadRequest, fmt.Errorf("ProjectionKey %d: %w", i, err)
+		}
+	}
+	checked := map[n10nWorkspace]n10nAccess{}
+	for _, projection := range projections {
+		if status, err := s.n10nProjectionAccess(ctx, p, projection, checked); err != nil {
+			return "", status, err
+		}
+	}
+	return principalLogin(p)
+}
+
+// the login is taken from the token after the token is accepted for a workspace the channel is subscribed to
+// otherwise the channel owner could be checked by an unverified login
+// the accepted token is cached on the channel -> the bus is not called on each poll
+// err != nil -> status is the response status
+func (s *httpService) authorizeN10NChannel(ctx context.Context, p principal, ch *n10nChannel) (status int, err error) {
+	checkAccess := p.claims == nil && len(s.N10NAuthResource) > 0 && !ch.isAuthorizedBy(p.token)
+	if checkAccess {
+		projection, ok := ch.anyProjection()
+		if !ok {
+			return http.StatusForbidden, errors.New("channel has no subscriptions to check the access by")
+		}
+		if status, err := s.n10nProjectionAccess(ctx, p, projection, map[n10nWorkspace]n10nAccess{}); err != nil {
+			return status, err
+		}
+	}
+	login, status, err := principalLogin(p)
+	if err != nil {
+		return status, err
+	}
+	if status, err = ch.checkOwnedBy(login); err != nil {
+		return status, err
+	}
+	if checkAccess {
+		ch.setAuthorizedBy(p.token)
+	}
+	return http.StatusOK, nil
+}
+
+// projection must be valid already
+// checked caches the result per workspace
+// N10NAuthResource is empty -> access is not checked
+// err != nil -> status is the response status
+func (s *httpService) n10nProjectionAccess(ctx context.Context, p principal, projection in10n.ProjectionKey, checked map[n10nWorkspace]n10nAccess) (status int, err error) {
+	if len(s.N10NAuthResource) == 0 {
+		return http.StatusOK, nil
+	}
+	wsKey := n10nWorkspace{app: projection.App, ws: projection.WS}
+	access, ok := checked[wsKey]
+	if !ok {
+		access.status, access.err = s.checkN10NWorkspaceAccess(ctx, p.token, projection.App, projection.WS)
+		if access.err != nil && logger.IsVerbose() {
+			logger.Verbose("n10n access denied to ", projection.App, " ws ", projection.WS, ": ", access.err)
+		}
+		checked[wsKey] = access
+	}
+	return access.status, access.err
+}
+
+// must be called after the token is verified: at the edge or accepted by the app access check
+// N10NAuthResource is empty -> the unverified login is just the channel subject
+// err != nil -> status is the response status
+func principalLogin(p principal) (login istructs.SubjectLogin, status int, err error) {
+	claims := p.claims
+	if claims == nil {
+		// verified by the app already
+		unverified, err := unverifiedTokenClaims(p.token)
+		if err != nil {
+			return "", http.StatusUnauthorized, fmt.Errorf("principal token is invalid: %w", err)
+		}
+		claims = &unverified
+	}
+	if len(claims.Login) == 0 {
+		return "", http.StatusUnauthorized, errors.New("principal token has no login")
+	}
+	return istructs.SubjectLogin(claims.Login), http.StatusOK, nil
+}
+
+// err != nil -> status is the response status
+func (s *httpService) checkN10NWorkspaceAccess(ctx context.Context, token string, app istructs.AppQName, ws istructs.WSID) (status int, err error) {
+	resource := s.N10NAuthResource
+	req := ibus.Request{
+		Method:   ibus.HTTPMethodPOST,
+		WSID:     int64(ws),
+		AppQName: app.String(),
+		Resource: resource,
+		Header:   map[string][]string{coreutils.Authorization: {coreutils.BearerPrefix + token}},
+		Body:     []byte(`{}`),
+		Host:     localhost,
+	}
+	resp, sections, secErr, err := s.bus.SendRequest2(ctx, req, s.busTimeout)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to exec %s: %w", resource, err)
+	}
+	if sections != nil {
+		// the result is not needed, the access is checked only. Undrained sections hang ibusnats
+		for iSection := range sections {
+			discardSection(iSection)
+		}
+		if *secErr != nil {
+			return http.StatusForbidden, fmt.Errorf("%s returned error: %w", resource, *secErr)
+		}
+		return http.StatusOK, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, fmt.Errorf("%s returned error: %s", resource, string(resp.Data))
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,390 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	ibus "github.com/untillpro/airs-ibus"
+	"github.com/voedger/voedger/pkg/appdef"
+	"github.com/voedger/voedger/pkg/in10n"
+	istructs "github.com/voedger/voedger/pkg/istructs"
+)
+
+type testN10NBroker struct {
+	sync.Mutex
+	in10n.IN10nBroker
+	subjects      map[in10n.ChannelID]istructs.SubjectLogin
+	subscriptions map[in10n.ChannelID]map[in10n.ProjectionKey]bool
+	created       chan in10n.ChannelID
+	updates       []UpdateUnit
+	watchers      map[in10n.ChannelID]func(projection in10n.ProjectionKey, offset istructs.Offset)
+	durations     map[in10n.ChannelID]time.Duration
+}
+
+func newTestN10NBroker() *testN10NBroker {
+	return &testN10NBroker{
+		subjects:      map[in10n.ChannelID]istructs.SubjectLogin{},
+		subscriptions: map[in10n.ChannelID]map[in10n.ProjectionKey]bool{},
+		created:       make(chan in10n.ChannelID, 1),
+		watchers:      map[in10n.ChannelID]func(projection in10n.ProjectionKey, offset istructs.Offset){},
+		durations:     map[in10n.ChannelID]time.Duration{},
+	}
+}
+
+func (b *testN10NBroker) NewChannel(subject istructs.SubjectLogin, channelDuration time.Duration) (channelID in10n.ChannelID, err error) {
+	b.Lock()
+	channelID = in10n.ChannelID(fmt.Sprintf("channel%d", len(b.subjects)+1))
+	b.subjects[channelID] = subject
+	b.durations[channelID] = channelDuration
+	b.subscriptions[channelID] = map[in10n.ProjectionKey]bool{}
+	b.Unlock()
+	select {
+	case b.created <- channelID:
+	default:
+	}
+	return channelID, nil
+}
+
+// the real broker counts each call against the quotas -> repeated calls are the errors
+func (b *testN10NBroker) Subscribe(channelID in10n.ChannelID, projection in10n.ProjectionKey) (err error) {
+	b.Lock()
+	defer b.Unlock()
+	if b.subscriptions[channelID][projection] {
+		return fmt.Errorf("%s is subscribed to %v already", channelID, projection)
+	}
+	b.subscriptions[channelID][projection] = true
+	return nil
+}
+
+func (b *testN10NBroker) Unsubscribe(channelID in10n.ChannelID, projection in10n.ProjectionKey) (err error) {
+	b.Lock()
+	defer b.Unlock()
+	if !b.subscriptions[channelID][projection] {
+		return fmt.Errorf("%s is not subscribed to %v", channelID, projection)
+	}
+	delete(b.subscriptions[channelID], projection)
+	return nil
+}
+
+func (b *testN10NBroker) WatchChannel(ctx context.Context, channelID in10n.ChannelID, notifySubscriber func(projection in10n.ProjectionKey, offset istructs.Offset)) {
+	b.Lock()
+	b.watchers[channelID] = notifySubscriber
+	b.Unlock()
+	<-ctx.Done()
+	b.Lock()
+	delete(b.watchers, channelID)
+	b.Unlock()
+}
+
+func (b *testN10NBroker) Update(projection in10n.ProjectionKey, offset istructs.Offset) {
+	b.Lock()
+	b.updates = append(b.updates, UpdateUnit{Projection: projection, Offset: offset})
+	var notify []func(projection in10n.ProjectionKey, offset istructs.Offset)
+	for channelID, watcher := range b.watchers {
+		if b.subscriptions[channelID][projection] {
+			notify = append(notify, watcher)
+		}
+	}
+	b.Unlock()
+	for _, watcher := range notify {
+		watcher(projection, offset)
+	}
+}
+
+func (b *testN10NBroker) MetricNumChannels() int {
+	b.Lock()
+	defer b.Unlock()
+	return len(b.subjects)
+}
+
+func (b *testN10NBroker) MetricNumSubcriptions() int {
+	b.Lock()
+	defer b.Unlock()
+	res := 0
+	for _, subscriptions := range b.subscriptions {
+		res += len(subscriptions)
+	}
+	return res
+}
+
+func (b *testN10NBroker) isSubscribed(channelID in10n.ChannelID, projection in10n.ProjectionKey) bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.subscriptions[channelID][projection]
+}
+
+const testN10NAuthResource = "q.sys.N10NAccess"
+
+// workspaces the principal has access to
+type testN10NAuthBus struct {
+	implIBusBP2
+	allowedWS    map[istructs.WSID]bool
+	invalidToken string // rejected by the app, e.g. forged
+	calls        int32
+}
+
+func (b *testN10NAuthBus) SendRequest2(ctx context.Context, request ibus.Request, timeout time.Duration) (res ibus.Response, sections <-chan ibus.ISection, secError *error, err error) {
+	atomic.AddInt32(&b.calls, 1)
+	authHeader := request.Header["Authorization"]
+	if len(b.invalidToken) > 0 && len(authHeader) > 0 && authHeader[0] == "Bearer "+b.invalidToken {
+		return ibus.Response{StatusCode: http.StatusUnauthorized, Data: []byte("token is invalid")}, nil, nil, nil
+	}
+	if len(authHeader) == 0 || !b.allowedWS[istructs.WSID(request.WSID)] {
+		return ibus.Response{StatusCode: http.StatusForbidden, Data: []byte("forbidden")}, nil, nil, nil
+	}
+	return ibus.Response{StatusCode: http.StatusOK}, nil, nil, nil
+}
+
+func TestN10NAuthorization(t *testing.T) {
+	require := require.New(t)
+	broker := newTestN10NBroker()
+	s := &httpService{n10n: broker, bus: &testN10NAuthBus{allowedWS: map[istructs.WSID]bool{1: true}}, RouterParams: RouterParams{N10NAuthResource: testN10NAuthResource}}
+	app := istructs.NewAppQName("untill", "airs-bp")
+	allowed := in10n.ProjectionKey{App: app, Projection: appdef.NewQName("paa", "price"), WS: 1}
+	forbidden := in10n.ProjectionKey{App: app, Projection: appdef.NewQName("paa", "price"), WS: 2}
+	ownerToken := issueTestToken(t, "HS256", "", testSecret, testClaims("untill/airs-bp", time.Now().Add(time.Hour)))
+	otherToken := issueTestToken(t, "HS256", "", testSecret, map[string]interface{}{"AppQName": "untill/airs-bp", "Login": "other"})
+
+	newRequest := func(ctx context.Context, path string, token string, payload interface{}) *http.Request {
+		payloadBytes, err := json.Marshal(payload)
+		require.NoError(err)
+		req := httptest.NewRequest(http.MethodGet, path+"?payload="+url.QueryEscape(string(payloadBytes)), http.NoBody).WithContext(ctx)
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return req
+	}
+	send := func(h http.Handler, req *http.Request) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	channelHandler := s.authHandler(s.subscribeAndWatchHandler(), authPolicyRequired, []string{http.MethodGet}, true)
+	subscribeHandler := s.authHandler(s.subscribeHandler(), authPolicyRequired, nil, false)
+	unsubscribeHandler := s.authHandler(s.unSubscribeHandler(), authPolicyRequired, nil, false)
+	createChannel := func(token string, projection in10n.ProjectionKey, subject istructs.SubjectLogin) int {
+		return send(channelHandler, newRequest(context.Background(), "/n10n/channel", token,
+			createChannelParamsType{SubjectLogin: subject, ProjectionKey: []in10n.ProjectionKey{projection}}))
+	}
+
+	t.Run("channel creation", func(t *testing.T) {
+		require.Equal(http.StatusUnauthorized, createChannel("", allowed, ""))
+		require.Equal(http.StatusForbidden, createChannel(ownerToken, forbidden, ""))
+		// subject of another principal
+		require.Equal(http.StatusForbidden, createChannel(ownerToken, allowed, "other"))
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watchDone := make(chan struct{})
+	go func() {
+		defer close(watchDone)
+		send(channelHandler, newRequest(ctx, "/n10n/channel", ownerToken, createChannelParamsType{ProjectionKey: []in10n.ProjectionKey{allowed}}))
+	}()
+	channel := <-broker.created
+	require.Equal(istructs.SubjectLogin("paa"), broker.subjects[channel])
+	require.True(broker.isSubscribed(channel, allowed))
+	another := in10n.ProjectionKey{App: app, Projection: appdef.NewQName("paa", "wine_price"), WS: 1}
+	subscribe := func(h http.Handler, token string, channel in10n.ChannelID, projection in10n.ProjectionKey) int {
+		return send(h, newRequest(context.Background(), "/n10n/subscribe", token,
+			subscriberParamsType{Channel: channel, ProjectionKey: []in10n.ProjectionKey{projection}}))
+	}
+
+	t.Run("subscribe", func(t *testing.T) {
+		require.Equal(http.StatusOK, subscribe(subscribeHandler, ownerToken, channel, another))
+		require.True(broker.isSubscribed(channel, another))
+		require.Equal(http.StatusForbidden, subscribe(subscribeHandler, otherToken, channel, allowed))
+		require.Equal(http.StatusForbidden, subscribe(subscribeHandler, ownerToken, channel, forbidden))
+		require.Equal(http.StatusNotFound, subscribe(subscribeHandler, ownerToken, "unknown", another))
+	})
+
+	t.Run("unsubscribe", func(t *testing.T) {
+		require.Equal(http.StatusForbidden, subscribe(unsubscribeHandler, otherToken, channel, another))
+		require.True(broker.isSubscribed(channel, another))
+		require.Equal(http.StatusOK, subscribe(unsubscribeHandler, ownerToken, channel, another))
+		require.False(broker.isSubscribed(channel, another))
+	})
+
+	cancel()
+	<-watchDone
+	// the channel is forgotten when the watch is done
+	require.Eventually(func() bool {
+		return subscribe(subscribeHandler, ownerToken, channel, another) == http.StatusNotFound
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestN10NSubscriptionBatch(t *testing.T) {
+	require := require.New(t)
+	broker := newTestN10NBroker()
+	forgedToken := issueTestToken(t, "HS256", "", []byte("forged"), testClaims("untill/airs-bp", time.Now().Add(time.Hour)))
+	s := &httpService{n10n: broker, bus: &testN10NAuthBus{allowedWS: map[istructs.WSID]bool{1: true}, invalidToken: forgedToken}, RouterParams: RouterParams{N10NAuthResource: testN10NAuthResource}}
+	app := istructs.NewAppQName("untill", "airs-bp")
+	price := in10n.ProjectionKey{App: app, Projection: appdef.NewQName("paa", "price"), WS: 1}
+	winePrice := in10n.ProjectionKey{App: app, Projection: appdef.NewQName("paa", "wine_price"), WS: 1}
+	forbidden := in10n.ProjectionKey{App: app, Projection: appdef.NewQName("paa", "price"), WS: 2}
+	token := issueTestToken(t, "HS256", "", testSecret, testClaims("untill/airs-bp", time.Now().Add(time.Hour)))
+	post := func(h http.HandlerFunc, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/n10n", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		if strings.Contains(body, "forged") {
+			req.Header.Set("Authorization", "Bearer "+forgedToken)
+		}
+		rec := httptest.NewRecorder()
+		s.authHandler(h, authPolicyRequired, nil, false).ServeHTTP(rec, req)
+		return rec
+	}
+	postBatch := func(h http.HandlerFunc, batch interface{}) []n10nProjectionResult {
+		body, err := json.Marshal(batch)
+		require.NoError(err)
+		rec := post(h, string(body))
+		require.Equal(http.StatusOK, rec.Code, rec.Body.String())
+		var res n10nBatchResponse
+		require.NoError(json.Unmarshal(rec.Body.Bytes(), &res))
+		for i := range res.Results {
+			if res.Results[i].Status != http.StatusOK {
+				require.NotEmpty(res.Results[i].Error)
+				res.Results[i].Error = ""
+			}
+		}
+		return res.Results
+	}
+	openChannel := func(login istructs.SubjectLogin) in10n.ChannelID {
+		ch, err := s.openN10NChannel(login, []in10n.ProjectionKey{price})
+		require.NoError(err)
+		t.Cleanup(ch.cancel)
+		return ch.id
+	}
+
+	// channel creation payload in the body
+	rec := post(s.pollChannelHandler(), `{"ProjectionKey":[{"App":"untill/airs-bp","Projection":"paa.price","WS":1}]}`)
+	require.Equal(http.StatusOK, rec.Code, rec.Body.String())
+	var channelRes pollChannelResponse
+	require.NoError(json.Unmarshal(rec.Body.Bytes(), &channelRes))
+	require.True(broker.isSubscribed(channelRes.Channel, price))
+	ch, _, err := s.n10nChannels.get(channelRes.Channel, "paa")
+	require.NoError(err)
+	defer ch.cancel()
+
+	ch1 := openChannel("paa")
+	ch2 := openChannel("paa")
+	otherCh := openChannel("other")
+	results := postBatch(s.subscribeHandler(), []subscriberParamsType{
+		{Channel: ch1, ProjectionKey: []in10n.ProjectionKey{price, forbidden}},
+		{Channel: ch2, ProjectionKey: []in10n.ProjectionKey{winePrice}},
+		{Channel: otherCh, ProjectionKey: []in10n.ProjectionKey{price}},
+		{Channel: "unknown", ProjectionKey: []in10n.ProjectionKey{price}},
+		{Channel: ch1},
+	})
+	require.Equal([]n10nProjectionResult{
+		{Channel: ch1, Projection: &price, Status: http.StatusOK},
+		{Channel: ch1, Projection: &forbidden, Status: http.StatusForbidden},
+		{Channel: ch2, Projection: &winePrice, Status: http.StatusOK},
+		{Channel: otherCh, Status: http.StatusForbidden},
+		{Channel: "unknown", Status: http.StatusNotFound},
+		{Channel: ch1, Status: http.StatusBadRequest},
+	}, results)
+	require.True(broker.isSubscribed(ch1, price))
+	require.False(broker.isSubscribed(ch1, forbidden))
+	require.True(broker.isSubscribed(ch2, winePrice))
+	require.False(broker.isSubscribed(otherCh, price))
+
+	// single object
+	results = postBatch(s.unSubscribeHandler(), subscriberParamsType{Channel: ch1, ProjectionKey: []in10n.ProjectionKey{price}})
+	require.Equal([]n10nProjectionResult{{Channel: ch1, Projection: &price, Status: http.StatusOK}}, results)
+	require.False(broker.isSubscribed(ch1, price))
+
+	t.Run("token rejected by the app", func(t *testing.T) {
+		// the login of the unverified token is not used to check the channel owner
+		results := postBatch(s.subscribeHandler(), []subscriberParamsType{
+			{Channel: ch1, ProjectionKey: []in10n.ProjectionKey{price}},
+			{Channel: "forged", ProjectionKey: []in10n.ProjectionKey{price}},
+		})
+		require.Equal([]n10nProjectionResult{
+			{Channel: ch1, Projection: &price, Status: http.StatusUnauthorized},
+			{Channel: "forged", Projection: &price, Status: http.StatusUnauthorized},
+		}, results)
+		require.False(broker.isSubscribed(ch1, price))
+	})
+
+	t.Run("malformed batch", func(t *testing.T) {
+		require.Equal(http.StatusBadRequest, post(s.subscribeHandler(), "wrong").Code)
+		require.Equal(http.StatusBadRequest, post(s.subscribeHandler(), "[]").Code)
+		require.Equal(http.StatusBadRequest, post(s.pollChannelHandler(), "").Code)
+	})
+}
+
+type testArraySection struct {
+	elems int
+}
+
+func (s *testArraySection) Type() string   { return "array" }
+func (s *testArraySection) Path() []string { return nil }
+func (s *testArraySection) Next() (value []byte, ok bool) {
+	if s.elems == 0 {
+		return nil, false
+	}
+	s.elems--
+	return []byte("{}"), true
+}
+
+// access helper responds with sections
+type testN10NAuthSectionsBus struct {
+	implIBusBP2
+	section *testArraySection
+}
+
+func (b *testN10NAuthSectionsBus) SendRequest2(ctx context.Context, request ibus.Request, timeout time.Duration) (res ibus.Response, sections <-chan ibus.ISection, secError *error, err error) {
+	ch := make(chan ibus.ISection, 1)
+	ch <- b.section
+	close(ch)
+	var secErr error
+	return res, ch, &secErr, nil
+}
+
+func TestN10NAuthorizationSectionsDrained(t *testing.T) {
+	require := require.New(t)
+	bus := &testN10NAuthSectionsBus{section: &testArraySection{elems: 3}}
+	s := &httpService{bus: bus}
+	status, err := s.checkN10NWorkspaceAccess(context.Background(), "token", istructs.NewAppQName("untill", "airs-bp"), 1)
+	require.NoError(err)
+	require.Equal(http.StatusOK, status)
+	require.Zero(bus.section.elems)
+}
+
+func TestN10NAuthorizationDisabled(t *testing.T) {
+	require := require.New(t)
+	broker := newTestN10NBroker()
+	// denies all -> must not be called
+	s := &httpService{n10n: broker, bus: &testN10NAuthBus{}}
+	projection := in10n.ProjectionKey{App: istructs.NewAppQName("untill", "airs-bp"), Projection: appdef.NewQName("paa", "price"), WS: 2}
+	token := issueTestToken(t, "HS256", "", testSecret, testClaims("untill/airs-bp", time.Now().Add(time.Hour)))
+	payload, err := json.Marshal(createChannelParamsType{ProjectionKey: []in10n.ProjectionKey{projection}})
+	require.NoError(err)
+	send := func(h http.HandlerFunc, path string) int {
+		req := httptest.NewRequest(http.MethodGet, path, http.NoBody)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		s.authHandler(h, authPolicyRequired, nil, false).ServeHTTP(rec, req)
+		return rec.Code
+	}
+	require.Equal(http.StatusOK, send(s.pollChannelHandler(), "/n10n/poll/channel?payload="+url.QueryEscape(string(payload))))
+	channel := <-broker.created
+	// channel subject is the token login
+	require.Equal(istructs.SubjectLogin("paa"), broker.subjects[channel])
+	require.True(broker.isSubscribed(channel, projection))
+	require.Equal(http.StatusOK, send(s.pollHandler(), "/n10n/poll?timeout=0&channel="+string(channel)))
+	s.n10nChannels.closeAll()
+}
@@ -0,0 +1,365 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/voedger/voedger/pkg/appdef"
+	"github.com/voedger/voedger/pkg/in10n"
+	istructs "github.com/voedger/voedger/pkg/istructs"
+	coreutils "github.com/voedger/voedger/pkg/utils"
+)
+
+// creates the channel and watches it until the channel is closed or the router is stopped
+func (s *httpService) openN10NChannel(login istructs.SubjectLogin, projections []in10n.ProjectionKey) (ch *n10nChannel, err error) {
+	s.n10nChannels.Lock()
+	defer s.n10nChannels.Unlock()
+	if s.N10NMaxChannelsPerSubject > 0 {
+		subjectChannels := 0
+		for _, ch := range s.n10nChannels.channels {
+			if ch.owner == login {
+				subjectChannels++
+			}
+		}
+		if subjectChannels >= s.N10NMaxChannelsPerSubject {
+			return nil, errQuotaExceededChannelsPerSubject
+		}
+	}
+	channelID, err := s.n10n.NewChannel(login, s.n10nChannelTTL(projections))
+	if err != nil {
+		return nil, err
+	}
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	ch = &n10nChannel{
+		id:          channelID,
+		owner:       login,
+		cancel:      cancel,
+		watchDone:   make(chan struct{}),
+		offsets:     map[in10n.ProjectionKey]n10nEvent{},
+		projections: map[in10n.ProjectionKey]bool{},
+		dropped:     &s.metrics.n10nDroppedEvents,
+	}
+	if s.n10nChannels.channels == nil {
+		s.n10nChannels.channels = map[in10n.ChannelID]*n10nChannel{}
+	}
+	s.n10nChannels.channels[channelID] = ch
+	go func() {
+		defer close(ch.watchDone)
+		defer s.n10nChannels.remove(channelID)
+		s.n10n.WatchChannel(ctx, channelID, ch.notify)
+	}()
+	return ch, nil
+}
+
+// the least TTL of the projections apps
+func (s *httpService) n10nChannelTTL(projections []in10n.ProjectionKey) time.Duration {
+	ttl := s.N10NChannelTTL
+	if ttl == 0 {
+		ttl = DefaultN10NChannelTTL
+	}
+	for _, projection := range projections {
+		if appTTL, ok := s.N10NChannelTTLByApp[projection.App.String()]; ok && appTTL > 0 && appTTL < ttl {
+			ttl = appTTL
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+func (s *httpService) n10nCoalesceWindow() time.Duration {
+	return time.Duration(s.N10NCoalesceWindow) * time.Millisecond
+}
+
+func (c *n10nChannels) remove(channelID in10n.ChannelID) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.channels, channelID)
+}
+
+func (c *n10nChannels) closeAll() {
+	c.Lock()
+	channels := make([]*n10nChannel, 0, len(c.channels))
+	for _, ch := range c.channels {
+		channels = append(channels, ch)
+	}
+	c.Unlock()
+	for _, ch := range channels {
+		ch.cancel()
+	}
+}
+
+// err != nil -> status is the response status
+func (c *n10nChannels) get(channelID in10n.ChannelID, login istructs.SubjectLogin) (ch *n10nChannel, status int, err error) {
+	ch, status, err = c.find(channelID)
+	if err != nil {
+		return nil, status, err
+	}
+	if status, err = ch.checkOwnedBy(login); err != nil {
+		return nil, status, err
+	}
+	return ch, http.StatusOK, nil
+}
+
+// the owner is not checked
+// err != nil -> status is the response status
+func (c *n10nChannels) find(channelID in10n.ChannelID) (ch *n10nChannel, status int, err error) {
+	c.Lock()
+	ch, ok := c.channels[channelID]
+	c.Unlock()
+	if !ok {
+		return nil, http.StatusNotFound, in10n.ErrChannelDoesNotExist
+	}
+	return ch, http.StatusOK, nil
+}
+
+// token has no exp -> not cached
+func (ch *n10nChannel) setAuthorizedBy(token string) {
+	claims, err := unverifiedTokenClaims(token)
+	if err != nil || claims.ExpiresAt == nil {
+		return
+	}
+	ch.Lock()
+	defer ch.Unlock()
+	ch.authorizedToken = token
+	ch.authorizedUntil = claims.ExpiresAt.Time
+}
+
+func (ch *n10nChannel) isAuthorizedBy(token string) bool {
+	ch.Lock()
+	defer ch.Unlock()
+	return len(ch.authorizedToken) > 0 && ch.authorizedToken == token && time.Now().Before(ch.authorizedUntil)
+}
+
+// err != nil -> status is the response status
+func (ch *n10nChannel) checkOwnedBy(login istructs.SubjectLogin) (status int, err error) {
+	if ch.owner != login {
+		return http.StatusForbidden, errors.New("channel is owned by another principal")
+	}
+	return http.StatusOK, nil
+}
+
+// ok == false -> the channel has no subscriptions
+func (ch *n10nChannel) anyProjection() (projection in10n.ProjectionKey, ok bool) {
+	ch.Lock()
+	defer ch.Unlock()
+	for projection = range ch.projections {
+		return projection, true
+	}
+	return projection, false
+}
+
+// false -> the error response is written already
+func (c *n10nChannels) checkOwner(rw http.ResponseWriter, channelID in10n.ChannelID, login istructs.SubjectLogin) (ch *n10nChannel, ok bool) {
+	ch, status, err := c.get(channelID, login)
+	if err != nil {
+		writeN10NError(rw, err, status)
+		return nil, false
+	}
+	return ch, true
+}
+
+// called by the broker. Never blocks: the latest offset per projection is kept until the stream takes it
+func (ch *n10nChannel) notify(projection in10n.ProjectionKey, offset istructs.Offset) {
+	ch.Lock()
+	ch.seq++
+	stream := ch.stream
+	if prev, ok := ch.offsets[projection]; ok && stream != nil && prev.seq > stream.sentSeq && ch.dropped != nil {
+		// the client can not keep up
+		ch.dropped.Add(1)
+	}
+	ch.offsets[projection] = n10nEvent{
+		UpdateUnit: UpdateUnit{Projection: projection, Offset: offset},
+		seq:        ch.seq,
+		timestamp:  istructs.UnixMilli(time.Now().UnixMilli()),
+	}
+	ch.Unlock()
+	if stream == nil {
+		// no client at the moment, the offset will be replayed on reattach
+		return
+	}
+	select {
+	case stream.ready <- struct{}{}:
+	default:
+		// signalled already
+	}
+}
+
+// the previous stream is detached. Returns the latest events with seq > lastSeq to replay
+func (ch *n10nChannel) attach(lastSeq uint64) (stream *n10nStream, replay []n10nEvent) {
+	ch.Lock()
+	defer ch.Unlock()
+	if ch.stream != nil {
+		close(ch.stream.detached)
+	}
+	if ch.closeTimer != nil {
+		ch.closeTimer.Stop()
+		ch.closeTimer = nil
+	}
+	stream = &n10nStream{ready: make(chan struct{}, 1), detached: make(chan struct{}), sentSeq: lastSeq}
+	ch.stream = stream
+	return stream, ch.pendingLocked(stream)
+}
+
+// waits window to collect the burst, then returns the latest offset per projection not sent to the stream yet
+// nil -> ctx is done or the stream is detached
+func (ch *n10nChannel) coalesce(ctx context.Context, stream *n10nStream, window time.Duration) []n10nEvent {
+	if window > 0 {
+		timer := time.NewTimer(window)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-stream.detached:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	ch.Lock()
+	defer ch.Unlock()
+	return ch.pendingLocked(stream)
+}
+
+func (ch *n10nChannel) pendingLocked(stream *n10nStream) (events []n10nEvent) {
+	for _, event := range ch.offsets {
+		if event.seq > stream.sentSeq {
+			events = append(events, event)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].seq < events[j].seq })
+	if len(events) > 0 {
+		stream.sentSeq = events[len(events)-1].seq
+	}
+	return events
+}
+
+// keepAlive == 0 -> the channel is closed, otherwise the channel is closed if no stream is attached during keepAlive
+func (ch *n10nChannel) detach(stream *n10nStream, keepAlive time.Duration) {
+	ch.Lock()
+	defer ch.Unlock()
+	if ch.stream != stream {
+		// another stream is attached already
+		return
+	}
+	ch.stream = nil
+	close(stream.detached)
+	if keepAlive == 0 {
+		ch.cancel()
+		return
+	}
+	ch.closeTimer = time.AfterFunc(keepAlive, ch.cancel)
+}
+
+// no stream is attached during keepAlive -> the channel is closed
+func (ch *n10nChannel) closeIfIdle(keepAlive time.Duration) {
+	ch.Lock()
+	defer ch.Unlock()
+	if ch.stream == nil && ch.closeTimer == nil {
+		ch.closeTimer = time.AfterFunc(keepAlive, ch.cancel)
+	}
+}
+
+// maxProjections == 0 -> unlimited
+// subscribed projections are skipped: the broker counts each Subscribe call against the quotas
+func (ch *n10nChannel) subscribe(broker in10n.IN10nBroker, projections []in10n.ProjectionKey, maxProjections int) error {
+	ch.Lock()
+	defer ch.Unlock()
+	newProjections := []in10n.ProjectionKey{}
+	isNew := map[in10n.ProjectionKey]bool{}
+	for _, projection := range projections {
+		if !ch.projections[projection] && !isNew[projection] {
+			isNew[projection] = true
+			newProjections = append(newProjections, projection)
+		}
+	}
+	if maxProjections > 0 && len(ch.projections)+len(newProjections) > maxProjections {
+		return errQuotaExceededProjectionsPerChannel
+	}
+	for _, projection := range newProjections {
+		if err := broker.Subscribe(ch.id, projection); err != nil {
+			return err
+		}
+		ch.projections[projection] = true
+	}
+	return nil
+}
+
+// unsubscribed projection is not replayed
+// not subscribed projections are skipped: the broker decrements its counters on each Unsubscribe call
+func (ch *n10nChannel) unsubscribe(broker in10n.IN10nBroker, projections []in10n.ProjectionKey) error {
+	ch.Lock()
+	defer ch.Unlock()
+	for _, projection := range projections {
+		if !ch.projections[projection] {
+			continue
+		}
+		if err := broker.Unsubscribe(ch.id, projection); err != nil {
+			return err
+		}
+		delete(ch.projections, projection)
+		delete(ch.offsets, projection)
+	}
+	return nil
+}
+
+func (ch *n10nChannel) eventID(seq uint64) string {
+	return fmt.Sprintf("%s:%d", ch.id, seq)
+}
+
+// <channelID>:<seq>
+func parseEventID(eventID string) (channelID in10n.ChannelID, seq uint64, err error) {
+	idx := strings.LastIndex(eventID, ":")
+	if idx < 0 {
+		return "", 0, fmt.Errorf("event id %s is malformed", eventID)
+	}
+	if seq, err = strconv.ParseUint(eventID[idx+1:], 10, 64); err != nil {
+		return "", 0, fmt.Errorf("event id %s is malformed: %w", eventID, err)
+	}
+	return in10n.ChannelID(eventID[:idx]), seq, nil
+}
+
+func n10nErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, in10n.ErrChannelDoesNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, in10n.ErrQuotaExceeded_Channels), errors.Is(err, in10n.ErrQuotaExceeded_ChannelsPerSubject),
+		errors.Is(err, in10n.ErrQuotaExceeded_Subsciptions), errors.Is(err, in10n.ErrQuotaExceeded_SubsciptionsPerSubject),
+		errors.Is(err, errQuotaExceededChannelsPerSubject), errors.Is(err, errQuotaExceededProjectionsPerChannel):
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// {"sys.Error":{"HTTPStatus":429,"Message":"quota exceeded: number of channels per subject"}}
+func writeN10NError(rw http.ResponseWriter, err error, status int) {
+	if status == http.StatusTooManyRequests {
+		rw.Header().Set("Retry-After", strconv.Itoa(n10nQuotaRetryAfter))
+	}
+	rw.Header().Set(coreutils.ContentType, coreutils.ApplicationJSON)
+	rw.WriteHeader(status)
+	writeResponse(rw, coreutils.SysError{HTTPStatus: status, Message: err.Error()}.ToJSON())
+}
+
+func validateProjectionKey(projection in10n.ProjectionKey) error {
+	switch {
+	case projection.App == istructs.NullAppQName:
+		return errors.New("App is not specified")
+	case projection.Projection == appdef.NullQName:
+		return errors.New("Projection is not specified")
+	case projection.WS == istructs.NullWSID:
+		return errors.New("WS is not specified")
+	}
+	return nil
+}
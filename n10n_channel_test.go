@@ -0,0 +1,457 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/voedger/voedger/pkg/appdef"
+	"github.com/voedger/voedger/pkg/in10n"
+	"github.com/voedger/voedger/pkg/in10nmem"
+	istructs "github.com/voedger/voedger/pkg/istructs"
+	coreutils "github.com/voedger/voedger/pkg/utils"
+)
+
+func TestSSEResume(t *testing.T) {
+	require := require.New(t)
+	broker := newTestN10NBroker()
+	s := &httpService{
+		n10n:         broker,
+		bus:          &testN10NAuthBus{allowedWS: map[istructs.WSID]bool{1: true}},
+		RouterParams: RouterParams{N10NResumeTimeout: 60, SSERetry: 3000, N10NAuthResource: testN10NAuthResource},
+	}
+	server := httptest.NewServer(s.authHandler(s.subscribeAndWatchHandler(), authPolicyRequired, []string{http.MethodGet}, true))
+	defer server.Close()
+	app := istructs.NewAppQName("untill", "airs-bp")
+	price := in10n.ProjectionKey{App: app, Projection: appdef.NewQName("paa", "price"), WS: 1}
+	winePrice := in10n.ProjectionKey{App: app, Projection: appdef.NewQName("paa", "wine_price"), WS: 1}
+	payload, err := json.Marshal(createChannelParamsType{ProjectionKey: []in10n.ProjectionKey{price, winePrice}})
+	require.NoError(err)
+	ownerToken := issueTestToken(t, "HS256", "", testSecret, testClaims("untill/airs-bp", time.Now().Add(time.Hour)))
+
+	connect := func(token string, lastEventID string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"?payload="+url.QueryEscape(string(payload)), http.NoBody)
+		require.NoError(err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if len(lastEventID) > 0 {
+			req.Header.Set(lastEventIDHeader, lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(err)
+		return resp
+	}
+	// lines of the next event
+	readEvent := func(reader *bufio.Reader) (lines []string) {
+		for {
+			line, err := reader.ReadString('\n')
+			require.NoError(err)
+			line = strings.TrimSuffix(line, "\n")
+			if len(line) == 0 {
+				return lines
+			}
+			lines = append(lines, line)
+		}
+	}
+	waitWatcher := func(channel in10n.ChannelID) {
+		require.Eventually(func() bool {
+			broker.Lock()
+			defer broker.Unlock()
+			return broker.watchers[channel] != nil
+		}, time.Second, 10*time.Millisecond)
+	}
+	priceEvent, err := json.Marshal(&price)
+	require.NoError(err)
+	winePriceEvent, err := json.Marshal(&winePrice)
+	require.NoError(err)
+
+	resp := connect(ownerToken, "")
+	reader := bufio.NewReader(resp.Body)
+	lines := readEvent(reader)
+	require.Len(lines, 4)
+	require.Equal("retry: 3000", lines[0])
+	require.Equal("event: channelId", lines[1])
+	channel := in10n.ChannelID(strings.TrimPrefix(lines[3], "data: "))
+	require.Equal("id: "+string(channel)+":0", lines[2])
+
+	waitWatcher(channel)
+	broker.Update(price, 13)
+	require.Equal([]string{"event: " + string(priceEvent), "id: " + string(channel) + ":1", "data: 13"}, readEvent(reader))
+
+	// client disconnected -> the channel is kept alive, updates are collected
+	require.NoError(resp.Body.Close())
+	s.n10nChannels.Lock()
+	ch := s.n10nChannels.channels[channel]
+	s.n10nChannels.Unlock()
+	require.Eventually(func() bool {
+		ch.Lock()
+		defer ch.Unlock()
+		return ch.stream == nil
+	}, time.Second, 10*time.Millisecond)
+	broker.Update(winePrice, 14)
+	broker.Update(winePrice, 15)
+
+	t.Run("channel of another principal", func(t *testing.T) {
+		otherToken := issueTestToken(t, "HS256", "", testSecret, map[string]interface{}{"AppQName": "untill/airs-bp", "Login": "other"})
+		resp := connect(otherToken, string(channel)+":1")
+		defer resp.Body.Close()
+		require.Equal(http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("malformed Last-Event-ID", func(t *testing.T) {
+		resp := connect(ownerToken, "wrong")
+		defer resp.Body.Close()
+		require.Equal(http.StatusBadRequest, resp.StatusCode)
+	})
+
+	// reconnect -> the latest offset is replayed
+	resp = connect(ownerToken, string(channel)+":1")
+	reader = bufio.NewReader(resp.Body)
+	lines = readEvent(reader)
+	require.Equal([]string{"retry: 3000", "event: channelId", "id: " + string(channel) + ":1", "data: " + string(channel)}, lines)
+	require.Equal([]string{"event: " + string(winePriceEvent), "id: " + string(channel) + ":3", "data: 15"}, readEvent(reader))
+	broker.Update(price, 16)
+	require.Equal([]string{"event: " + string(priceEvent), "id: " + string(channel) + ":4", "data: 16"}, readEvent(reader))
+	require.Equal(1, broker.MetricNumChannels())
+	require.NoError(resp.Body.Close())
+
+	// the channel is closed already -> new channel
+	ch.cancel()
+	<-ch.watchDone
+	resp = connect(ownerToken, string(channel)+":4")
+	defer resp.Body.Close()
+	lines = readEvent(bufio.NewReader(resp.Body))
+	require.NotEqual("data: "+string(channel), lines[3])
+	require.True(strings.HasSuffix(lines[2], ":0"))
+}
+
+func TestSSEResumeSubscriptionsCount(t *testing.T) {
+	require := require.New(t)
+	// in10nmem counts each Subscribe call against the quotas
+	broker := in10nmem.Provide(in10n.Quotas{Channels: 10, ChannelsPerSubject: 10, Subsciptions: 10, SubsciptionsPerSubject: 1})
+	s := &httpService{
+		n10n:         broker,
+		bus:          &testN10NAuthBus{allowedWS: map[istructs.WSID]bool{1: true}},
+		RouterParams: RouterParams{N10NResumeTimeout: 60},
+	}
+	server := httptest.NewServer(s.authHandler(s.subscribeAndWatchHandler(), authPolicyRequired, []string{http.MethodGet}, true))
+	defer server.Close()
+	price := in10n.ProjectionKey{App: istructs.NewAppQName("untill", "airs-bp"), Projection: appdef.NewQName("paa", "price"), WS: 1}
+	payload, err := json.Marshal(createChannelParamsType{ProjectionKey: []in10n.ProjectionKey{price}})
+	require.NoError(err)
+	token := issueTestToken(t, "HS256", "", testSecret, testClaims("untill/airs-bp", time.Now().Add(time.Hour)))
+	// returns the channel id sent by the first event
+	connect := func(lastEventID string) in10n.ChannelID {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"?payload="+url.QueryEscape(string(payload)), http.NoBody)
+		require.NoError(err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if len(lastEventID) > 0 {
+			req.Header.Set(lastEventIDHeader, lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(err)
+		defer resp.Body.Close()
+		require.Equal(http.StatusOK, resp.StatusCode)
+		reader := bufio.NewReader(resp.Body)
+		for {
+			line, err := reader.ReadString('\n')
+			require.NoError(err)
+			if strings.HasPrefix(line, "data: ") {
+				return in10n.ChannelID(strings.TrimSpace(strings.TrimPrefix(line, "data: ")))
+			}
+		}
+	}
+
+	channel := connect("")
+	s.n10nChannels.Lock()
+	ch := s.n10nChannels.channels[channel]
+	s.n10nChannels.Unlock()
+	for i := 0; i < 3; i++ {
+		require.Eventually(func() bool {
+			ch.Lock()
+			defer ch.Unlock()
+			return ch.stream == nil
+		}, time.Second, 10*time.Millisecond)
+		// the quota is not exceeded by the reattach
+		require.Equal(channel, connect(string(channel)+":0"))
+		require.Equal(1, broker.MetricNumSubcriptions())
+	}
+
+	ch.cancel()
+	<-ch.watchDone
+	require.Zero(broker.MetricNumSubcriptions())
+}
+
+func TestSSEHeartbeatAndShutdown(t *testing.T) {
+	require := require.New(t)
+	broker := newTestN10NBroker()
+	s := &httpService{
+		n10n:         broker,
+		bus:          &testN10NAuthBus{allowedWS: map[istructs.WSID]bool{1: true}},
+		RouterParams: RouterParams{SSEHeartbeatInterval: 1, SSEHeartbeatEvent: true},
+		stopping:     make(chan struct{}),
+	}
+	server := httptest.NewUnstartedServer(s.authHandler(s.subscribeAndWatchHandler(), authPolicyRequired, []string{http.MethodGet}, true))
+	// less than the heartbeat interval -> the write deadline must be extended per write
+	server.Config.WriteTimeout = 500 * time.Millisecond
+	server.Start()
+	defer server.Close()
+	price := in10n.ProjectionKey{App: istructs.NewAppQName("untill", "airs-bp"), Projection: appdef.NewQName("paa", "price"), WS: 1}
+	payload, err := json.Marshal(createChannelParamsType{ProjectionKey: []in10n.ProjectionKey{price}})
+	require.NoError(err)
+	req, err := http.NewRequest(http.MethodGet, server.URL+"?payload="+url.QueryEscape(string(payload)), http.NoBody)
+	require.NoError(err)
+	req.Header.Set("Authorization", "Bearer "+issueTestToken(t, "HS256", "", testSecret, testClaims("untill/airs-bp", time.Now().Add(time.Hour))))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(err)
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	readLine := func() string {
+		line, err := reader.ReadString('\n')
+		require.NoError(err)
+		return line
+	}
+	require.Equal("event: channelId\n", readLine())
+	readLine()
+	channel := in10n.ChannelID(strings.TrimSuffix(strings.TrimPrefix(readLine(), "data: "), "\n"))
+	require.Equal("\n", readLine())
+
+	require.Equal(sseHeartbeatEvent, readLine()+readLine()+readLine())
+	require.Equal(sseHeartbeatEvent, readLine()+readLine()+readLine())
+
+	// stopping -> clients are notified, channels are closed
+	close(s.stopping)
+	require.Equal(sseShutdownEvent, readLine()+readLine()+readLine())
+	_, err = reader.ReadString('\n')
+	require.Error(err)
+	require.Eventually(func() bool {
+		_, _, err := s.n10nChannels.get(channel, "paa")
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestN10NChannelLimits(t *testing.T) {
+	require := require.New(t)
+	broker := newTestN10NBroker()
+	s := &httpService{
+		n10n: broker,
+		bus:  &testN10NAuthBus{allowedWS: map[istructs.WSID]bool{1: true}},
+		RouterParams: RouterParams{
+			N10NChannelTTL:               600,
+			N10NChannelTTLByApp:          map[string]int{"untill/airs-bp": 60},
+			N10NMaxChannelsPerSubject:    1,
+			N10NMaxProjectionsPerChannel: 2,
+		},
+	}
+	app := istructs.NewAppQName("untill", "airs-bp")
+	price := in10n.ProjectionKey{App: app, Projection: appdef.NewQName("paa", "price"), WS: 1}
+	winePrice := in10n.ProjectionKey{App: app, Projection: appdef.NewQName("paa", "wine_price"), WS: 1}
+	beerPrice := in10n.ProjectionKey{App: app, Projection: appdef.NewQName("paa", "beer_price"), WS: 1}
+	otherAppPrice := in10n.ProjectionKey{App: istructs.NewAppQName("untill", "other"), Projection: appdef.NewQName("paa", "price"), WS: 1}
+	token := issueTestToken(t, "HS256", "", testSecret, testClaims("untill/airs-bp", time.Now().Add(time.Hour)))
+
+	ch, err := s.openN10NChannel("paa", []in10n.ProjectionKey{price})
+	require.NoError(err)
+	defer ch.cancel()
+	require.NoError(ch.subscribe(broker, []in10n.ProjectionKey{price}, s.N10NMaxProjectionsPerChannel))
+	require.Equal(time.Minute, broker.durations[ch.id])
+	otherCh, err := s.openN10NChannel("other", []in10n.ProjectionKey{otherAppPrice})
+	require.NoError(err)
+	defer otherCh.cancel()
+	require.Equal(10*time.Minute, broker.durations[otherCh.id])
+
+	send := func(h http.HandlerFunc, payload interface{}) *httptest.ResponseRecorder {
+		payloadBytes, err := json.Marshal(payload)
+		require.NoError(err)
+		req := httptest.NewRequest(http.MethodGet, "/n10n?payload="+url.QueryEscape(string(payloadBytes)), http.NoBody)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		s.authHandler(h, authPolicyRequired, nil, false).ServeHTTP(rec, req)
+		return rec
+	}
+	requireError := func(rec *httptest.ResponseRecorder, status int) {
+		require.Equal(status, rec.Code)
+		require.Equal(coreutils.ApplicationJSON, rec.Header().Get(coreutils.ContentType))
+		var body map[string]coreutils.SysError
+		require.NoError(json.Unmarshal(rec.Body.Bytes(), &body))
+		require.Equal(status, body["sys.Error"].HTTPStatus)
+	}
+
+	t.Run("channels per subject", func(t *testing.T) {
+		rec := send(s.subscribeAndWatchHandler(), createChannelParamsType{ProjectionKey: []in10n.ProjectionKey{price}})
+		requireError(rec, http.StatusTooManyRequests)
+		require.Equal(strconv.Itoa(n10nQuotaRetryAfter), rec.Header().Get("Retry-After"))
+	})
+
+	t.Run("projections per channel", func(t *testing.T) {
+		rec := send(s.subscribeHandler(), subscriberParamsType{Channel: ch.id, ProjectionKey: []in10n.ProjectionKey{winePrice}})
+		require.Equal(http.StatusOK, rec.Code)
+		// subscribed already -> not counted
+		rec = send(s.subscribeHandler(), subscriberParamsType{Channel: ch.id, ProjectionKey: []in10n.ProjectionKey{price}})
+		require.Equal(http.StatusOK, rec.Code)
+		rec = send(s.subscribeHandler(), subscriberParamsType{Channel: ch.id, ProjectionKey: []in10n.ProjectionKey{beerPrice}})
+		requireError(rec, http.StatusTooManyRequests)
+		require.False(broker.isSubscribed(ch.id, beerPrice))
+		// unsubscribe frees the quota
+		rec = send(s.unSubscribeHandler(), subscriberParamsType{Channel: ch.id, ProjectionKey: []in10n.ProjectionKey{winePrice}})
+		require.Equal(http.StatusOK, rec.Code)
+		rec = send(s.subscribeHandler(), subscriberParamsType{Channel: ch.id, ProjectionKey: []in10n.ProjectionKey{beerPrice}})
+		require.Equal(http.StatusOK, rec.Code)
+	})
+
+	t.Run("unknown channel", func(t *testing.T) {
+		requireError(send(s.subscribeHandler(), subscriberParamsType{Channel: "unknown", ProjectionKey: []in10n.ProjectionKey{price}}), http.StatusNotFound)
+	})
+
+	t.Run("malformed projection", func(t *testing.T) {
+		malformed := in10n.ProjectionKey{App: app, Projection: appdef.NewQName("paa", "price")}
+		requireError(send(s.subscribeHandler(), subscriberParamsType{Channel: ch.id, ProjectionKey: []in10n.ProjectionKey{malformed}}), http.StatusBadRequest)
+	})
+}
+
+func TestN10NChannelSubscriptionsCount(t *testing.T) {
+	require := require.New(t)
+	// in10nmem counts each Subscribe and Unsubscribe call
+	broker := in10nmem.Provide(in10n.Quotas{Channels: 10, ChannelsPerSubject: 10, Subsciptions: 10, SubsciptionsPerSubject: 3})
+	s := &httpService{n10n: broker}
+	app := istructs.NewAppQName("untill", "airs-bp")
+	price := in10n.ProjectionKey{App: app, Projection: appdef.NewQName("paa", "price"), WS: 1}
+	winePrice := in10n.ProjectionKey{App: app, Projection: appdef.NewQName("paa", "wine_price"), WS: 1}
+
+	ch, err := s.openN10NChannel("paa", []in10n.ProjectionKey{price})
+	require.NoError(err)
+	for i := 0; i < 5; i++ {
+		require.NoError(ch.subscribe(broker, []in10n.ProjectionKey{price, price}, 0))
+	}
+	require.Equal(1, broker.MetricNumSubcriptions())
+
+	// not subscribed -> the counters are not decremented
+	require.NoError(ch.unsubscribe(broker, []in10n.ProjectionKey{winePrice}))
+	require.Equal(1, broker.MetricNumSubcriptions())
+	require.NoError(ch.unsubscribe(broker, []in10n.ProjectionKey{price}))
+	require.NoError(ch.unsubscribe(broker, []in10n.ProjectionKey{price}))
+	require.Zero(broker.MetricNumSubcriptions())
+
+	require.NoError(ch.subscribe(broker, []in10n.ProjectionKey{price, winePrice}, 0))
+	require.Equal(2, broker.MetricNumSubcriptions())
+	ch.cancel()
+	<-ch.watchDone
+	require.Zero(broker.MetricNumSubcriptions())
+}
+
+func TestN10NCoalescing(t *testing.T) {
+	require := require.New(t)
+	s := &httpService{n10n: newTestN10NBroker()}
+	app := istructs.NewAppQName("untill", "airs-bp")
+	price := in10n.ProjectionKey{App: app, Projection: appdef.NewQName("paa", "price"), WS: 1}
+	winePrice := in10n.ProjectionKey{App: app, Projection: appdef.NewQName("paa", "wine_price"), WS: 1}
+	ch, err := s.openN10NChannel("paa", []in10n.ProjectionKey{price})
+	require.NoError(err)
+	defer ch.cancel()
+	stream, replay := ch.attach(0)
+	require.Empty(replay)
+	ctx := context.Background()
+	coalesce := func(window time.Duration) []n10nEvent {
+		events := ch.coalesce(ctx, stream, window)
+		for i := range events {
+			require.NotZero(events[i].timestamp)
+			events[i].timestamp = 0
+		}
+		return events
+	}
+
+	// slow client -> intermediate offsets are dropped, the broker is not blocked
+	ch.notify(price, 1)
+	ch.notify(price, 2)
+	ch.notify(winePrice, 3)
+	ch.notify(price, 4)
+	<-stream.ready
+	require.Equal([]n10nEvent{{UpdateUnit: UpdateUnit{Projection: winePrice, Offset: 3}, seq: 3}, {UpdateUnit: UpdateUnit{Projection: price, Offset: 4}, seq: 4}}, coalesce(0))
+	require.Equal(int64(2), s.metrics.n10nDroppedEvents.Load())
+	require.Empty(coalesce(0))
+
+	// burst within the window -> the latest offset only
+	ch.notify(price, 5)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		ch.notify(price, 6)
+	}()
+	<-stream.ready
+	require.Equal([]n10nEvent{{UpdateUnit: UpdateUnit{Projection: price, Offset: 6}, seq: 6}}, coalesce(200*time.Millisecond))
+	require.Equal(int64(3), s.metrics.n10nDroppedEvents.Load())
+
+	// detached -> nothing to send
+	ch.notify(price, 7)
+	ch.attach(6)
+	require.Nil(coalesce(time.Second))
+}
+
+func TestSSEFormatV2(t *testing.T) {
+	require := require.New(t)
+	broker := newTestN10NBroker()
+	s := &httpService{
+		n10n: broker,
+		bus:  &testN10NAuthBus{allowedWS: map[istructs.WSID]bool{1: true}},
+	}
+	server := httptest.NewServer(s.authHandler(s.subscribeAndWatchHandler(), authPolicyRequired, []string{http.MethodGet}, true))
+	defer server.Close()
+	price := in10n.ProjectionKey{App: istructs.NewAppQName("untill", "airs-bp"), Projection: appdef.NewQName("paa", "price"), WS: 1}
+	payload, err := json.Marshal(createChannelParamsType{ProjectionKey: []in10n.ProjectionKey{price}})
+	require.NoError(err)
+	token := issueTestToken(t, "HS256", "", testSecret, testClaims("untill/airs-bp", time.Now().Add(time.Hour)))
+	connect := func(format string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"?format="+format+"&payload="+url.QueryEscape(string(payload)), http.NoBody)
+		require.NoError(err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(err)
+		return resp
+	}
+
+	t.Run("unknown format", func(t *testing.T) {
+		resp := connect("v3")
+		defer resp.Body.Close()
+		require.Equal(http.StatusBadRequest, resp.StatusCode)
+	})
+
+	resp := connect(sseFormatV2)
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	readLine := func() string {
+		line, err := reader.ReadString('\n')
+		require.NoError(err)
+		return strings.TrimSuffix(line, "\n")
+	}
+	require.Equal("event: channelId", readLine())
+	readLine()
+	channel := in10n.ChannelID(strings.TrimPrefix(readLine(), "data: "))
+	require.Empty(readLine())
+	require.Eventually(func() bool {
+		broker.Lock()
+		defer broker.Unlock()
+		return broker.watchers[channel] != nil
+	}, time.Second, 10*time.Millisecond)
+
+	before := time.Now().UnixMilli()
+	broker.Update(price, 13)
+	require.Equal("event: update", readLine())
+	require.Equal("id: "+string(channel)+":1", readLine())
+	data := strings.TrimPrefix(readLine(), "data: ")
+	var update sseUpdateData
+	require.NoError(json.Unmarshal([]byte(data), &update))
+	require.GreaterOrEqual(int64(update.Timestamp), before)
+	update.Timestamp = 0
+	require.Equal(sseUpdateData{App: price.App, Projection: price.Projection, WS: 1, Offset: 13}, update)
+	require.Contains(data, `"App":"untill/airs-bp","Projection":"paa.price","WS":1,"Offset":13`)
+}
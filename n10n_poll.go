@@ -0,0 +1,173 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/untillpro/goutils/logger"
+	"github.com/voedger/voedger/pkg/in10n"
+	coreutils "github.com/voedger/voedger/pkg/utils"
+)
+
+/*
+fallback for the clients behind proxies that buffer SSE
+curl -G --data-urlencode "payload={\"ProjectionKey\":[{\"App\":\"untill/airs-bp\",\"Projection\":\"paa.price\",\"WS\":1}]}" https://alpha2.dev.untill.ru/n10n/poll/channel -H "Authorization: Bearer <token>"
+{"Channel":"a23b2050-b90c-4ed1-adb7-1ecc4f346f2b"}
+or POST with the payload in the body
+*/
+func (s *httpService) pollChannelHandler() http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		var params createChannelParamsType
+		if err := getJsonPayload(req, &params); err != nil {
+			writeN10NError(rw, err, http.StatusBadRequest)
+			return
+		}
+		logger.Info("n10n poll channel: ", params)
+		login, ok := s.authorizeN10N(rw, req, params.ProjectionKey)
+		if !ok {
+			return
+		}
+		if len(params.SubjectLogin) > 0 && params.SubjectLogin != login {
+			writeN10NError(rw, errors.New("SubjectLogin does not match the principal login"), http.StatusForbidden)
+			return
+		}
+		ch, err := s.openN10NChannel(login, params.ProjectionKey)
+		if err != nil {
+			logger.Error(err)
+			writeN10NError(rw, err, n10nErrorStatus(err))
+			return
+		}
+		if err := ch.subscribe(s.n10n, params.ProjectionKey, s.N10NMaxProjectionsPerChannel); err != nil {
+			logger.Error(err)
+			ch.cancel()
+			writeN10NError(rw, err, n10nErrorStatus(err))
+			return
+		}
+		// not polled -> closed
+		ch.closeIfIdle(s.n10nPollKeepAlive())
+		writeN10NJSON(rw, pollChannelResponse{Channel: ch.id})
+	}
+}
+
+/*
+curl "https://alpha2.dev.untill.ru/n10n/poll?channel=a23b2050-b90c-4ed1-adb7-1ecc4f346f2b&timeout=30" -H "Authorization: Bearer <token>"
+{"Updates":[{"Projection":{"App":"untill/airs-bp","Projection":"paa.price","WS":1},"Offset":13}]}
+*/
+func (s *httpService) pollHandler() http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		channelID := in10n.ChannelID(query.Get("channel"))
+		if len(channelID) == 0 {
+			writeN10NError(rw, errors.New("channel query parameter is missing"), http.StatusBadRequest)
+			return
+		}
+		timeout := DefaultN10NPollTimeout
+		if timeoutParam := query.Get("timeout"); len(timeoutParam) > 0 {
+			var err error
+			if timeout, err = strconv.Atoi(timeoutParam); err != nil || timeout < 0 {
+				writeN10NError(rw, fmt.Errorf("timeout %s is malformed", timeoutParam), http.StatusBadRequest)
+				return
+			}
+		}
+		if timeout > n10nMaxPollTimeout {
+			timeout = n10nMaxPollTimeout
+		}
+		p, ok := principalFromContext(req.Context())
+		if !ok {
+			writeN10NError(rw, errors.New("not authorized"), http.StatusUnauthorized)
+			return
+		}
+		ch, status, err := s.n10nChannels.find(channelID)
+		if err == nil {
+			status, err = s.authorizeN10NChannel(req.Context(), p, ch)
+		}
+		if err != nil {
+			writeN10NError(rw, err, status)
+			return
+		}
+		updates, lastSeq, err := ch.poll(req.Context(), time.Duration(timeout)*time.Second, s.n10nCoalesceWindow(), s.n10nPollKeepAlive(), s.stopping)
+		if err != nil {
+			writeN10NError(rw, err, n10nErrorStatus(err))
+			return
+		}
+		// the poll could outlive the server WriteTimeout
+		rc := http.NewResponseController(rw)
+		_ = rc.SetWriteDeadline(time.Now().Add(n10nPollWriteTimeout)) // not supported -> the server WriteTimeout is kept
+		if writeN10NJSON(rw, pollResponse{Updates: updates}) && rc.Flush() == nil {
+			// failed to write -> the same updates are returned by the next poll
+			ch.commitPoll(lastSeq)
+		}
+	}
+}
+
+// the channel is closed if not polled during the resume timeout
+func (s *httpService) n10nPollKeepAlive() time.Duration {
+	if s.N10NResumeTimeout > 0 {
+		return time.Duration(s.N10NResumeTimeout) * time.Second
+	}
+	return DefaultN10NResumeTimeout * time.Second
+}
+
+// returns the latest offsets updated since the previous poll or waits for the update during timeout
+// lastSeq must be committed by commitPoll when the updates are delivered to the client
+// the channel is closed -> in10n.ErrChannelDoesNotExist
+func (ch *n10nChannel) poll(ctx context.Context, timeout time.Duration, window time.Duration, keepAlive time.Duration, stopping <-chan struct{}) (updates []UpdateUnit, lastSeq uint64, err error) {
+	ch.Lock()
+	polledSeq := ch.polledSeq
+	ch.Unlock()
+	stream, replay := ch.attach(polledSeq)
+	defer ch.detach(stream, keepAlive)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for len(replay) == 0 {
+		select {
+		case <-stream.ready:
+			replay = ch.coalesce(ctx, stream, window)
+			continue
+		case <-ch.watchDone:
+			return nil, 0, in10n.ErrChannelDoesNotExist
+		case <-timer.C:
+		case <-stream.detached:
+			// polled by another request
+		case <-stopping:
+		case <-ctx.Done():
+		}
+		break
+	}
+	updates = make([]UpdateUnit, 0, len(replay))
+	for _, event := range replay {
+		updates = append(updates, event.UpdateUnit)
+		lastSeq = event.seq
+	}
+	return updates, lastSeq, nil
+}
+
+// the updates up to seq are delivered to the client
+func (ch *n10nChannel) commitPoll(seq uint64) {
+	ch.Lock()
+	defer ch.Unlock()
+	if seq > ch.polledSeq {
+		ch.polledSeq = seq
+	}
+}
+
+// false -> failed to write
+func writeN10NJSON(rw http.ResponseWriter, res interface{}) bool {
+	body, err := json.Marshal(res)
+	if err != nil {
+		writeN10NError(rw, err, http.StatusInternalServerError)
+		return false
+	}
+	rw.Header().Set(coreutils.ContentType, coreutils.ApplicationJSON)
+	rw.Header().Set("Cache-Control", "no-cache")
+	return writeResponse(rw, string(body))
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/voedger/voedger/pkg/appdef"
+	"github.com/voedger/voedger/pkg/in10n"
+	istructs "github.com/voedger/voedger/pkg/istructs"
+)
+
+func TestN10NPoll(t *testing.T) {
+	require := require.New(t)
+	broker := newTestN10NBroker()
+	forgedToken := issueTestToken(t, "HS256", "", []byte("forged"), testClaims("untill/airs-bp", time.Now().Add(time.Hour)))
+	bus := &testN10NAuthBus{allowedWS: map[istructs.WSID]bool{1: true}, invalidToken: forgedToken}
+	s := &httpService{
+		n10n:         broker,
+		bus:          bus,
+		RouterParams: RouterParams{N10NResumeTimeout: 1, N10NAuthResource: testN10NAuthResource},
+	}
+	app := istructs.NewAppQName("untill", "airs-bp")
+	price := in10n.ProjectionKey{App: app, Projection: appdef.NewQName("paa", "price"), WS: 1}
+	winePrice := in10n.ProjectionKey{App: app, Projection: appdef.NewQName("paa", "wine_price"), WS: 1}
+	token := issueTestToken(t, "HS256", "", testSecret, testClaims("untill/airs-bp", time.Now().Add(time.Hour)))
+	send := func(h http.HandlerFunc, query string, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/n10n/poll?"+query, http.NoBody)
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		s.authHandler(h, authPolicyRequired, nil, false).ServeHTTP(rec, req)
+		return rec
+	}
+	poll := func(channel in10n.ChannelID, timeout string) (updates []UpdateUnit) {
+		rec := send(s.pollHandler(), "channel="+string(channel)+"&timeout="+timeout, token)
+		require.Equal(http.StatusOK, rec.Code, rec.Body.String())
+		var res pollResponse
+		require.NoError(json.Unmarshal(rec.Body.Bytes(), &res))
+		require.NotNil(res.Updates)
+		return res.Updates
+	}
+
+	payload, err := json.Marshal(createChannelParamsType{ProjectionKey: []in10n.ProjectionKey{price, winePrice}})
+	require.NoError(err)
+	rec := send(s.pollChannelHandler(), "payload="+url.QueryEscape(string(payload)), token)
+	require.Equal(http.StatusOK, rec.Code)
+	var channelRes pollChannelResponse
+	require.NoError(json.Unmarshal(rec.Body.Bytes(), &channelRes))
+	channel := channelRes.Channel
+	require.True(broker.isSubscribed(channel, price))
+	require.Eventually(func() bool {
+		broker.Lock()
+		defer broker.Unlock()
+		return broker.watchers[channel] != nil
+	}, time.Second, 10*time.Millisecond)
+
+	// timeout -> empty result
+	require.Empty(poll(channel, "0"))
+
+	// updates between polls -> the latest offset per projection
+	broker.Update(price, 13)
+	broker.Update(winePrice, 14)
+	broker.Update(price, 15)
+	require.Equal([]UpdateUnit{{Projection: winePrice, Offset: 14}, {Projection: price, Offset: 15}}, poll(channel, "1"))
+	require.Empty(poll(channel, "0"))
+
+	// waits for the update
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		broker.Update(price, 16)
+	}()
+	require.Equal([]UpdateUnit{{Projection: price, Offset: 16}}, poll(channel, "5"))
+
+	t.Run("failed to write -> the same updates on the next poll", func(t *testing.T) {
+		broker.Update(price, 17)
+		req := httptest.NewRequest(http.MethodGet, "/n10n/poll?timeout=1&channel="+string(channel), http.NoBody)
+		req.Header.Set("Authorization", "Bearer "+token)
+		s.authHandler(s.pollHandler(), authPolicyRequired, nil, false).ServeHTTP(failingWriter{httptest.NewRecorder()}, req)
+		require.Equal([]UpdateUnit{{Projection: price, Offset: 17}}, poll(channel, "1"))
+		require.Empty(poll(channel, "0"))
+	})
+
+	t.Run("access is checked once per token", func(t *testing.T) {
+		atomic.StoreInt32(&bus.calls, 0)
+		require.Empty(poll(channel, "0"))
+		require.Empty(poll(channel, "0"))
+		require.Zero(atomic.LoadInt32(&bus.calls))
+		refreshedToken := issueTestToken(t, "HS256", "", testSecret, testClaims("untill/airs-bp", time.Now().Add(2*time.Hour)))
+		require.Equal(http.StatusOK, send(s.pollHandler(), "timeout=0&channel="+string(channel), refreshedToken).Code)
+		require.Equal(http.StatusOK, send(s.pollHandler(), "timeout=0&channel="+string(channel), refreshedToken).Code)
+		require.Equal(int32(1), atomic.LoadInt32(&bus.calls))
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		require.Equal(http.StatusUnauthorized, send(s.pollHandler(), "channel="+string(channel), "").Code)
+		require.Equal(http.StatusBadRequest, send(s.pollHandler(), "timeout=1", token).Code)
+		require.Equal(http.StatusBadRequest, send(s.pollHandler(), "channel="+string(channel)+"&timeout=wrong", token).Code)
+		require.Equal(http.StatusNotFound, send(s.pollHandler(), "channel=unknown", token).Code)
+		otherToken := issueTestToken(t, "HS256", "", testSecret, map[string]interface{}{"AppQName": "untill/airs-bp", "Login": "other"})
+		require.Equal(http.StatusForbidden, send(s.pollHandler(), "channel="+string(channel), otherToken).Code)
+		// the owner login in the token rejected by the app
+		require.Equal(http.StatusUnauthorized, send(s.pollHandler(), "channel="+string(channel), forgedToken).Code)
+	})
+
+	// not polled during the resume timeout -> the channel is closed
+	ch, _, err := s.n10nChannels.get(channel, "paa")
+	require.NoError(err)
+	select {
+	case <-ch.watchDone:
+	case <-time.After(3 * time.Second):
+		require.Fail("channel is not closed")
+	}
+	require.Eventually(func() bool {
+		return send(s.pollHandler(), "channel="+string(channel), token).Code == http.StatusNotFound
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/untillpro/goutils/logger"
+	"github.com/voedger/voedger/pkg/in10n"
+	"golang.org/x/net/websocket"
+)
+
+/*
+one connection -> one channel. The channel is created on the first subscribe frame:
+> {"Type":"subscribe","ID":"1","ProjectionKey":[{"App":"untill/airs-bp","Projection":"paa.price","WS":1}]}
+< {"Type":"channel","Channel":"a23b2050-b90c-4ed1-adb7-1ecc4f346f2b"}
+< {"Type":"ack","ID":"1"}
+< {"Type":"update","Projection":{"App":"untill/airs-bp","Projection":"paa.price","WS":1},"Offset":13}
+*/
+func (s *httpService) wsHandler() http.Handler {
+	return websocket.Server{
+		Handshake: s.wsHandshake,
+		Handler:   s.serveN10NWebSocket,
+	}
+}
+
+// websocket is not restricted by the browser CORS policy -> the origin is checked here
+func (s *httpService) wsHandshake(config *websocket.Config, req *http.Request) error {
+	origin := req.Header.Get("Origin")
+	if p, ok := principalFromContext(req.Context()); ok && p.source == principalTokenSourceCookie {
+		// the browser sends the cookie on the cross-site handshake too -> cross-site WebSocket hijacking
+		// so the origin must be allowed explicitly, denied by default
+		if s.cors == nil || !s.cors.isOriginListed(origin) {
+			return fmt.Errorf("origin %s is not allowed for the cookie token", origin)
+		}
+		return nil
+	}
+	if len(origin) > 0 && s.cors != nil && !s.cors.isOriginAllowed(origin) {
+		return fmt.Errorf("origin %s is not allowed", origin)
+	}
+	return nil
+}
+
+type wsSession struct {
+	*httpService
+	conn      *websocket.Conn
+	principal principal
+	ctx       context.Context
+	cancel    context.CancelFunc
+	out       chan wsMessage
+	ch        *n10nChannel
+	forwarded chan struct{}
+}
+
+func (s *httpService) serveN10NWebSocket(conn *websocket.Conn) {
+	p, ok := principalFromContext(conn.Request().Context())
+	if !ok {
+		_ = websocket.JSON.Send(conn, wsMessage{Type: wsMessageError, Status: http.StatusUnauthorized, Error: "not authorized"})
+		return
+	}
+	ctx, cancel := context.WithCancel(conn.Request().Context())
+	session := &wsSession{
+		httpService: s,
+		conn:        conn,
+		principal:   p,
+		ctx:         ctx,
+		cancel:      cancel,
+		out:         make(chan wsMessage, wsSendBufferSize),
+	}
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		session.writeFrames()
+	}()
+	session.readFrames()
+	cancel()
+	if session.ch != nil {
+		<-session.forwarded
+		<-session.ch.watchDone
+	}
+	<-writerDone
+}
+
+func (ws *wsSession) readFrames() {
+	for ws.ctx.Err() == nil {
+		if err := ws.conn.SetReadDeadline(time.Now().Add(wsReadTimeout)); err != nil {
+			return
+		}
+		var msg wsMessage
+		if err := websocket.JSON.Receive(ws.conn, &msg); err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				ws.sendError(msg.ID, http.StatusBadRequest, fmt.Errorf("failed to parse frame: %w", err))
+				continue
+			}
+			if ws.ctx.Err() == nil {
+				logger.Verbose("n10n websocket closed: ", err)
+			}
+			return
+		}
+		switch msg.Type {
+		case wsMessagePing:
+			ws.send(wsMessage{Type: wsMessagePong, ID: msg.ID})
+		case wsMessagePong:
+			// read deadline is prolonged already
+		case wsMessageSubscribe:
+			ws.subscribe(msg)
+		case wsMessageUnsubscribe:
+			ws.unsubscribe(msg)
+		default:
+			ws.sendError(msg.ID, http.StatusBadRequest, fmt.Errorf("unknown frame type %s", msg.Type))
+		}
+	}
+}
+
+func (ws *wsSession) subscribe(msg wsMessage) {
+	login, status, err := ws.authorizeN10NProjections(ws.ctx, ws.principal, msg.ProjectionKey)
+	if err != nil {
+		ws.sendError(msg.ID, status, err)
+		return
+	}
+	if ws.ch == nil {
+		if ws.ch, err = ws.openN10NChannel(login, msg.ProjectionKey); err != nil {
+			logger.Error(err)
+			ws.sendError(msg.ID, n10nErrorStatus(err), err)
+			return
+		}
+		stream, _ := ws.ch.attach(0)
+		ws.forwarded = make(chan struct{})
+		go func() {
+			defer close(ws.forwarded)
+			// websocket channel is not resumed
+			defer ws.ch.detach(stream, 0)
+			ws.forward(stream)
+		}()
+		ws.send(wsMessage{Type: wsMessageChannel, Channel: ws.ch.id})
+	}
+	if err := ws.ch.subscribe(ws.n10n, msg.ProjectionKey, ws.N10NMaxProjectionsPerChannel); err != nil {
+		logger.Error(err)
+		ws.sendError(msg.ID, n10nErrorStatus(err), err)
+		return
+	}
+	ws.send(wsMessage{Type: wsMessageAck, ID: msg.ID})
+}
+
+func (ws *wsSession) unsubscribe(msg wsMessage) {
+	if ws.ch == nil {
+		ws.sendError(msg.ID, http.StatusNotFound, in10n.ErrChannelDoesNotExist)
+		return
+	}
+	if err := ws.ch.unsubscribe(ws.n10n, msg.ProjectionKey); err != nil {
+		logger.Error(err)
+		ws.sendError(msg.ID, n10nErrorStatus(err), err)
+		return
+	}
+	ws.send(wsMessage{Type: wsMessageAck, ID: msg.ID})
+}
+
+// channel events -> update frames until the connection is closed
+func (ws *wsSession) forward(stream *n10nStream) {
+	for {
+		select {
+		case <-stream.ready:
+			for _, event := range ws.ch.coalesce(ws.ctx, stream, ws.n10nCoalesceWindow()) {
+				projection := event.Projection
+				ws.send(wsMessage{Type: wsMessageUpdate, Projection: &projection, Offset: event.Offset})
+			}
+		case <-ws.ch.watchDone:
+			ws.cancel()
+			return
+		case <-ws.ctx.Done():
+			return
+		}
+	}
+}
+
+func (ws *wsSession) sendError(id string, status int, err error) {
+	ws.send(wsMessage{Type: wsMessageError, ID: id, Status: status, Error: err.Error()})
+}
+
+// never blocks the broker: the send buffer is full -> the client is too slow, the connection is closed
+func (ws *wsSession) send(msg wsMessage) {
+	select {
+	case ws.out <- msg:
+	default:
+		logger.Error("n10n websocket send buffer overflow, connection is closed")
+		ws.cancel()
+	}
+}
+
+func (ws *wsSession) writeFrames() {
+	// unblocks the reader
+	defer ws.conn.Close()
+	defer ws.cancel()
+	pingTicker := time.NewTicker(wsPingInterval)
+	defer pingTicker.Stop()
+	for {
+		var msg wsMessage
+		select {
+		case <-ws.ctx.Done():
+			return
+		case msg = <-ws.out:
+		case <-pingTicker.C:
+			msg = wsMessage{Type: wsMessagePing}
+		}
+		if err := ws.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout)); err != nil {
+			return
+		}
+		if err := websocket.JSON.Send(ws.conn, msg); err != nil {
+			logger.Verbose("failed to write n10n websocket frame: ", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	"github.com/voedger/voedger/pkg/appdef"
+	"github.com/voedger/voedger/pkg/in10n"
+	istructs "github.com/voedger/voedger/pkg/istructs"
+	"golang.org/x/net/websocket"
+)
+
+func TestN10NWebSocket(t *testing.T) {
+	require := require.New(t)
+	broker := newTestN10NBroker()
+	cors, err := newCORSPolicy(CORSParams{AllowedOrigins: []string{"https://web.untill.com"}})
+	require.NoError(err)
+	s := &httpService{n10n: broker, bus: &testN10NAuthBus{allowedWS: map[istructs.WSID]bool{1: true}}, cors: cors, RouterParams: RouterParams{N10NAuthResource: testN10NAuthResource}}
+	router := mux.NewRouter()
+	router.Use(newSecurityHeadersPolicy(SecurityHeadersParams{Default: SecurityHeaders{FrameOptions: DefaultFrameOptions}}).middleware)
+	router.Handle("/n10n/ws", s.authHandler(s.wsHandler(), authPolicyRequired, []string{http.MethodGet}, true)).Name(routeNameN10NWebSocket)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/n10n/ws"
+	token := issueTestToken(t, "HS256", "", testSecret, testClaims("untill/airs-bp", time.Now().Add(time.Hour)))
+
+	dial := func(origin string, token string) (*websocket.Conn, error) {
+		config, err := websocket.NewConfig(wsURL, origin)
+		require.NoError(err)
+		if len(token) > 0 {
+			config.Header.Set("Authorization", "Bearer "+token)
+		}
+		return websocket.DialConfig(config)
+	}
+
+	t.Run("handshake", func(t *testing.T) {
+		_, err := dial("https://web.untill.com", "")
+		require.Error(err)
+		_, err = dial("https://evil.com", token)
+		require.Error(err)
+	})
+
+	t.Run("cookie token requires listed origin", func(t *testing.T) {
+		dialCookie := func(wsURL string, origin string) error {
+			config, err := websocket.NewConfig(wsURL, origin)
+			require.NoError(err)
+			config.Header.Set("Cookie", "Authorization="+url.QueryEscape("Bearer "+token))
+			conn, err := websocket.DialConfig(config)
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}
+		require.NoError(dialCookie(wsURL, "https://web.untill.com"))
+		require.Error(dialCookie(wsURL, "https://evil.com"))
+
+		// any origin by default -> denied for the cookie, allowed for the header
+		anyOrigin, err := newCORSPolicy(CORSParams{})
+		require.NoError(err)
+		s := &httpService{n10n: broker, bus: s.bus, cors: anyOrigin}
+		server := httptest.NewServer(s.authHandler(s.wsHandler(), authPolicyRequired, []string{http.MethodGet}, true))
+		defer server.Close()
+		anyOriginURL := "ws" + strings.TrimPrefix(server.URL, "http")
+		require.Error(dialCookie(anyOriginURL, "https://evil.com"))
+		config, err := websocket.NewConfig(anyOriginURL, "https://evil.com")
+		require.NoError(err)
+		config.Header.Set("Authorization", "Bearer "+token)
+		conn, err := websocket.DialConfig(config)
+		require.NoError(err)
+		conn.Close()
+	})
+
+	conn, err := dial("https://web.untill.com", token)
+	require.NoError(err)
+	defer conn.Close()
+	send := func(msg wsMessage) {
+		require.NoError(websocket.JSON.Send(conn, msg))
+	}
+	receive := func() (msg wsMessage) {
+		require.NoError(conn.SetReadDeadline(time.Now().Add(5 * time.Second)))
+		require.NoError(websocket.JSON.Receive(conn, &msg))
+		return msg
+	}
+	app := istructs.NewAppQName("untill", "airs-bp")
+	allowed := in10n.ProjectionKey{App: app, Projection: appdef.NewQName("paa", "price"), WS: 1}
+	forbidden := in10n.ProjectionKey{App: app, Projection: appdef.NewQName("paa", "price"), WS: 2}
+
+	send(wsMessage{Type: wsMessagePing, ID: "1"})
+	require.Equal(wsMessage{Type: wsMessagePong, ID: "1"}, receive())
+
+	send(wsMessage{Type: wsMessageUnsubscribe, ID: "2", ProjectionKey: []in10n.ProjectionKey{allowed}})
+	require.Equal(http.StatusNotFound, receive().Status)
+
+	send(wsMessage{Type: wsMessageSubscribe, ID: "3", ProjectionKey: []in10n.ProjectionKey{forbidden}})
+	msg := receive()
+	require.Equal(wsMessageError, msg.Type)
+	require.Equal("3", msg.ID)
+	require.Equal(http.StatusForbidden, msg.Status)
+
+	send(wsMessage{Type: wsMessageSubscribe, ID: "4", ProjectionKey: []in10n.ProjectionKey{allowed}})
+	msg = receive()
+	require.Equal(wsMessageChannel, msg.Type)
+	channel := msg.Channel
+	require.Equal(wsMessage{Type: wsMessageAck, ID: "4"}, receive())
+	require.Equal(istructs.SubjectLogin("paa"), broker.subjects[channel])
+
+	require.Eventually(func() bool {
+		broker.Lock()
+		defer broker.Unlock()
+		return broker.watchers[channel] != nil
+	}, time.Second, 10*time.Millisecond)
+	broker.Update(allowed, 13)
+	require.Equal(wsMessage{Type: wsMessageUpdate, Projection: &allowed, Offset: 13}, receive())
+
+	send(wsMessage{Type: wsMessageUnsubscribe, ID: "5", ProjectionKey: []in10n.ProjectionKey{allowed}})
+	require.Equal(wsMessage{Type: wsMessageAck, ID: "5"}, receive())
+	require.False(broker.isSubscribed(channel, allowed))
+
+	send(wsMessage{Type: "unknown", ID: "6"})
+	require.Equal(http.StatusBadRequest, receive().Status)
+
+	// the channel is forgotten when the connection is closed
+	require.NoError(conn.Close())
+	require.Eventually(func() bool {
+		_, _, err := s.n10nChannels.get(channel, "paa")
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+}
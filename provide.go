@@ -5,8 +5,10 @@
 package router2
 
 import (
+	"container/list"
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"strings"
 
 	"github.com/voedger/voedger/pkg/in10n"
@@ -47,6 +49,17 @@ func ProvideBP3(hvmCtx context.Context, rp RouterParams, aBusTimeout time.Durati
 		busTimeout:    aBusTimeout,
 		appsWSAmount:  appsWSAmount,
 	}
+	if rp.EdgeAuth && rp.AppKeysProvider == nil {
+		if len(rp.AppKeysResource) > 0 {
+			httpService.AppKeysProvider = ProvideAppKeysProviderBus(bus, aBusTimeout, rp.AppKeysResource)
+		} else {
+			// no keys -> tokens are validated by the app only
+			logger.Warning("edge auth is disabled: keys resource is not specified")
+		}
+	}
+	if rp.IdempotencyKeyTTL > 0 && rp.IdempotencyStore == nil {
+		httpService.IdempotencyStore = ProvideIdempotencyStoreMem()
+	}
 	if bp != nil {
 		bp.procBus = iprocbusmem.Provide(bp.ServiceChannels)
 		for i := 0; i < bp.BLOBWorkersNum; i++ {
@@ -78,6 +91,10 @@ func ProvideBP3(hvmCtx context.Context, rp RouterParams, aBusTimeout time.Durati
 	if crtMgr.Cache == nil {
 		crtMgr.Cache = autocert.DirCache(rp.CertDir)
 	}
+	if httpService.SecurityHeaders.HSTSMaxAge == 0 {
+		// HSTS is automatic on HTTPS, e.g. if RouterParams are built without the command line
+		httpService.SecurityHeaders.HSTSMaxAge = DefaultHSTSMaxAge
+	}
 	httpsService := &httpsService{
 		httpService: &httpService,
 		crtMgr:      crtMgr,
@@ -89,10 +106,10 @@ func ProvideBP3(hvmCtx context.Context, rp RouterParams, aBusTimeout time.Durati
 			Addr:         ":80",
 			ReadTimeout:  DefaultACMEServerReadTimeout,
 			WriteTimeout: DefaultACMEServerWriteTimeout,
-			Handler:      crtMgr.HTTPHandler(nil),
+			Handler:      crtMgr.HTTPHandler(httpsRedirectHandler(rp.HTTPSRedirectStatus)),
 		},
 	}
-	acmeServiceHadler := crtMgr.HTTPHandler(nil)
+	acmeServiceHadler := crtMgr.HTTPHandler(httpsRedirectHandler(rp.HTTPSRedirectStatus))
 	if logger.IsVerbose() {
 		acmeService.Handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 			logger.Verbose("acme server request:", r.Method, r.Host, r.RemoteAddr, r.RequestURI, r.URL.String())
@@ -104,43 +121,175 @@ func ProvideBP3(hvmCtx context.Context, rp RouterParams, aBusTimeout time.Durati
 	return []interface{}{httpsService, acmeService}
 }
 
+// in-memory IIdempotencyStore, expired responses are dropped lazily
+// responses over idempotencyStoreMemMaxSize bytes -> the oldest are evicted
+func ProvideIdempotencyStoreMem() IIdempotencyStore {
+	return &implIIdempotencyStoreMem{
+		entries: map[string]*idempotencyEntry{},
+		stored:  list.New(),
+		maxSize: idempotencyStoreMemMaxSize,
+		now:     time.Now,
+	}
+}
+
+// fetches the app principal token keys via the bus by keysResource query function once and caches them. Failures are cached for appKeysFailureTTL
+func ProvideAppKeysProviderBus(bus ibus.IBus, busTimeout time.Duration, keysResource string) IAppKeysProvider {
+	return &implIAppKeysProviderBus{
+		bus:          bus,
+		busTimeout:   busTimeout,
+		keysResource: keysResource,
+		cache:        map[istructs.AppQName]*appKeysCacheEntry{},
+		now:          time.Now,
+	}
+}
+
 func ProvideRouterParamsFromCmdLine() RouterParams {
 	fs := flag.NewFlagSet("", flag.ExitOnError)
 	rp := RouterParams{}
 	routes := []string{}
 	routesRewrite := []string{}
+	routeDomains := []string{}
+	redirects := []string{}
+	staticRoutes := []string{}
+	routeHealthChecks := map[string]string{}
 	natsServers := ""
 	isVerbose := false
+	configFile := ""
+	fs.StringVar(&configFile, "config", "", "JSON file with RouterParams. Command line flags override the file values")
 	fs.StringVar(&natsServers, "ns", "", "The nats server URLs (separated by comma)")
 	fs.IntVar(&rp.Port, "p", DefaultRouterPort, "Server port")
 	fs.IntVar(&rp.WriteTimeout, "wt", DefaultRouterWriteTimeout, "Write timeout in seconds")
 	fs.IntVar(&rp.ReadTimeout, "rt", DefaultRouterReadTimeout, "Read timeout in seconds")
 	fs.IntVar(&rp.ConnectionsLimit, "cl", DefaultRouterConnectionsLimit, "Limit of incoming connections")
 	fs.BoolVar(&rp.Verbose, "v", false, "verbose, log raw NATS traffic")
+	fs.IntVar(&rp.IdempotencyKeyTTL, "ikttl", 0, "Idempotency-Key responses time-to-live in seconds, 0 (default) -> Idempotency-Key header is ignored")
 
 	// actual for airs-bp3 only
-	fs.StringSliceVar(&routes, "rht", []string{}, "reverse proxy </url-part-after-ip>=<target> mapping")
-	fs.StringSliceVar(&routesRewrite, "rhtr", []string{}, "reverse proxy </url-part-after-ip>=<target> rewriting mapping")
+	fs.StringSliceVar(&routes, "rht", []string{}, "reverse proxy </url-part-after-ip>=<target>[;<target>...] mapping")
+	fs.StringSliceVar(&routesRewrite, "rhtr", []string{}, "reverse proxy </url-part-after-ip>=<target>[;<target>...] rewriting mapping")
 	fs.StringSliceVar(&rp.HTTP01ChallengeHosts, "rch", []string{}, "HTTP-01 Challenge host for let's encrypt service. Must be specified if router-port is 443, ignored otherwise")
+	fs.StringSliceVar(&routeDomains, "route-domain", []string{}, "reverse proxy <host>=<target>[;<target>...] mapping, host is exact, *.<suffix> or ~<regex>, target may contain {1} or {<group name>}, e.g. \"*.dev.untill.ru=http://{1}.internal:8080\"")
+	fs.StringArrayVar(&redirects, "redirect", []string{}, "redirect [<host>][<path prefix>]=[<status> ]<location>, e.g. \"www.untill.ru=301 https://untill.ru{path}{query}\". Location may contain {scheme}, {host}, {path}, {rest}, {query} and the host groups")
+	fs.StringArrayVar(&staticRoutes, "static", []string{}, "static files route <route prefix or host>=<dir>, e.g. \"/app=/var/www/app\". SPA fallback and Cache-Control are specified in the config file")
+	fs.IntVar(&rp.HTTPSRedirectStatus, "https-redirect-status", 0, "http -> https redirect status of the port 80 server: 301, 302, 307 or 308. 0 -> 302")
 	fs.StringVar(&rp.RouteDefault, "rhtd", "", "url to be redirected to if url is unknown")
+	fs.StringToStringVar(&rp.RouteBalancing, "route-balancing", nil, "reverse proxy route targets balancing <route>=<round-robin|least-conn|hash-ip|hash-header:<name>|hash-cookie:<name>>, e.g. \"/grafana=least-conn\"")
+	fs.StringToStringVar(&routeHealthChecks, "route-health-check", nil, "reverse proxy route targets health check path <route>=<path>, e.g. \"/grafana=/api/health\". Other health check params are default or specified in the config file")
+	fs.StringSliceVar(&rp.TrustedProxies, "trusted-proxies", nil, "CIDRs or IPs of the proxies in front of the router, e.g. 10.0.0.0/8. Their X-Forwarded-For, X-Forwarded-Host, X-Forwarded-Proto are accepted")
 	fs.StringVar(&rp.CertDir, "rcd", ".", "SSL certificates dir")
 
+	fs.StringSliceVar(&rp.CORS.AllowedOrigins, "cors-origins", nil, "CORS allowed origins, wildcards are allowed: https://*.untill.com. Any origin if not specified")
+	fs.StringSliceVar(&rp.CORS.AllowedHeaders, "cors-headers", nil, "CORS allowed headers. "+DefaultCORSAllowedHeaders+" if not specified")
+	fs.StringSliceVar(&rp.CORS.ExposedHeaders, "cors-exposed-headers", nil, "CORS exposed headers")
+	fs.BoolVar(&rp.CORS.AllowCredentials, "cors-credentials", false, "CORS allow credentials (cookies), requires --cors-origins")
+	fs.IntVar(&rp.CORS.MaxAge, "cors-max-age", 0, "CORS preflight max age in seconds")
+	fs.StringToStringVar(&rp.CORS.RouteMethods, "cors-methods", nil, "route CORS methods <route name>=<methods separated by spaces>, must be allowed by the route, e.g. \"blob read=GET\". All route methods if not specified")
+
+	fs.IntVar(&rp.SecurityHeaders.HSTSMaxAge, "sh-hsts-max-age", DefaultHSTSMaxAge, "Strict-Transport-Security max-age in seconds, sent over HTTPS only. Negative -> not sent")
+	fs.BoolVar(&rp.SecurityHeaders.HSTSIncludeSubDomains, "sh-hsts-subdomains", false, "Strict-Transport-Security includeSubDomains")
+	fs.StringVar(&rp.SecurityHeaders.Default.FrameOptions, "sh-frame-options", DefaultFrameOptions, "X-Frame-Options for all routes")
+	fs.StringVar(&rp.SecurityHeaders.Default.ReferrerPolicy, "sh-referrer-policy", DefaultReferrerPolicy, "Referrer-Policy for all routes")
+	fs.StringVar(&rp.SecurityHeaders.Default.ContentSecurityPolicy, "sh-csp", "", "Content-Security-Policy for all routes")
+	fs.StringVar(&rp.SecurityHeaders.Default.PermissionsPolicy, "sh-permissions-policy", "", "Permissions-Policy for all routes")
+	fs.BoolVar(&rp.EdgeAuth, "edge-auth", false, "validate principal tokens by the router before sending requests to the bus")
+	fs.StringVar(&rp.AppKeysResource, "edge-auth-keys-resource", "", "query function that returns the app principal token keys as JWKS, must be declared by each app. Edge auth is disabled if not specified")
+	fs.StringVar(&rp.N10NAuthResource, "n10n-auth-resource", "", "query function executed in each workspace of the n10n projections to check the principal access, must be declared by each app. Access is not checked if not specified")
+	fs.IntVar(&rp.N10NResumeTimeout, "n10n-resume-timeout", DefaultN10NResumeTimeout, "seconds the n10n channel is kept after SSE client disconnect to be resumed by Last-Event-ID, 0 -> closed on disconnect")
+	fs.IntVar(&rp.SSERetry, "sse-retry", DefaultSSERetry, "SSE client reconnection time, milliseconds. 0 -> not sent")
+	fs.IntVar(&rp.SSEHeartbeatInterval, "sse-heartbeat-interval", DefaultSSEHeartbeatInterval, "seconds between SSE heartbeats, 0 -> no heartbeats")
+	fs.BoolVar(&rp.SSEHeartbeatEvent, "sse-heartbeat-event", false, "send SSE heartbeat as `event: heartbeat` instead of the comment")
+	fs.IntVar(&rp.N10NChannelTTL, "n10n-channel-ttl", DefaultN10NChannelTTL, "n10n channel lifetime, seconds")
+	fs.StringToIntVar(&rp.N10NChannelTTLByApp, "n10n-channel-ttl-app", nil, "n10n channel lifetime per app, seconds, e.g. untill/airs-bp=3600")
+	fs.IntVar(&rp.N10NMaxChannelsPerSubject, "n10n-max-channels-per-subject", 0, "max n10n channels per subject, 0 -> unlimited")
+	fs.IntVar(&rp.N10NMaxProjectionsPerChannel, "n10n-max-projections-per-channel", 0, "max projections per n10n channel, 0 -> unlimited")
+	fs.IntVar(&rp.N10NCoalesceWindow, "n10n-coalesce-window", 0, "milliseconds during which n10n updates are coalesced to the latest offset per projection, 0 -> no delay")
+	fs.StringVar(&rp.AdminAddress, "admin-address", "", "internal listener address for admin endpoints, e.g. 127.0.0.1:8081. No admin listener if not specified")
+	fs.StringVar(&rp.N10NUpdateSecret, "n10n-update-secret", "", "shared secret required by /n10n/update of the admin listener, must be specified if the admin address is not loopback")
+	fs.StringToStringVar(&rp.AuthPolicies, "auth-policy", nil, "route auth policy <route name>=<required|optional|forbidden>, e.g. \"api=required\"")
+	fs.BoolVar(&rp.SecurityHeaders.ProxyOverride, "sh-proxy-override", false, "security headers replace the values returned by reverse proxy upstreams")
+
+	// config file values are applied over defaults, then explicitly specified flags are applied over config file values
+	fsConfig := flag.NewFlagSet("", flag.ContinueOnError)
+	fsConfig.ParseErrorsWhitelist.UnknownFlags = true
+	fsConfig.Usage = func() {}
+	fsConfig.StringVar(&configFile, "config", "", "")
+	_ = fsConfig.Parse(os.Args[1:]) // unknown flags and help are handled by the main flag set
+	if len(configFile) > 0 {
+		if err := loadRouterParamsFromFile(configFile, &rp); err != nil {
+			panic(err)
+		}
+	}
+
 	_ = fs.Parse(os.Args[1:]) // os.Exit on error
 	if len(natsServers) > 0 {
 		_ = rp.NATSServers.Set(natsServers) // error impossible
 	}
+	if len(routes) > 0 && rp.Routes == nil {
+		rp.Routes = map[string]string{}
+	}
 	if err := coreutils.PairsToMap(routes, rp.Routes); err != nil {
 		panic(err)
 	}
+	if len(routesRewrite) > 0 && rp.RoutesRewrite == nil {
+		rp.RoutesRewrite = map[string]string{}
+	}
 	if err := coreutils.PairsToMap(routesRewrite, rp.RoutesRewrite); err != nil {
 		panic(err)
 	}
+	if len(routeDomains) > 0 && rp.RouteDomains == nil {
+		rp.RouteDomains = map[string]string{}
+	}
+	if err := coreutils.PairsToMap(routeDomains, rp.RouteDomains); err != nil {
+		panic(err)
+	}
+	for _, redirect := range redirects {
+		// location may contain "="
+		from, to, ok := strings.Cut(redirect, "=")
+		if !ok {
+			panic("wrong redirect value: " + redirect)
+		}
+		if rp.Redirects == nil {
+			rp.Redirects = map[string]string{}
+		}
+		rp.Redirects[from] = to
+	}
+	for _, staticRoute := range staticRoutes {
+		routeKey, dir, ok := strings.Cut(staticRoute, "=")
+		if !ok {
+			panic("wrong static route value: " + staticRoute)
+		}
+		if rp.StaticRoutes == nil {
+			rp.StaticRoutes = map[string]StaticRouteParams{}
+		}
+		static := rp.StaticRoutes[routeKey]
+		static.Dir = dir
+		rp.StaticRoutes[routeKey] = static
+	}
+	for routeKey, path := range routeHealthChecks {
+		if rp.RouteHealthChecks == nil {
+			rp.RouteHealthChecks = map[string]HealthCheckParams{}
+		}
+		healthCheck := rp.RouteHealthChecks[routeKey]
+		healthCheck.Path = path
+		rp.RouteHealthChecks[routeKey] = healthCheck
+	}
 	if isVerbose {
 		logger.SetLogLevel(logger.LogLevelVerbose)
 	}
 	return rp
 }
 
+func loadRouterParamsFromFile(fileName string, rp *RouterParams) error {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return fmt.Errorf("failed to read router config file: %w", err)
+	}
+	if err := json.Unmarshal(data, rp); err != nil {
+		return fmt.Errorf("failed to parse router config file %s: %w", fileName, err)
+	}
+	return nil
+}
+
 func (s *httpsService) Prepare(work interface{}) error {
 	if err := s.httpService.Prepare(work); err != nil {
 		return err
@@ -151,6 +300,9 @@ func (s *httpsService) Prepare(work interface{}) error {
 }
 
 func (s *httpsService) Run(ctx context.Context) {
+	s.ctx = ctx
+	s.runAdmin(ctx)
+	s.runHealthChecks(ctx)
 	log.Printf("Starting HTTPS server on %s\n", s.server.Addr)
 	logger.Info("HTTPS server Write Timeout: ", s.server.WriteTimeout)
 	logger.Info("HTTPS server Read Timeout: ", s.server.ReadTimeout)
@@ -162,17 +314,32 @@ func (s *httpsService) Run(ctx context.Context) {
 // pipeline.IService
 func (s *httpService) Prepare(work interface{}) (err error) {
 	s.router = mux.NewRouter()
+	s.stopping = make(chan struct{})
 
 	// https://dev.untill.com/projects/#!627072
 	s.router.SkipClean(true)
 
+	if s.trustedProxies, err = parseTrustedProxies(s.TrustedProxies); err != nil {
+		return err
+	}
+	if s.HTTPSRedirectStatus != 0 && !isRedirectStatus(s.HTTPSRedirectStatus) {
+		return fmt.Errorf("https redirect status %d is not 301, 302, 307 or 308", s.HTTPSRedirectStatus)
+	}
+
 	if err = s.registerHandlers(s.busTimeout, s.appsWSAmount); err != nil {
 		return err
 	}
 
+	if err = s.prepareAdmin(); err != nil {
+		return err
+	}
+
 	port := strconv.Itoa(s.RouterParams.Port)
 
 	if s.listener, err = net.Listen("tcp", ":"+port); err != nil {
+		if s.admin.listener != nil {
+			s.admin.listener.Close()
+		}
 		return err
 	}
 
@@ -182,7 +349,7 @@ func (s *httpService) Prepare(work interface{}) (err error) {
 
 	s.server = &http.Server{
 		Addr:         ":" + port,
-		Handler:      s.router,
+		Handler:      s.clientHandler(s.router),
 		ReadTimeout:  time.Duration(s.RouterParams.ReadTimeout) * time.Second,
 		WriteTimeout: time.Duration(s.RouterParams.WriteTimeout) * time.Second,
 	}
@@ -195,6 +362,9 @@ func (s *httpService) Run(ctx context.Context) {
 	s.server.BaseContext = func(l net.Listener) context.Context {
 		return ctx // need to track both client disconnect and app finalize
 	}
+	s.ctx = ctx
+	s.runAdmin(ctx)
+	s.runHealthChecks(ctx)
 	logger.Info("Starting HTTP server on", s.listener.Addr().(*net.TCPAddr).String())
 	if err := s.server.Serve(s.listener); err != http.ErrServerClosed {
 		log.Println("main HTTP server failure: " + err.Error())
@@ -203,6 +373,8 @@ func (s *httpService) Run(ctx context.Context) {
 
 // pipeline.IService
 func (s *httpService) Stop() {
+	// SSE clients are notified and disconnected
+	close(s.stopping)
 	// ctx here is used to avoid eternal waiting for close idle connections and listeners
 	// all connections and listeners are closed in the explicit way (they're tracks ctx.Done()) so it is not necessary to track ctx here
 	if err := s.server.Shutdown(context.Background()); err != nil {
@@ -210,6 +382,9 @@ func (s *httpService) Stop() {
 		s.listener.Close()
 		s.server.Close()
 	}
+	s.stopAdmin()
+	// detached channels are waiting for resume, websocket connections are hijacked
+	s.n10nChannels.closeAll()
 	if s.n10n != nil {
 		for s.n10n.MetricNumSubcriptions() > 0 {
 			time.Sleep(subscriptionsCloseCheckInterval)
@@ -227,34 +402,73 @@ func (s *httpService) registerHandlers(busTimeout time.Duration, appsWSAmount ma
 	if err != nil {
 		return err
 	}
-	s.router.HandleFunc("/api/check", corsHandler(checkHandler())).Methods("POST", "OPTIONS").Name("router check")
-	s.router.HandleFunc("/api", corsHandler(queueNamesHandler())).Name("queues names")
+	if s.cors, err = newCORSPolicy(s.CORS); err != nil {
+		return err
+	}
+	var corsErr error
+	corsHandler := func(routeName string, h http.Handler, methods ...string) http.HandlerFunc {
+		methods, err := s.cors.routeMethodsOf(routeName, methods)
+		if err != nil && corsErr == nil {
+			corsErr = err
+		}
+		return s.cors.handler(h, methods...)
+	}
+	for routeName := range s.AuthPolicies {
+		if _, err := s.routeAuthPolicy(routeName, authPolicyOptional); err != nil {
+			return err
+		}
+	}
+	authHandler := func(routeName string, defaultPolicy authPolicy, h http.Handler) http.Handler {
+		policy, _ := s.routeAuthPolicy(routeName, defaultPolicy) // checked already
+		// browser navigation, EventSource and WebSocket can not send headers
+		eventStream := routeName == routeNameN10NChannel || routeName == routeNameN10NWebSocket
+		var cookieTokenMethods []string
+		switch {
+		case eventStream:
+			cookieTokenMethods = []string{http.MethodGet}
+		case routeName == routeNameBLOBRead:
+			// POST blob read is a read as well and browser clients send it with the cookie
+			cookieTokenMethods = []string{http.MethodGet, http.MethodPost}
+		}
+		return s.authHandler(h, policy, cookieTokenMethods, eventStream)
+	}
+	s.router.Use(newSecurityHeadersPolicy(s.SecurityHeaders).middleware)
+	s.router.HandleFunc("/api/check", corsHandler(routeNameRouterCheck, checkHandler(), "POST")).Methods("POST", "OPTIONS").Name(routeNameRouterCheck)
+	s.router.HandleFunc("/api", corsHandler(routeNameQueuesNames, queueNamesHandler())).Name(routeNameQueuesNames)
 	/*
 		launching app from localhost from browser. Trying to execute POST from web app within browser.
 		Browser sees that hosts differs: from localhost to alpha -> need CORS -> denies POST and executes the same request with OPTIONS header
 		-> need to allow OPTIONS
 	*/
 	if s.BlobberParams != nil {
-		s.router.Handle(fmt.Sprintf("/blob/{%s}/{%s}/{%s:[0-9]+}", bp3AppOwner, bp3AppName, wSIDVar), corsHandler(s.blobWriteRequestHandler())).
+		s.router.Handle(fmt.Sprintf("/blob/{%s}/{%s}/{%s:[0-9]+}", bp3AppOwner, bp3AppName, wSIDVar), corsHandler(routeNameBLOBWrite, authHandler(routeNameBLOBWrite, authPolicyRequired, s.blobWriteRequestHandler()), "POST")).
 			Methods("POST", "OPTIONS").
-			Name("blob write")
-		s.router.Handle(fmt.Sprintf("/blob/{%s}/{%s}/{%s:[0-9]+}/{%s:[0-9]+}", bp3AppOwner, bp3AppName, wSIDVar, bp3BLOBID), corsHandler(s.blobReadRequestHandler())).
+			Name(routeNameBLOBWrite)
+		s.router.Handle(fmt.Sprintf("/blob/{%s}/{%s}/{%s:[0-9]+}/{%s:[0-9]+}", bp3AppOwner, bp3AppName, wSIDVar, bp3BLOBID), corsHandler(routeNameBLOBRead, authHandler(routeNameBLOBRead, authPolicyRequired, s.blobReadRequestHandler()), "POST", "GET")).
 			Methods("POST", "GET", "OPTIONS").
-			Name("blob read")
+			Name(routeNameBLOBRead)
+	}
+	var apiHandler http.Handler = partitionHandler(s.queues, s.bus, busTimeout, appsWSAmount)
+	if s.IdempotencyKeyTTL > 0 {
+		apiHandler = idempotencyHandler(s.IdempotencyStore, time.Duration(s.IdempotencyKeyTTL)*time.Second, apiHandler)
 	}
+	apiHandler = authHandler(routeNameAPI, authPolicyOptional, apiHandler)
 	if s.RouterParams.UseBP3 {
 		s.router.HandleFunc(fmt.Sprintf("/api/{%s}/{%s}/{%s:[0-9]+}/{%s:[a-zA-Z_/.]+}", bp3AppOwner, bp3AppName,
-			wSIDVar, resourceNameVar), corsHandler(partitionHandler(s.queues, s.bus, busTimeout, appsWSAmount))).
-			Methods("POST", "PATCH", "OPTIONS").Name("api")
+			wSIDVar, resourceNameVar), corsHandler(routeNameAPI, apiHandler, "POST", "PATCH")).
+			Methods("POST", "PATCH", "OPTIONS").Name(routeNameAPI)
 	} else {
 		s.router.HandleFunc(fmt.Sprintf("/api/{%s}/{%s:[0-9]+}/{%s:[a-zA-Z_/.]+}", queueAliasVar,
-			wSIDVar, resourceNameVar), corsHandler(partitionHandler(s.queues, s.bus, busTimeout, appsWSAmount))).
-			Methods("POST", "PATCH", "OPTIONS").Name("api")
+			wSIDVar, resourceNameVar), corsHandler(routeNameAPI, apiHandler, "POST", "PATCH")).
+			Methods("POST", "PATCH", "OPTIONS").Name(routeNameAPI)
 	}
-	s.router.Handle("/n10n/channel", corsHandler(s.subscribeAndWatchHandler())).Methods("GET")
-	s.router.Handle("/n10n/subscribe", corsHandler(s.subscribeHandler())).Methods("GET")
-	s.router.Handle("/n10n/unsubscribe", corsHandler(s.unSubscribeHandler())).Methods("GET")
-	s.router.Handle("/n10n/update/{offset:[0-9]{1,10}}", corsHandler(s.updateHandler()))
+	s.router.Handle("/n10n/channel", corsHandler(routeNameN10NChannel, authHandler(routeNameN10NChannel, authPolicyRequired, s.subscribeAndWatchHandler()), "GET", "POST")).Methods("GET", "POST", "OPTIONS").Name(routeNameN10NChannel)
+	s.router.Handle("/n10n/subscribe", corsHandler(routeNameN10NSubscribe, authHandler(routeNameN10NSubscribe, authPolicyRequired, s.subscribeHandler()), "GET", "POST")).Methods("GET", "POST", "OPTIONS").Name(routeNameN10NSubscribe)
+	s.router.Handle("/n10n/unsubscribe", corsHandler(routeNameN10NUnsubscribe, authHandler(routeNameN10NUnsubscribe, authPolicyRequired, s.unSubscribeHandler()), "GET", "POST")).Methods("GET", "POST", "OPTIONS").Name(routeNameN10NUnsubscribe)
+	s.router.Handle("/n10n/poll/channel", corsHandler(routeNameN10NPollChannel, authHandler(routeNameN10NPollChannel, authPolicyRequired, s.pollChannelHandler()), "GET", "POST")).Methods("GET", "POST", "OPTIONS").Name(routeNameN10NPollChannel)
+	s.router.Handle("/n10n/poll", corsHandler(routeNameN10NPoll, authHandler(routeNameN10NPoll, authPolicyRequired, s.pollHandler()), "GET")).Methods("GET", "OPTIONS").Name(routeNameN10NPoll)
+	// origin is checked on handshake
+	s.router.Handle("/n10n/ws", authHandler(routeNameN10NWebSocket, authPolicyRequired, s.wsHandler())).Methods("GET").Name(routeNameN10NWebSocket)
 
 	// pprof profile
 	s.router.Handle("/debug/pprof", http.HandlerFunc(pprof.Index))
@@ -269,8 +483,8 @@ func (s *httpService) registerHandlers(busTimeout time.Duration, appsWSAmount ma
 	})) // must be the last
 
 	// must be the last handler
-	s.router.MatcherFunc(redirectMatcher).Name("reverse proxy")
-	return nil
+	s.router.MatcherFunc(redirectMatcher).Name(routeNameReverseProxy)
+	return corsErr
 }
 
 // pipeline.IService
@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+
+	"github.com/untillpro/goutils/logger"
+)
+
+func newProxyErrorPage(route string, params ProxyErrorParams) (page *proxyErrorPage, err error) {
+	page = &proxyErrorPage{
+		route:       route,
+		on:          map[proxyErrorKind]bool{},
+		body:        []byte(params.Body),
+		contentType: params.ContentType,
+		redirect:    params.Redirect,
+	}
+	for _, kind := range params.On {
+		switch proxyErrorKind(kind) {
+		case proxyErrorConnection, proxyErrorTimeout, proxyError5xx:
+			page.on[proxyErrorKind(kind)] = true
+		default:
+			return nil, fmt.Errorf("unknown proxy error kind %s", kind)
+		}
+	}
+	if len(params.File) > 0 {
+		if len(params.Body) > 0 {
+			return nil, errors.New("both File and Body of the proxy error page are specified")
+		}
+		if page.body, err = os.ReadFile(params.File); err != nil {
+			return nil, fmt.Errorf("failed to read proxy error page: %w", err)
+		}
+	}
+	if len(page.contentType) == 0 {
+		page.contentType = defaultProxyErrorContentType
+	}
+	if len(params.Fallback) > 0 {
+		if page.fallback, err = parseURL(params.Fallback); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// upstream failures are logged with the route and the target
+// page != nil -> failures are handled by the page. transport == nil -> http.DefaultTransport. headers == nil -> proxied as is
+func newRouteProxy(route string, page *proxyErrorPage, transport http.RoundTripper, headers *proxyHeaders) *httputil.ReverseProxy {
+	// target is set by redirectMatcher
+	director := func(r *http.Request) {
+		setForwardedHeaders(r)
+		if headers != nil {
+			headers.modifyRequest(r)
+		}
+	}
+	modifyResponse := func(resp *http.Response) error {
+		if page != nil {
+			if err := page.modifyResponse(resp); err != nil {
+				return err
+			}
+		}
+		if headers != nil {
+			headers.modifyResponse(resp)
+		}
+		return nil
+	}
+	proxy := &httputil.ReverseProxy{Director: director, Transport: transport, ModifyResponse: modifyResponse}
+	var fallbackProxy *httputil.ReverseProxy
+	if page != nil && page.fallback != nil {
+		fallbackProxy = &httputil.ReverseProxy{Director: director, Transport: transport, ModifyResponse: modifyResponse}
+		fallbackProxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+			logProxyError(route+" fallback", req, err)
+			page.write(rw, req, err)
+		}
+	}
+	proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+		logProxyError(route, req, err)
+		if page == nil || !page.handles(err) {
+			rw.WriteHeader(proxyErrorStatus(err))
+			return
+		}
+		if inbound, ok := inboundFromRequest(req); ok && fallbackProxy != nil && (inbound.Body == nil || inbound.Body == http.NoBody) {
+			// request body is consumed already -> not retried
+			// req is directed already -> the inbound one is proxied, otherwise forwarded and header rules are applied twice
+			fallbackReq := inbound.Clone(inbound.Context())
+			redirect(fallbackReq, fallbackReq.URL.Path, page.fallback)
+			fallbackProxy.ServeHTTP(rw, fallbackReq)
+			return
+		}
+		page.write(rw, req, err)
+	}
+	return proxy
+}
+
+func logProxyError(route string, req *http.Request, err error) {
+	if errors.Is(err, context.Canceled) {
+		if logger.IsVerbose() {
+			logger.Verbose("reverse proxy route ", route, " target ", req.URL.Host, ": client ", clientIPFromRequest(req), " disconnected")
+		}
+		return
+	}
+	logger.Error("reverse proxy route ", route, " target ", req.URL.Host, " client ", clientIPFromRequest(req), " failed: ", err)
+}
+
+func (page *proxyErrorPage) modifyResponse(resp *http.Response) error {
+	if resp.StatusCode >= http.StatusInternalServerError && page.isOn(proxyError5xx) {
+		return &upstreamStatusError{status: resp.StatusCode}
+	}
+	return nil
+}
+
+func (page *proxyErrorPage) handles(err error) bool {
+	return !errors.Is(err, context.Canceled) && page.isOn(proxyErrorKindOf(err))
+}
+
+func (page *proxyErrorPage) isOn(kind proxyErrorKind) bool {
+	return len(page.on) == 0 || page.on[kind]
+}
+
+func (page *proxyErrorPage) write(rw http.ResponseWriter, req *http.Request, err error) {
+	if len(page.redirect) > 0 {
+		http.Redirect(rw, req, page.redirect, http.StatusFound)
+		return
+	}
+	rw.Header().Set("Content-Type", page.contentType)
+	rw.WriteHeader(proxyErrorStatus(err))
+	_, _ = rw.Write(page.body)
+}
+
+func proxyErrorKindOf(err error) proxyErrorKind {
+	var statusErr *upstreamStatusError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &statusErr):
+		return proxyError5xx
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return proxyErrorTimeout
+	}
+	return proxyErrorConnection
+}
+
+// connection -> 502, timeout -> 504, 5xx -> the upstream status
+func proxyErrorStatus(err error) int {
+	var statusErr *upstreamStatusError
+	switch {
+	case errors.As(err, &statusErr):
+		return statusErr.status
+	case proxyErrorKindOf(err) == proxyErrorTimeout:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("upstream responded %d", e.status)
+}
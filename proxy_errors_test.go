@@ -0,0 +1,181 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+type testTimeoutError struct{}
+
+func (testTimeoutError) Error() string   { return "i/o timeout" }
+func (testTimeoutError) Timeout() bool   { return true }
+func (testTimeoutError) Temporary() bool { return true }
+
+func TestProxyErrorPages(t *testing.T) {
+	require := require.New(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/failing") {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = rw.Write([]byte("upstream " + req.URL.Path))
+	}))
+	defer upstream.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	errorFile := filepath.Join(t.TempDir(), "error.html")
+	require.NoError(os.WriteFile(errorFile, []byte("<h1>maintenance</h1>"), 0600))
+	s := &httpService{RouterParams: RouterParams{
+		Routes: map[string]string{
+			"/inline":   down.URL,
+			"/failing":  upstream.URL,
+			"/redirect": down.URL,
+			"/fallback": down.URL,
+			"/plain":    down.URL,
+			"/timeout":  down.URL,
+		},
+		RouteErrorPages: map[string]ProxyErrorParams{
+			"/inline":   {On: []string{"connection"}, Body: "service is unavailable", ContentType: "text/plain"},
+			"/failing":  {On: []string{"5xx"}, File: errorFile},
+			"/redirect": {Redirect: "https://status.untill.com"},
+			"/fallback": {Body: "fallback failed", Fallback: upstream.URL},
+			"/timeout":  {On: []string{"timeout"}, Body: "timeout"},
+		},
+	}}
+	redirectMatcher, err := s.getRedirectMatcher()
+	require.NoError(err)
+	router := mux.NewRouter()
+	router.MatcherFunc(redirectMatcher)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }}
+	send := func(method string, path string, body io.Reader) (*http.Response, string) {
+		req, err := http.NewRequest(method, server.URL+path, body)
+		require.NoError(err)
+		resp, err := client.Do(req)
+		require.NoError(err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(err)
+		return resp, string(data)
+	}
+
+	resp, body := send(http.MethodGet, "/inline/foo", nil)
+	require.Equal(http.StatusBadGateway, resp.StatusCode)
+	require.Equal("text/plain", resp.Header.Get("Content-Type"))
+	require.Equal("service is unavailable", body)
+
+	resp, body = send(http.MethodGet, "/failing/foo", nil)
+	require.Equal(http.StatusInternalServerError, resp.StatusCode)
+	require.Equal(defaultProxyErrorContentType, resp.Header.Get("Content-Type"))
+	require.Equal("<h1>maintenance</h1>", body)
+
+	resp, _ = send(http.MethodGet, "/redirect/foo", nil)
+	require.Equal(http.StatusFound, resp.StatusCode)
+	require.Equal("https://status.untill.com", resp.Header.Get("Location"))
+
+	resp, body = send(http.MethodGet, "/fallback/foo", nil)
+	require.Equal(http.StatusOK, resp.StatusCode)
+	require.Equal("upstream /fallback/foo", body)
+	// request body is consumed -> not retried
+	resp, body = send(http.MethodPost, "/fallback/foo", strings.NewReader("data"))
+	require.Equal(http.StatusBadGateway, resp.StatusCode)
+	require.Equal("fallback failed", body)
+
+	resp, body = send(http.MethodGet, "/plain/foo", nil)
+	require.Equal(http.StatusBadGateway, resp.StatusCode)
+	require.Empty(body)
+
+	// the page is for timeouts only
+	resp, body = send(http.MethodGet, "/timeout/foo", nil)
+	require.Equal(http.StatusBadGateway, resp.StatusCode)
+	require.Empty(body)
+
+	t.Run("error kinds", func(t *testing.T) {
+		require.Equal(proxyErrorTimeout, proxyErrorKindOf(testTimeoutError{}))
+		require.Equal(proxyErrorTimeout, proxyErrorKindOf(context.DeadlineExceeded))
+		require.Equal(http.StatusGatewayTimeout, proxyErrorStatus(testTimeoutError{}))
+		require.Equal(proxyErrorConnection, proxyErrorKindOf(errors.New("connection refused")))
+		require.Equal(http.StatusServiceUnavailable, proxyErrorStatus(&upstreamStatusError{status: http.StatusServiceUnavailable}))
+	})
+
+	t.Run("config errors", func(t *testing.T) {
+		for _, params := range []ProxyErrorParams{
+			{On: []string{"unknown"}},
+			{File: errorFile, Body: "body"},
+			{File: filepath.Join(t.TempDir(), "unknown.html")},
+		} {
+			_, err := newProxyErrorPage("/inline", params)
+			require.Error(err)
+		}
+		s := &httpService{RouterParams: RouterParams{RouteErrorPages: map[string]ProxyErrorParams{"/unknown": {Body: "body"}}}}
+		_, err := s.getRedirectMatcher()
+		require.Error(err)
+	})
+}
+
+func TestProxyFallbackHeaders(t *testing.T) {
+	require := require.New(t)
+	fallback := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(rw).Encode(req.Header)
+	}))
+	defer fallback.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	// X-Forwarded-For and Forwarded of the trusted peer are appended -> duplicates are visible
+	trustedProxies, err := parseTrustedProxies([]string{"127.0.0.1"})
+	require.NoError(err)
+	s := &httpService{trustedProxies: trustedProxies, RouterParams: RouterParams{
+		Routes: map[string]string{"/down": down.URL, "/failing": failing.URL},
+		RouteErrorPages: map[string]ProxyErrorParams{
+			"/down":    {Fallback: fallback.URL},
+			"/failing": {On: []string{"5xx"}, Fallback: fallback.URL},
+		},
+		RouteHeaders: map[string]ProxyHeadersParams{
+			"/down":    {Request: HeaderRules{Add: map[string]string{"X-Tag": "a"}}},
+			"/failing": {Request: HeaderRules{Add: map[string]string{"X-Tag": "a"}}},
+		},
+	}}
+	redirectMatcher, err := s.getRedirectMatcher()
+	require.NoError(err)
+	router := mux.NewRouter()
+	router.MatcherFunc(redirectMatcher)
+	server := httptest.NewServer(s.clientHandler(router))
+	defer server.Close()
+
+	// the outbound request of the failed target is directed already -> must not be directed again for the fallback
+	for _, path := range []string{"/down/foo", "/failing/foo"} {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, http.NoBody)
+		require.NoError(err)
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		req.Header.Set("Forwarded", "for=203.0.113.7")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(err)
+		proxied := http.Header{}
+		require.NoError(json.NewDecoder(resp.Body).Decode(&proxied))
+		resp.Body.Close()
+		require.Equal(http.StatusOK, resp.StatusCode, path)
+		require.Equal([]string{"a"}, proxied.Values("X-Tag"), path)
+		require.Equal("203.0.113.7, 127.0.0.1", proxied.Get("X-Forwarded-For"), path)
+		require.Equal([]string{`for=203.0.113.7, for=127.0.0.1;host="` + strings.TrimPrefix(server.URL, "http://") + `";proto=http`}, proxied.Values("Forwarded"), path)
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+func newProxyHeaders(params ProxyHeadersParams) (*proxyHeaders, error) {
+	for _, rules := range []HeaderRules{params.Request, params.Response} {
+		for _, values := range []map[string]string{rules.Set, rules.Add} {
+			for name, value := range values {
+				for _, placeholder := range placeholderRegexp.FindAllStringSubmatch(value, -1) {
+					switch placeholder[1] {
+					case headerVarClientIP, headerVarHost, headerVarPrefix:
+					default:
+						return nil, fmt.Errorf("header %s: unknown variable %s", name, placeholder[0])
+					}
+				}
+			}
+		}
+	}
+	return &proxyHeaders{request: params.Request, response: params.Response, preserveHost: params.PreserveHost}, nil
+}
+
+// called by ReverseProxy.Director
+func (h *proxyHeaders) modifyRequest(req *http.Request) {
+	if h.preserveHost {
+		req.Host = clientFromRequest(req).requestHost
+	}
+	vars, _ := req.Context().Value(proxyHeaderVarsKey).(proxyHeaderVars)
+	h.request.apply(req.Header, vars)
+}
+
+func (h *proxyHeaders) modifyResponse(resp *http.Response) {
+	vars, _ := resp.Request.Context().Value(proxyHeaderVarsKey).(proxyHeaderVars)
+	h.response.apply(resp.Header, vars)
+}
+
+func (rules *HeaderRules) apply(header http.Header, vars proxyHeaderVars) {
+	for _, name := range rules.Remove {
+		header.Del(name)
+	}
+	for name, value := range rules.Set {
+		header.Set(name, vars.expand(value))
+	}
+	for name, value := range rules.Add {
+		header.Add(name, vars.expand(value))
+	}
+}
+
+func (vars proxyHeaderVars) expand(value string) string {
+	return placeholderRegexp.ReplaceAllStringFunc(value, func(placeholder string) string {
+		switch placeholder[1 : len(placeholder)-1] {
+		case headerVarClientIP:
+			return vars.clientIP
+		case headerVarHost:
+			return vars.host
+		}
+		return vars.prefix // checked on start
+	})
+}
+
+// the connection peer, see clientIPFromRequest for the real client IP
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyHeaders(t *testing.T) {
+	require := require.New(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Server", "grafana")
+		rw.Header().Set("Cache-Control", "no-store")
+		_ = json.NewEncoder(rw).Encode(req.Header)
+	}))
+	defer upstream.Close()
+	s := &httpService{RouterParams: RouterParams{
+		Routes:        map[string]string{"/grafana": upstream.URL, "/plain": upstream.URL},
+		RoutesRewrite: map[string]string{"/portal": upstream.URL + "/rewritten"},
+		RouteDomains:  map[string]string{"portal.untill.ru": upstream.URL},
+		RouteHeaders: map[string]ProxyHeadersParams{
+			"/grafana": {
+				Request:  HeaderRules{Remove: []string{"Authorization"}, Set: map[string]string{"X-Real-IP": "{client_ip}"}},
+				Response: HeaderRules{Remove: []string{"Server"}, Set: map[string]string{"Cache-Control": "public, max-age=60"}, Add: map[string]string{"Vary": "Accept"}},
+			},
+			"/portal": {
+				Request: HeaderRules{Set: map[string]string{"X-Forwarded-Prefix": "{prefix}", "X-Original-Host": "{host}"}},
+			},
+			"portal.untill.ru": {
+				Request: HeaderRules{Add: map[string]string{"X-Portal": "{host}{prefix}"}},
+			},
+		},
+	}}
+	redirectMatcher, err := s.getRedirectMatcher()
+	require.NoError(err)
+	router := mux.NewRouter()
+	router.MatcherFunc(redirectMatcher)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	do := func(host string, path string) (resp *http.Response, proxied http.Header) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, http.NoBody)
+		require.NoError(err)
+		req.Header.Set("Authorization", "Bearer secret")
+		if len(host) > 0 {
+			req.Host = host
+		}
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(err)
+		defer resp.Body.Close()
+		require.NoError(json.NewDecoder(resp.Body).Decode(&proxied))
+		return resp, proxied
+	}
+
+	t.Run("remove and set", func(t *testing.T) {
+		resp, proxied := do("", "/grafana/foo")
+		require.Empty(proxied.Get("Authorization"))
+		require.Equal("127.0.0.1", proxied.Get("X-Real-IP"))
+		require.Empty(resp.Header.Get("Server"))
+		require.Equal("public, max-age=60", resp.Header.Get("Cache-Control"))
+		require.Equal([]string{"Accept"}, resp.Header.Values("Vary"))
+	})
+
+	t.Run("prefix and host of the client request", func(t *testing.T) {
+		_, proxied := do("alpha.untill.ru", "/portal/foo")
+		require.Equal("/portal", proxied.Get("X-Forwarded-Prefix"))
+		require.Equal("alpha.untill.ru", proxied.Get("X-Original-Host"))
+		_, proxied = do("portal.untill.ru", "/foo")
+		require.Equal("portal.untill.ru", proxied.Get("X-Portal"))
+	})
+
+	t.Run("route without headers is proxied as is", func(t *testing.T) {
+		resp, proxied := do("", "/plain/foo")
+		require.Equal("Bearer secret", proxied.Get("Authorization"))
+		require.Equal("grafana", resp.Header.Get("Server"))
+	})
+
+	t.Run("wrong config", func(t *testing.T) {
+		for name, rp := range map[string]RouterParams{
+			"unknown route": {RouteHeaders: map[string]ProxyHeadersParams{"/grafana": {}}},
+			"unknown variable": {
+				Routes:       map[string]string{"/grafana": upstream.URL},
+				RouteHeaders: map[string]ProxyHeadersParams{"/grafana": {Request: HeaderRules{Set: map[string]string{"X-User": "{user}"}}}},
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				_, err := (&httpService{RouterParams: rp}).getRedirectMatcher()
+				require.Error(err)
+			})
+		}
+	})
+}
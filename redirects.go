@@ -0,0 +1,176 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/untillpro/goutils/logger"
+)
+
+// www.untill.ru=301 https://untill.ru{path}{query}
+// /old-portal=308 {scheme}://{host}/portal{rest}{query}
+// *.untill.ru/docs=https://docs.untill.ru/{1}{rest}
+// sorted by the host: exact, wildcards by the longest suffix, regexes, any. Then by the longest path prefix
+func (s *httpService) parseRedirects() (rules []*redirectRule, err error) {
+	for from, to := range s.Redirects {
+		rule, err := newRedirectRule(from, to)
+		if err != nil {
+			return nil, fmt.Errorf("redirect %s: %w", from, err)
+		}
+		rules = append(rules, rule)
+		logger.Info("redirect registered: ", from, " -> ", to)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		ri, rj := rules[i], rules[j]
+		if ri.hostRank != rj.hostRank {
+			return ri.hostRank < rj.hostRank
+		}
+		if ri.hostRank == redirectHostWildcard && len(ri.host) != len(rj.host) {
+			return len(ri.host) > len(rj.host)
+		}
+		if len(ri.pathPrefix) != len(rj.pathPrefix) {
+			return len(ri.pathPrefix) > len(rj.pathPrefix)
+		}
+		return ri.from < rj.from
+	})
+	return rules, nil
+}
+
+// from: [<host>][<path prefix>], to: [<status> ]<location>
+func newRedirectRule(from string, to string) (rule *redirectRule, err error) {
+	rule = &redirectRule{from: from, status: DefaultRedirectStatus, location: strings.TrimSpace(to)}
+	if statusStr, location, ok := strings.Cut(rule.location, " "); ok {
+		if rule.status, err = strconv.Atoi(statusStr); err != nil {
+			return nil, fmt.Errorf("status %s is malformed", statusStr)
+		}
+		rule.location = strings.TrimSpace(location)
+	}
+	if !isRedirectStatus(rule.status) {
+		return nil, fmt.Errorf("status %d is not 301, 302, 307 or 308", rule.status)
+	}
+	if len(rule.location) == 0 {
+		return nil, errors.New("location is missing")
+	}
+	rule.host = from
+	if slashPos := strings.Index(from, "/"); slashPos >= 0 {
+		rule.host = from[:slashPos]
+		rule.pathPrefix = strings.TrimSuffix(from[slashPos:], "/")
+		if len(rule.pathPrefix) == 0 && len(rule.host) == 0 {
+			return nil, errors.New("host or path prefix is missing")
+		}
+	}
+	var wildcard bool
+	if rule.hostRe, wildcard, err = compileHostPattern(rule.host); err != nil {
+		return nil, fmt.Errorf("host %s: %w", rule.host, err)
+	}
+	switch {
+	case len(rule.host) == 0:
+		rule.hostRank = redirectHostAny
+	case wildcard:
+		rule.hostRank = redirectHostWildcard
+	case rule.hostRe != nil:
+		rule.hostRank = redirectHostRegex
+	}
+	for _, placeholder := range placeholderRegexp.FindAllStringSubmatch(rule.location, -1) {
+		name := placeholder[1]
+		switch name {
+		case redirectVarScheme, redirectVarHost, redirectVarPath, redirectVarRest, redirectVarQuery:
+			continue
+		}
+		if rule.hostRe == nil {
+			return nil, fmt.Errorf("unknown variable %s", placeholder[0])
+		}
+		if n, err := strconv.Atoi(name); err == nil {
+			if n < 1 || n > rule.hostRe.NumSubexp() {
+				return nil, fmt.Errorf("no group %d for placeholder %s", n, placeholder[0])
+			}
+		} else if rule.hostRe.SubexpIndex(name) < 0 {
+			return nil, fmt.Errorf("no group named %s for placeholder %s", name, placeholder[0])
+		}
+	}
+	return rule, nil
+}
+
+// ok == false -> not matched
+func (rule *redirectRule) match(req *http.Request, hostNoPort string) (location string, ok bool) {
+	if len(rule.pathPrefix) > 0 && req.URL.Path != rule.pathPrefix && !strings.HasPrefix(req.URL.Path, rule.pathPrefix+"/") {
+		return "", false
+	}
+	var groups []string
+	switch {
+	case rule.hostRe != nil:
+		if groups = rule.hostRe.FindStringSubmatch(hostNoPort); groups == nil {
+			return "", false
+		}
+	case len(rule.host) > 0 && rule.host != hostNoPort:
+		return "", false
+	}
+	return rule.expand(req, hostNoPort, groups), true
+}
+
+func (rule *redirectRule) expand(req *http.Request, hostNoPort string, groups []string) string {
+	return placeholderRegexp.ReplaceAllStringFunc(rule.location, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		switch name {
+		case redirectVarScheme:
+			return clientFromRequest(req).proto
+		case redirectVarHost:
+			return hostNoPort
+		case redirectVarPath:
+			return req.URL.EscapedPath()
+		case redirectVarRest:
+			return strings.TrimPrefix(req.URL.EscapedPath(), rule.pathPrefix)
+		case redirectVarQuery:
+			if len(req.URL.RawQuery) == 0 {
+				return ""
+			}
+			return "?" + req.URL.RawQuery
+		}
+		if n, err := strconv.Atoi(name); err == nil {
+			return groups[n] // checked on start
+		}
+		return groups[rule.hostRe.SubexpIndex(name)]
+	})
+}
+
+func isRedirectStatus(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+func redirectHandler(location string, status int) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		http.Redirect(rw, req, location, status)
+	}
+}
+
+// fallback of the ACME port 80 server: http -> https
+// 301, 302 -> GET and HEAD only, the body of other methods would be lost
+func httpsRedirectHandler(status int) http.HandlerFunc {
+	if status == 0 {
+		status = http.StatusFound
+	}
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if (status == http.StatusMovedPermanently || status == http.StatusFound) && req.Method != http.MethodGet && req.Method != http.MethodHead {
+			writeTextResponse(rw, "Use HTTPS", http.StatusBadRequest)
+			return
+		}
+		host := req.Host
+		if hostNoPort, _, err := net.SplitHostPort(host); err == nil {
+			host = hostNoPort
+		}
+		http.Redirect(rw, req, "https://"+host+req.URL.RequestURI(), status)
+	}
+}
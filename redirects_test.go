@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedirects(t *testing.T) {
+	require := require.New(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("proxied"))
+	}))
+	defer upstream.Close()
+	s := &httpService{RouterParams: RouterParams{
+		Routes: map[string]string{"/grafana": upstream.URL, "/old-portal": upstream.URL},
+		Redirects: map[string]string{
+			"www.untill.ru":                          "https://untill.ru{path}{query}",
+			"/old-portal":                            "308 {scheme}://{host}/portal{rest}{query}",
+			"/old-portal/keep":                       "302 /kept",
+			"*.docs.untill.ru/guide":                 "307 https://docs.untill.ru/{1}{rest}",
+			"~(?P<lang>[a-z]{2})\\.untill\\.ru/help": "https://help.untill.ru/{lang}{rest}",
+		},
+	}}
+	redirectMatcher, err := s.getRedirectMatcher()
+	require.NoError(err)
+	router := mux.NewRouter()
+	router.MatcherFunc(redirectMatcher)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }}
+	do := func(host string, pathAndQuery string) (status int, location string) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+pathAndQuery, http.NoBody)
+		require.NoError(err)
+		req.Host = host
+		resp, err := client.Do(req)
+		require.NoError(err)
+		defer resp.Body.Close()
+		return resp.StatusCode, resp.Header.Get("Location")
+	}
+
+	t.Run("host canonicalization", func(t *testing.T) {
+		status, location := do("www.untill.ru", "/foo/bar?a=1&b=2")
+		require.Equal(http.StatusMovedPermanently, status)
+		require.Equal("https://untill.ru/foo/bar?a=1&b=2", location)
+	})
+
+	t.Run("legacy path", func(t *testing.T) {
+		status, location := do("alpha.untill.ru:8080", "/old-portal/foo?a=1")
+		require.Equal(http.StatusPermanentRedirect, status)
+		require.Equal("http://alpha.untill.ru/portal/foo?a=1", location)
+		status, location = do("alpha.untill.ru", "/old-portal/keep/foo")
+		require.Equal(http.StatusFound, status)
+		require.Equal("/kept", location)
+	})
+
+	t.Run("host groups", func(t *testing.T) {
+		status, location := do("v2.docs.untill.ru", "/guide/install")
+		require.Equal(http.StatusTemporaryRedirect, status)
+		require.Equal("https://docs.untill.ru/v2/install", location)
+		_, location = do("de.untill.ru", "/help/faq")
+		require.Equal("https://help.untill.ru/de/faq", location)
+	})
+
+	t.Run("no redirect -> proxied", func(t *testing.T) {
+		status, _ := do("alpha.untill.ru", "/old-portalfoo/x")
+		require.Equal(http.StatusNotFound, status)
+		status, _ = do("alpha.untill.ru", "/grafana/foo")
+		require.Equal(http.StatusOK, status)
+	})
+
+	t.Run("wrong config", func(t *testing.T) {
+		for name, redirects := range map[string]map[string]string{
+			"wrong status":         {"/old": "200 /new"},
+			"malformed status":     {"/old": "permanent /new"},
+			"no location":          {"/old": ""},
+			"no host and path":     {"/": "/new"},
+			"unknown variable":     {"/old": "/new{user}"},
+			"unknown group":        {"*.untill.ru": "https://{2}.untill.com"},
+			"group of exact host":  {"www.untill.ru": "https://{1}.untill.com"},
+			"wrong host pattern":   {"~(/old": "/new"},
+			"wildcard in the host": {"www.*.ru/old": "/new"},
+		} {
+			t.Run(name, func(t *testing.T) {
+				_, err := (&httpService{RouterParams: RouterParams{Redirects: redirects}}).getRedirectMatcher()
+				require.Error(err)
+			})
+		}
+	})
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	require := require.New(t)
+	do := func(status int, method string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		httpsRedirectHandler(status)(rw, httptest.NewRequest(method, "http://alpha.untill.ru:80/foo?a=1", http.NoBody))
+		return rw
+	}
+	rw := do(0, http.MethodGet)
+	require.Equal(http.StatusFound, rw.Code)
+	require.Equal("https://alpha.untill.ru/foo?a=1", rw.Header().Get("Location"))
+	require.Equal(http.StatusBadRequest, do(http.StatusMovedPermanently, http.MethodPost).Code)
+	rw = do(http.StatusPermanentRedirect, http.MethodPost)
+	require.Equal(http.StatusPermanentRedirect, rw.Code)
+	require.Equal("https://alpha.untill.ru/foo?a=1", rw.Header().Get("Location"))
+}
@@ -7,7 +7,6 @@ package router2
 import (
 	"fmt"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"strings"
 
@@ -16,17 +15,22 @@ import (
 	"github.com/valyala/bytebufferpool"
 )
 
-func parseRoutes(routesURLs map[string]route, routes map[string]string, isRewrite bool) error {
+func (s *httpService) parseRoutes(routesURLs map[string]route, routes map[string]string, isRewrite bool) error {
 	for from, to := range routes {
 		if !strings.HasPrefix(from, "/") {
 			return fmt.Errorf("%s reverse proxy url must have a leading slash", from)
 		}
-		targetURL, err := parseURL(to)
+		pool, err := s.newRoutePool(from, to)
 		if err != nil {
 			return err
 		}
+		for _, u := range pool.upstreams {
+			if len(u.template) > 0 {
+				return fmt.Errorf("route %s: target placeholders are allowed for the route domain patterns only", from)
+			}
+		}
 		routesURLs[from] = route{
-			targetURL,
+			pool,
 			isRewrite,
 			"",
 		}
@@ -40,15 +44,78 @@ func parseRoutes(routesURLs map[string]route, routes map[string]string, isRewrit
 // route rewrite: /grafana-rewrite=http://10.0.0.3:3000/rewritten : https://alpha.dev.untill.ru/grafana-rewrite/foo -> http://10.0.0.3:3000/rewritten/foo
 // default route: http://10.0.0.3:3000/not-found : https://alpha.dev.untill.ru/unknown/foo -> http://10.0.0.3:3000/not-found/unknown/foo
 // route domain : resellerportal.dev.untill.ru=http://resellerportal : https://resellerportal.dev.untill.ru/foo -> http://resellerportal/foo
+// domain wildcard: *.dev.untill.ru=http://{1}.internal:8080 : https://tenant1.dev.untill.ru/foo -> http://tenant1.internal:8080/foo
+// domain regex : ~(?P<sub>[a-z0-9-]+)\.untill\.ru=http://{sub}.internal:8080, see parseDomainRoutes
+// redirects   : www.untill.ru=301 https://untill.ru{path}{query}, evaluated first, see parseRedirects
+// static route : /app={"Dir": "/var/www/app", "SPAFallback": true} : https://alpha.dev.untill.ru/app/orders -> /var/www/app/index.html
+// route rules : host, path prefix, method and headers, evaluated by priority before the routes above, see RouteRule
+// targets pool : /grafana=http://10.0.0.3:3000;http://10.0.0.4:3000, the target is chosen by RouteBalancing of the route
 func (s *httpService) getRedirectMatcher() (redirectMatcher mux.MatcherFunc, err error) {
 	routes := map[string]route{}
-	reverseProxy := &httputil.ReverseProxy{Director: func(r *http.Request) {}} // director's job is done by redirectMatcher
-	if err := parseRoutes(routes, s.Routes, false); err != nil {
+	defaultProxy := newRouteProxy("default", nil, nil, nil)
+	s.upstreams = nil
+	if err := s.parseRoutes(routes, s.Routes, false); err != nil {
 		return nil, err
 	}
-	if err = parseRoutes(routes, s.RoutesRewrite, true); err != nil {
+	if err = s.parseRoutes(routes, s.RoutesRewrite, true); err != nil {
+		return nil, err
+	}
+	domainRoutes, err := s.parseDomainRoutes()
+	if err != nil {
 		return nil, err
 	}
+	rules, err := s.parseRouteRules()
+	if err != nil {
+		return nil, err
+	}
+	redirects, err := s.parseRedirects()
+	if err != nil {
+		return nil, err
+	}
+	statics, err := s.parseStaticRoutes()
+	if err != nil {
+		return nil, err
+	}
+	rootStatic := statics.prefixes[""]
+	if rootStatic != nil && len(s.RouteDefault) > 0 {
+		return nil, fmt.Errorf("both static route / and default route %s are specified", s.RouteDefault)
+	}
+	isKnownRoute := func(routeKey string) bool {
+		if _, ok := routes[routeKey]; ok || domainRoutes.isKnown(routeKey) {
+			return true
+		}
+		for _, rule := range rules {
+			if rule.Name == routeKey {
+				return true
+			}
+		}
+		return false
+	}
+	for routeKey := range s.RouteBalancing {
+		if !isKnownRoute(routeKey) {
+			return nil, fmt.Errorf("balancing is specified for unknown route %s", routeKey)
+		}
+	}
+	for routeKey := range s.RouteHealthChecks {
+		if !isKnownRoute(routeKey) {
+			return nil, fmt.Errorf("health check is specified for unknown route %s", routeKey)
+		}
+	}
+	for routeKey := range s.RouteErrorPages {
+		if !isKnownRoute(routeKey) {
+			return nil, fmt.Errorf("error page is specified for unknown route %s", routeKey)
+		}
+	}
+	for routeKey := range s.RouteTransports {
+		if !isKnownRoute(routeKey) {
+			return nil, fmt.Errorf("transport is specified for unknown route %s", routeKey)
+		}
+	}
+	for routeKey := range s.RouteHeaders {
+		if !isKnownRoute(routeKey) {
+			return nil, fmt.Errorf("headers are specified for unknown route %s", routeKey)
+		}
+	}
 	var defaultRouteURL *url.URL
 	if len(s.RouteDefault) > 0 {
 		if defaultRouteURL, err = parseURL(s.RouteDefault); err != nil {
@@ -64,16 +131,60 @@ func (s *httpService) getRedirectMatcher() (redirectMatcher mux.MatcherFunc, err
 		if colonPos := strings.Index(hostNoPort, ":"); colonPos > 0 {
 			hostNoPort = hostNoPort[:colonPos]
 		}
-		if targetDomainStr, ok := s.RouteDomains[hostNoPort]; ok {
-			targetDomain, err := url.Parse(targetDomainStr)
+		for _, r := range redirects {
+			if location, ok := r.match(req, hostNoPort); ok {
+				rm.Handler = redirectHandler(location, r.status)
+				return true
+			}
+		}
+		for _, rule := range rules {
+			groups, ok := rule.match(req, hostNoPort)
+			if !ok {
+				continue
+			}
+			upstream := rule.pool.pick(req)
+			if upstream == nil {
+				rm.Handler = noHealthyUpstreamHandler(rule.Name)
+				return true
+			}
+			targetURL, err := upstream.resolve(rule.hostRe, groups)
 			if err != nil {
-				panic(err)
+				logger.Error("reverse proxy route rule ", rule.Name, ": ", err)
+				rm.Handler = badTargetHandler()
+				return true
+			}
+			targetPath := req.URL.Path
+			if rule.Rewrite {
+				// /portal/foo -> /rewritten/foo
+				targetPath = targetURL.Path + strings.TrimPrefix(targetPath, rule.PathPrefix)
 			}
+			// rule matched -> ignore the rest
+			rm.Handler = rule.pool.handler(upstream, req, rule.PathPrefix)
+			redirect(req, targetPath, targetURL)
+			return true
+		}
+		if pool, re, groups := domainRoutes.match(hostNoPort); pool != nil {
+			upstream := pool.pick(req)
+			if upstream == nil {
+				rm.Handler = noHealthyUpstreamHandler(pool.route)
+				return true
+			}
+			targetURL, err := upstream.resolve(re, groups)
+			if err != nil {
+				logger.Error("reverse proxy route domain ", pool.route, ": ", err)
+				rm.Handler = badTargetHandler()
+				return true
+			}
+			targetDomain := *targetURL
 			targetDomain.Host = strings.Replace(req.Host, hostNoPort, targetDomain.Host, 1)
 
 			// route domain matched -> ignore the rest
-			redirect(req, req.URL.Path, targetDomain)
-			rm.Handler = reverseProxy
+			rm.Handler = pool.handler(upstream, req, "")
+			redirect(req, req.URL.Path, &targetDomain)
+			return true
+		}
+		if static, ok := statics.hosts[hostNoPort]; ok {
+			rm.Handler = static.handler(req.URL.Path)
 			return true
 		}
 		pathParts := strings.Split(req.URL.Path, "/")
@@ -82,28 +193,92 @@ func (s *httpService) getRedirectMatcher() (redirectMatcher mux.MatcherFunc, err
 			_, _ = pathPrefix.WriteString(pathPart) // error impossible
 			route, ok := routes[pathPrefix.String()]
 			if !ok {
+				if static, ok := statics.prefixes[pathPrefix.String()]; ok {
+					// /app/js/main.js -> <Dir>/js/main.js
+					rm.Handler = static.handler(strings.TrimPrefix(req.URL.Path, pathPrefix.String()))
+					return true
+				}
 				continue
 			}
+			upstream := route.pool.pick(req)
+			if upstream == nil {
+				rm.Handler = noHealthyUpstreamHandler(route.pool.route)
+				return true
+			}
 			targetPath := req.URL.Path
 			if route.isRewrite {
 				// /grafana-rewrite/foo -> /rewritten/foo
-				targetPath = strings.Replace(targetPath, pathPrefix.String(), route.targetURL.Path, 1)
+				targetPath = strings.Replace(targetPath, pathPrefix.String(), upstream.targetURL.Path, 1)
 			}
-			redirect(req, targetPath, route.targetURL)
-			rm.Handler = reverseProxy
+			rm.Handler = route.pool.handler(upstream, req, pathPrefix.String())
+			redirect(req, targetPath, upstream.targetURL)
+			return true
+		}
+		if rootStatic != nil {
+			rm.Handler = rootStatic.handler(req.URL.Path)
 			return true
 		}
 		if defaultRouteURL != nil {
 			// no match -> redirect to default route if specified
 			targetPath := defaultRouteURL.Path + req.URL.Path
+			rm.Handler = proxyRequestHandler(req, "", defaultProxy)
 			redirect(req, targetPath, defaultRouteURL)
-			rm.Handler = reverseProxy
 			return true
 		}
 		return false
 	}, nil
 }
 
+// routeKey is the path prefix or the domain
+func (s *httpService) newRoutePool(routeKey string, targets string) (pool *upstreamPool, err error) {
+	if pool, err = newUpstreamPool(targets, s.RouteBalancing[routeKey]); err != nil {
+		return nil, fmt.Errorf("route %s: %w", routeKey, err)
+	}
+	pool.route = routeKey
+	var page *proxyErrorPage
+	if params, ok := s.RouteErrorPages[routeKey]; ok {
+		if page, err = newProxyErrorPage(routeKey, params); err != nil {
+			return nil, fmt.Errorf("route %s: %w", routeKey, err)
+		}
+	}
+	var transport http.RoundTripper
+	if params, ok := s.RouteTransports[routeKey]; ok {
+		if pool.transport, err = newProxyTransport(params); err != nil {
+			return nil, fmt.Errorf("route %s: %w", routeKey, err)
+		}
+		transport = pool.transport
+		if params.Retries > 0 {
+			transport = &retryTransport{RoundTripper: pool.transport, retries: params.Retries}
+		}
+	}
+	if params, ok := s.RouteHeaders[routeKey]; ok {
+		if pool.headers, err = newProxyHeaders(params); err != nil {
+			return nil, fmt.Errorf("route %s: %w", routeKey, err)
+		}
+	}
+	pool.proxy = newRouteProxy(routeKey, page, transport, pool.headers)
+	if healthCheck, ok := s.RouteHealthChecks[routeKey]; ok {
+		if pool.healthCheck, err = newHealthCheck(healthCheck); err != nil {
+			return nil, fmt.Errorf("route %s: %w", routeKey, err)
+		}
+	}
+	s.upstreams = append(s.upstreams, pool)
+	return pool, nil
+}
+
+func noHealthyUpstreamHandler(routeKey string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		writeTextResponse(rw, fmt.Sprintf("no healthy targets of route %s", routeKey), http.StatusServiceUnavailable)
+	}
+}
+
+// the target resolved by the host placeholders is malformed
+func badTargetHandler() http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		writeTextResponse(rw, "bad host", http.StatusBadRequest)
+	}
+}
+
 func parseURL(urlStr string) (url *url.URL, err error) {
 	url, err = url.Parse(urlStr)
 	if err != nil {
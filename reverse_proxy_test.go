@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReverseProxyBalancing(t *testing.T) {
+	require := require.New(t)
+	var targets []string
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("upstream%d", i)
+		upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			_, _ = rw.Write([]byte(name + " " + req.URL.Path))
+		}))
+		defer upstream.Close()
+		targets = append(targets, upstream.URL)
+	}
+	s := &httpService{RouterParams: RouterParams{
+		Routes:        map[string]string{"/grafana": targets[0] + ";" + targets[1], "/hash": targets[0] + ";" + targets[1] + ";" + targets[2]},
+		RoutesRewrite: map[string]string{"/rewrite": targets[0] + "/rewritten;" + targets[1] + "/rewritten"},
+		RouteDomains:  map[string]string{"portal.untill.com": targets[1] + ";" + targets[2]},
+		RouteBalancing: map[string]string{
+			"/hash":             balancingNameHashHeader + "X-Tenant",
+			"portal.untill.com": balancingNameLeastConn,
+		},
+	}}
+	redirectMatcher, err := s.getRedirectMatcher()
+	require.NoError(err)
+	router := mux.NewRouter()
+	router.MatcherFunc(redirectMatcher)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	get := func(path string, header http.Header, host string) string {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, http.NoBody)
+		require.NoError(err)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if len(host) > 0 {
+			req.Host = host
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(err)
+		return string(body)
+	}
+
+	t.Run("round-robin", func(t *testing.T) {
+		first := get("/grafana/foo", nil, "")
+		second := get("/grafana/foo", nil, "")
+		require.ElementsMatch([]string{"upstream0 /grafana/foo", "upstream1 /grafana/foo"}, []string{first, second})
+		require.Equal(first, get("/grafana/foo", nil, ""))
+		require.Contains([]string{"upstream0 /rewritten/foo", "upstream1 /rewritten/foo"}, get("/rewrite/foo", nil, ""))
+	})
+
+	t.Run("consistent hash", func(t *testing.T) {
+		chosen := map[string]bool{}
+		for i := 0; i < 20; i++ {
+			header := http.Header{"X-Tenant": {fmt.Sprintf("tenant%d", i)}}
+			upstream := get("/hash/foo", header, "")
+			require.Equal(upstream, get("/hash/foo", header, ""))
+			chosen[upstream] = true
+		}
+		require.Greater(len(chosen), 1)
+	})
+
+	t.Run("route domain", func(t *testing.T) {
+		require.Contains([]string{"upstream1 /foo", "upstream2 /foo"}, get("/foo", nil, "portal.untill.com"))
+	})
+}
+
+func TestUpstreamPool(t *testing.T) {
+	require := require.New(t)
+
+	t.Run("least connections", func(t *testing.T) {
+		pool, err := newUpstreamPool("http://10.0.0.1;http://10.0.0.2;http://10.0.0.3", balancingNameLeastConn)
+		require.NoError(err)
+		pool.upstreams[0].active.Store(2)
+		pool.upstreams[1].active.Store(1)
+		pool.upstreams[2].active.Store(3)
+		req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+		for i := 0; i < 3; i++ {
+			require.Equal(pool.upstreams[1], pool.pick(req))
+		}
+	})
+
+	t.Run("hash by client ip", func(t *testing.T) {
+		pool, err := newUpstreamPool("http://10.0.0.1;http://10.0.0.2", balancingNameHashIP)
+		require.NoError(err)
+		req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+		req.RemoteAddr = "192.168.0.5:1234"
+		expected := pool.pick(req)
+		req.RemoteAddr = "192.168.0.5:4321"
+		require.Equal(expected, pool.pick(req))
+	})
+
+	t.Run("hash by cookie", func(t *testing.T) {
+		pool, err := newUpstreamPool("http://10.0.0.1;http://10.0.0.2", balancingNameHashCookie+"session")
+		require.NoError(err)
+		req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+		req.AddCookie(&http.Cookie{Name: "session", Value: "42"})
+		expected := pool.pick(req)
+		for i := 0; i < 3; i++ {
+			require.Equal(expected, pool.pick(req))
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		_, err := newUpstreamPool("http://10.0.0.1", "random")
+		require.Error(err)
+		_, err = newUpstreamPool("http://10.0.0.1", balancingNameHashHeader)
+		require.Error(err)
+		_, err = newUpstreamPool(" ; ", "")
+		require.Error(err)
+		s := &httpService{RouterParams: RouterParams{
+			Routes:         map[string]string{"/grafana": "http://10.0.0.1"},
+			RouteBalancing: map[string]string{"/unknown": balancingNameLeastConn},
+		}}
+		_, err = s.getRedirectMatcher()
+		require.Error(err)
+	})
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/untillpro/goutils/logger"
+)
+
+// rules are sorted by Priority, equal -> in the order of RouteRules
+func (s *httpService) parseRouteRules() (rules []*routeRule, err error) {
+	names := map[string]bool{}
+	for _, params := range s.RouteRules {
+		if len(params.Name) == 0 {
+			return nil, errors.New("route rule name is missing")
+		}
+		if names[params.Name] {
+			return nil, fmt.Errorf("route rule %s is duplicated", params.Name)
+		}
+		if _, ok := s.Routes[params.Name]; ok {
+			return nil, fmt.Errorf("route rule %s: name is used by the route already", params.Name)
+		}
+		if _, ok := s.RoutesRewrite[params.Name]; ok {
+			return nil, fmt.Errorf("route rule %s: name is used by the route already", params.Name)
+		}
+		if _, ok := s.RouteDomains[params.Name]; ok {
+			return nil, fmt.Errorf("route rule %s: name is used by the route domain already", params.Name)
+		}
+		names[params.Name] = true
+		rule, err := s.newRouteRule(params)
+		if err != nil {
+			return nil, fmt.Errorf("route rule %s: %w", params.Name, err)
+		}
+		rules = append(rules, rule)
+		logger.Info("reverse proxy route rule registered: ", params.Name, " -> ", params.Target)
+	}
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].Priority > rules[j].Priority })
+	return rules, nil
+}
+
+func (s *httpService) newRouteRule(params RouteRule) (rule *routeRule, err error) {
+	rule = &routeRule{RouteRule: params}
+	if len(params.PathPrefix) > 0 && !strings.HasPrefix(params.PathPrefix, "/") {
+		return nil, fmt.Errorf("path prefix %s must have a leading slash", params.PathPrefix)
+	}
+	rule.PathPrefix = strings.TrimSuffix(params.PathPrefix, "/")
+	if len(params.Methods) > 0 {
+		rule.methods = map[string]bool{}
+		for _, method := range params.Methods {
+			rule.methods[strings.ToUpper(method)] = true
+		}
+	}
+	if rule.hostRe, _, err = compileHostPattern(params.Host); err != nil {
+		return nil, fmt.Errorf("host %s: %w", params.Host, err)
+	}
+	if rule.pool, err = s.newRoutePool(params.Name, params.Target); err != nil {
+		return nil, err
+	}
+	if err := checkTargetTemplates(rule.pool, rule.hostRe); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// groups of the host pattern are returned
+func (rule *routeRule) match(req *http.Request, hostNoPort string) (groups []string, ok bool) {
+	if rule.methods != nil && !rule.methods[req.Method] {
+		return nil, false
+	}
+	if len(rule.PathPrefix) > 0 && req.URL.Path != rule.PathPrefix && !strings.HasPrefix(req.URL.Path, rule.PathPrefix+"/") {
+		return nil, false
+	}
+	for name, value := range rule.Headers {
+		values, ok := req.Header[http.CanonicalHeaderKey(name)]
+		if !ok || (len(value) > 0 && !containsString(values, value)) {
+			return nil, false
+		}
+	}
+	switch {
+	case rule.hostRe != nil:
+		if groups = rule.hostRe.FindStringSubmatch(hostNoPort); groups == nil {
+			return nil, false
+		}
+	case len(rule.Host) > 0 && rule.Host != hostNoPort:
+		return nil, false
+	}
+	return groups, true
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteRules(t *testing.T) {
+	require := require.New(t)
+	newUpstream := func(name string) string {
+		upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			_, _ = rw.Write([]byte(name + " " + req.URL.Path))
+		}))
+		t.Cleanup(upstream.Close)
+		return upstream.URL
+	}
+	portalA := newUpstream("portalA")
+	portalB := newUpstream("portalB")
+	api := newUpstream("api")
+	legacy := newUpstream("legacy")
+	s := &httpService{RouterParams: RouterParams{
+		Routes:       map[string]string{"/grafana": legacy},
+		RouteDomains: map[string]string{"b.untill.ru": legacy},
+		RouteRules: []RouteRule{
+			{Name: "portal a", Host: "a.untill.ru", Target: portalA},
+			{Name: "portal b api", Host: "*.untill.ru", PathPrefix: "/api/", Methods: []string{"post"}, Target: api + "/v2", Rewrite: true, Priority: 10},
+			{Name: "portal b beta", Host: "b.untill.ru", Headers: map[string]string{"X-Beta": "1"}, Target: portalB, Priority: 5},
+			{Name: "canary", Headers: map[string]string{"X-Canary": ""}, Target: portalB, Priority: 20},
+		},
+		RouteBalancing: map[string]string{"portal a": balancingNameLeastConn},
+	}}
+	redirectMatcher, err := s.getRedirectMatcher()
+	require.NoError(err)
+	router := mux.NewRouter()
+	router.MatcherFunc(redirectMatcher)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	do := func(method string, host string, path string, header http.Header) string {
+		req, err := http.NewRequest(method, server.URL+path, http.NoBody)
+		require.NoError(err)
+		req.Host = host
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(err)
+		return string(body)
+	}
+
+	t.Run("host", func(t *testing.T) {
+		require.Equal("portalA /foo", do(http.MethodGet, "a.untill.ru", "/foo", nil))
+		require.Equal("portalA /grafana/foo", do(http.MethodGet, "a.untill.ru", "/grafana/foo", nil))
+	})
+
+	t.Run("path prefix, method and rewrite", func(t *testing.T) {
+		require.Equal("api /v2/orders", do(http.MethodPost, "b.untill.ru", "/api/orders", nil))
+		require.Equal("api /v2", do(http.MethodPost, "a.untill.ru", "/api", nil))
+		require.Equal("portalA /apis", do(http.MethodPost, "a.untill.ru", "/apis", nil))
+		require.Equal("legacy /api/orders", do(http.MethodGet, "b.untill.ru", "/api/orders", nil))
+	})
+
+	t.Run("header", func(t *testing.T) {
+		require.Equal("portalB /foo", do(http.MethodGet, "b.untill.ru", "/foo", http.Header{"X-Beta": {"1"}}))
+		require.Equal("legacy /foo", do(http.MethodGet, "b.untill.ru", "/foo", http.Header{"X-Beta": {"2"}}))
+	})
+
+	t.Run("priority", func(t *testing.T) {
+		require.Equal("portalB /api/orders", do(http.MethodPost, "b.untill.ru", "/api/orders", http.Header{"X-Canary": {"any"}}))
+	})
+
+	t.Run("no rule matched -> routes", func(t *testing.T) {
+		require.Equal("legacy /grafana/foo", do(http.MethodGet, "c.untill.com", "/grafana/foo", nil))
+	})
+
+	t.Run("wrong config", func(t *testing.T) {
+		for name, rp := range map[string]RouterParams{
+			"no name":             {RouteRules: []RouteRule{{Target: portalA}}},
+			"duplicated name":     {RouteRules: []RouteRule{{Name: "a", Target: portalA}, {Name: "a", Target: portalB}}},
+			"name of the route":   {Routes: map[string]string{"/grafana": legacy}, RouteRules: []RouteRule{{Name: "/grafana", Target: portalA}}},
+			"no target":           {RouteRules: []RouteRule{{Name: "a"}}},
+			"relative prefix":     {RouteRules: []RouteRule{{Name: "a", PathPrefix: "api", Target: portalA}}},
+			"wrong host":          {RouteRules: []RouteRule{{Name: "a", Host: "~(", Target: portalA}}},
+			"unknown placeholder": {RouteRules: []RouteRule{{Name: "a", Host: "*.untill.ru", Target: "http://{2}.internal"}}},
+		} {
+			t.Run(name, func(t *testing.T) {
+				_, err := (&httpService{RouterParams: rp}).getRedirectMatcher()
+				require.Error(err)
+			})
+		}
+	})
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+type securityHeadersPolicy struct {
+	hsts          string
+	byRouteType   map[routeType]http.Header
+	proxyOverride bool
+}
+
+func newSecurityHeadersPolicy(params SecurityHeadersParams) *securityHeadersPolicy {
+	p := &securityHeadersPolicy{
+		byRouteType:   map[routeType]http.Header{},
+		proxyOverride: params.ProxyOverride,
+	}
+	if params.HSTSMaxAge > 0 {
+		p.hsts = "max-age=" + strconv.Itoa(params.HSTSMaxAge)
+		if params.HSTSIncludeSubDomains {
+			p.hsts += "; includeSubDomains"
+		}
+	}
+	for rt, headers := range map[routeType]SecurityHeaders{
+		routeTypeAPI:   params.API,
+		routeTypeBLOB:  params.BLOB,
+		routeTypeProxy: params.Proxy,
+	} {
+		h := http.Header{}
+		setSecurityHeader(h, "X-Frame-Options", headers.FrameOptions, params.Default.FrameOptions)
+		setSecurityHeader(h, "Referrer-Policy", headers.ReferrerPolicy, params.Default.ReferrerPolicy)
+		setSecurityHeader(h, "Content-Security-Policy", headers.ContentSecurityPolicy, params.Default.ContentSecurityPolicy)
+		setSecurityHeader(h, "Permissions-Policy", headers.PermissionsPolicy, params.Default.PermissionsPolicy)
+		p.byRouteType[rt] = h
+	}
+	return p
+}
+
+func setSecurityHeader(h http.Header, name string, value string, defaultValue string) {
+	if len(value) == 0 {
+		value = defaultValue
+	}
+	if len(value) > 0 {
+		h.Set(name, value)
+	}
+}
+
+func getRouteType(req *http.Request) routeType {
+	route := mux.CurrentRoute(req)
+	if route == nil {
+		return routeTypeAPI
+	}
+	switch route.GetName() {
+	case routeNameBLOBRead, routeNameBLOBWrite:
+		return routeTypeBLOB
+	case routeNameReverseProxy:
+		return routeTypeProxy
+	}
+	return routeTypeAPI
+}
+
+// mux.MiddlewareFunc
+// headers are written right before the response header is sent so the route handler and the upstream values are known
+func (p *securityHeadersPolicy) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt := getRouteType(r)
+		headers := p.byRouteType[rt]
+		if r.TLS != nil && len(p.hsts) > 0 {
+			headers = headers.Clone()
+			headers.Set("Strict-Transport-Security", p.hsts)
+		}
+		if len(headers) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		sw := &securityHeadersWriter{
+			ResponseWriter: w,
+			headers:        headers,
+			override:       rt == routeTypeProxy && p.proxyOverride,
+		}
+		h.ServeHTTP(sw, r)
+		// nothing is written by the handler -> the header is sent after return
+		sw.writeSecurityHeaders()
+	})
+}
+
+type securityHeadersWriter struct {
+	http.ResponseWriter
+	headers       http.Header
+	override      bool
+	headerWritten bool
+}
+
+func (w *securityHeadersWriter) writeSecurityHeaders() {
+	if w.headerWritten {
+		return
+	}
+	w.headerWritten = true
+	for name, values := range w.headers {
+		if _, ok := w.Header()[name]; ok && !w.override {
+			// value from the handler or from the upstream is kept
+			continue
+		}
+		w.Header()[name] = values
+	}
+}
+
+func (w *securityHeadersWriter) WriteHeader(statusCode int) {
+	w.writeSecurityHeaders()
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *securityHeadersWriter) Write(data []byte) (int, error) {
+	w.writeSecurityHeaders()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *securityHeadersWriter) Flush() {
+	_ = w.FlushError()
+}
+
+// used by http.ResponseController, e.g. to detect the SSE client disconnect
+func (w *securityHeadersWriter) FlushError() error {
+	w.writeSecurityHeaders()
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// websocket.Server asserts http.Hijacker
+func (w *securityHeadersWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// used by http.ResponseController, e.g. on websocket upgrade by httputil.ReverseProxy
+func (w *securityHeadersWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
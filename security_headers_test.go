@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	"github.com/voedger/voedger/pkg/in10n"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	require := require.New(t)
+	newRouter := func(params SecurityHeadersParams) *mux.Router {
+		router := mux.NewRouter()
+		router.Use(newSecurityHeadersPolicy(params).middleware)
+		router.HandleFunc("/api/check", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		})
+		router.HandleFunc("/blob/1", func(w http.ResponseWriter, r *http.Request) {}).Name(routeNameBLOBRead)
+		router.MatcherFunc(func(r *http.Request, rm *mux.RouteMatch) bool {
+			rm.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// upstream values
+				w.Header().Set("X-Frame-Options", "ALLOW-FROM https://untill.com")
+				w.WriteHeader(http.StatusOK)
+			})
+			return true
+		}).Name(routeNameReverseProxy)
+		return router
+	}
+	params := SecurityHeadersParams{
+		HSTSMaxAge:            DefaultHSTSMaxAge,
+		HSTSIncludeSubDomains: true,
+		Default: SecurityHeaders{
+			FrameOptions:   "DENY",
+			ReferrerPolicy: DefaultReferrerPolicy,
+		},
+		BLOB: SecurityHeaders{
+			ContentSecurityPolicy: "default-src 'none'",
+		},
+		Proxy: SecurityHeaders{
+			FrameOptions:      "SAMEORIGIN",
+			PermissionsPolicy: "camera=(), microphone=()",
+		},
+	}
+	get := func(router *mux.Router, target string) http.Header {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, http.NoBody))
+		return rec.Header()
+	}
+
+	t.Run("api", func(t *testing.T) {
+		h := get(newRouter(params), "http://localhost/api/check")
+		require.Equal("DENY", h.Get("X-Frame-Options"))
+		require.Equal(DefaultReferrerPolicy, h.Get("Referrer-Policy"))
+		require.Empty(h.Get("Content-Security-Policy"))
+		require.Empty(h.Get("Strict-Transport-Security"))
+	})
+
+	t.Run("hsts over https only", func(t *testing.T) {
+		h := get(newRouter(params), "https://localhost/api/check")
+		require.Equal("max-age=31536000; includeSubDomains", h.Get("Strict-Transport-Security"))
+	})
+
+	t.Run("blob", func(t *testing.T) {
+		h := get(newRouter(params), "http://localhost/blob/1")
+		require.Equal("DENY", h.Get("X-Frame-Options"))
+		require.Equal("default-src 'none'", h.Get("Content-Security-Policy"))
+	})
+
+	t.Run("proxy keeps upstream values", func(t *testing.T) {
+		h := get(newRouter(params), "http://localhost/grafana")
+		require.Equal([]string{"ALLOW-FROM https://untill.com"}, h["X-Frame-Options"])
+		require.Equal("camera=(), microphone=()", h.Get("Permissions-Policy"))
+	})
+
+	t.Run("proxy overrides upstream values", func(t *testing.T) {
+		params := params
+		params.ProxyOverride = true
+		h := get(newRouter(params), "http://localhost/grafana")
+		require.Equal([]string{"SAMEORIGIN"}, h["X-Frame-Options"])
+	})
+}
+
+func TestHSTSDefaultOnHTTPS(t *testing.T) {
+	require := require.New(t)
+	hstsMaxAge := func(rp RouterParams) int {
+		rp.Port = HTTPSPort
+		rp.CertDir = t.TempDir()
+		return ProvideBP3(context.Background(), rp, time.Second, nil, in10n.Quotas{}, nil, nil, nil, nil)[0].(*httpsService).SecurityHeaders.HSTSMaxAge
+	}
+	require.Equal(DefaultHSTSMaxAge, hstsMaxAge(RouterParams{}))
+	require.Equal(42, hstsMaxAge(RouterParams{SecurityHeaders: SecurityHeadersParams{HSTSMaxAge: 42}}))
+	require.Equal(-1, hstsMaxAge(RouterParams{SecurityHeaders: SecurityHeadersParams{HSTSMaxAge: -1}}))
+	require.Empty(newSecurityHeadersPolicy(SecurityHeadersParams{HSTSMaxAge: -1}).hsts)
+}
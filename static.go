@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/untillpro/goutils/logger"
+)
+
+// key: path prefix or exact host
+func (s *httpService) parseStaticRoutes() (res *staticRoutes, err error) {
+	res = &staticRoutes{prefixes: map[string]*staticRoute{}, hosts: map[string]*staticRoute{}}
+	for routeKey, params := range s.StaticRoutes {
+		_, isRoute := s.Routes[routeKey]
+		_, isRewriteRoute := s.RoutesRewrite[routeKey]
+		_, isDomainRoute := s.RouteDomains[routeKey]
+		if isRoute || isRewriteRoute || isDomainRoute {
+			return nil, fmt.Errorf("static route %s is the reverse proxy route already", routeKey)
+		}
+		if strings.ContainsAny(routeKey, "*~") {
+			return nil, fmt.Errorf("static route %s: host patterns are not supported", routeKey)
+		}
+		route, err := newStaticRoute(params)
+		if err != nil {
+			return nil, fmt.Errorf("static route %s: %w", routeKey, err)
+		}
+		if strings.HasPrefix(routeKey, "/") {
+			res.prefixes[strings.TrimSuffix(routeKey, "/")] = route
+		} else {
+			res.hosts[routeKey] = route
+		}
+		logger.Info("static route registered: ", routeKey, " -> ", params.Dir)
+	}
+	return res, nil
+}
+
+func newStaticRoute(params StaticRouteParams) (*staticRoute, error) {
+	info, err := os.Stat(params.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", params.Dir)
+	}
+	route := &staticRoute{StaticRouteParams: params, root: http.Dir(params.Dir)}
+	if len(route.Index) == 0 {
+		route.Index = defaultStaticIndex
+	}
+	if len(route.IndexCacheControl) == 0 {
+		route.IndexCacheControl = defaultStaticIndexCacheControl
+	}
+	return route, nil
+}
+
+// filePath is relative to the route prefix
+func (route *staticRoute) handler(filePath string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			rw.Header().Set("Allow", "GET, HEAD")
+			writeTextResponse(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := path.Clean("/" + filePath)
+		if isHiddenPath(name) {
+			http.NotFound(rw, req)
+			return
+		}
+		file, info, err := route.open(name)
+		if err == nil && info.IsDir() {
+			file.Close()
+			name = path.Join(name, route.Index)
+			file, info, err = route.open(name)
+		}
+		if errors.Is(err, fs.ErrNotExist) && route.SPAFallback && len(path.Ext(name)) == 0 {
+			// client side routing: /app/orders/42 -> index.html
+			name = "/" + route.Index
+			file, info, err = route.open(name)
+		}
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+				http.NotFound(rw, req)
+				return
+			}
+			logger.Error("static route ", route.Dir, " failed to open ", name, ": ", err)
+			writeTextResponse(rw, "failed to read file", http.StatusInternalServerError)
+			return
+		}
+		if compressed, compressedInfo, encoding := route.openPrecompressed(name, req); compressed != nil {
+			file.Close()
+			file, info = compressed, compressedInfo
+			rw.Header().Set("Content-Encoding", encoding)
+		}
+		defer file.Close()
+		// the response depends on Accept-Encoding if the precompressed file exists
+		rw.Header().Add("Vary", "Accept-Encoding")
+		cacheControl := route.CacheControl
+		if path.Base(name) == route.Index {
+			cacheControl = route.IndexCacheControl
+		}
+		if len(cacheControl) > 0 {
+			rw.Header().Set("Cache-Control", cacheControl)
+		}
+		rw.Header().Set("ETag", fmt.Sprintf(`W/"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+		// Content-Type by the name extension, If-None-Match, If-Modified-Since and Range are handled by ServeContent
+		http.ServeContent(rw, req, name, info.ModTime(), file)
+	}
+}
+
+func (route *staticRoute) open(name string) (http.File, fs.FileInfo, error) {
+	file, err := route.root.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, info, nil
+}
+
+// .br is preferred over .gz. nil -> no precompressed file or not accepted by the client
+func (route *staticRoute) openPrecompressed(name string, req *http.Request) (file http.File, info fs.FileInfo, encoding string) {
+	acceptEncoding := req.Header.Get("Accept-Encoding")
+	for _, variant := range staticPrecompressed {
+		if !acceptsEncoding(acceptEncoding, variant.encoding) {
+			continue
+		}
+		file, info, err := route.open(name + variant.ext)
+		if err != nil {
+			continue
+		}
+		if info.IsDir() {
+			file.Close()
+			continue
+		}
+		return file, info, variant.encoding
+	}
+	return nil, nil, ""
+}
+
+// gzip;q=0 -> not accepted
+func acceptsEncoding(acceptEncoding string, encoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			if key, value, _ := strings.Cut(strings.TrimSpace(param), "="); key == "q" {
+				q, err := strconv.ParseFloat(value, 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// /.git/config, /.env
+func isHiddenPath(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
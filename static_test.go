@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticRoutes(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"index.html":      "index",
+		"app.js":          "app",
+		"app.js.br":       "app br",
+		"app.js.gz":       "app gz",
+		"style.css":       "style",
+		".env":            "secret",
+		"docs/index.html": "docs",
+	} {
+		require.NoError(os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755))
+		require.NoError(os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+	s := &httpService{RouterParams: RouterParams{
+		StaticRoutes: map[string]StaticRouteParams{
+			"/app":             {Dir: dir, SPAFallback: true, CacheControl: "public, max-age=31536000"},
+			"/plain":           {Dir: dir},
+			"portal.untill.ru": {Dir: dir},
+		},
+	}}
+	redirectMatcher, err := s.getRedirectMatcher()
+	require.NoError(err)
+	router := mux.NewRouter()
+	router.SkipClean(true) // as in the service
+	router.MatcherFunc(redirectMatcher)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	do := func(method string, host string, path string, header http.Header) (*http.Response, string) {
+		req, err := http.NewRequest(method, server.URL+path, http.NoBody)
+		require.NoError(err)
+		if len(host) > 0 {
+			req.Host = host
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		// no transparent gzip of the client
+		req.Header.Set("Accept-Encoding", req.Header.Get("Accept-Encoding"))
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		require.NoError(err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(err)
+		return resp, string(body)
+	}
+
+	t.Run("file", func(t *testing.T) {
+		resp, body := do(http.MethodGet, "", "/app/style.css", nil)
+		require.Equal(http.StatusOK, resp.StatusCode)
+		require.Equal("style", body)
+		require.Equal("text/css; charset=utf-8", resp.Header.Get("Content-Type"))
+		require.Equal("public, max-age=31536000", resp.Header.Get("Cache-Control"))
+		require.NotEmpty(resp.Header.Get("ETag"))
+		require.NotEmpty(resp.Header.Get("Last-Modified"))
+	})
+
+	t.Run("conditional requests", func(t *testing.T) {
+		resp, _ := do(http.MethodGet, "", "/app/style.css", nil)
+		notModified, _ := do(http.MethodGet, "", "/app/style.css", http.Header{"If-None-Match": {resp.Header.Get("ETag")}})
+		require.Equal(http.StatusNotModified, notModified.StatusCode)
+		notModified, _ = do(http.MethodGet, "", "/app/style.css", http.Header{"If-Modified-Since": {resp.Header.Get("Last-Modified")}})
+		require.Equal(http.StatusNotModified, notModified.StatusCode)
+	})
+
+	t.Run("precompressed", func(t *testing.T) {
+		resp, body := do(http.MethodGet, "", "/app/app.js", http.Header{"Accept-Encoding": {"gzip, br"}})
+		require.Equal("app br", body)
+		require.Equal("br", resp.Header.Get("Content-Encoding"))
+		require.Equal("text/javascript; charset=utf-8", resp.Header.Get("Content-Type"))
+		require.Equal("Accept-Encoding", resp.Header.Get("Vary"))
+		resp, body = do(http.MethodGet, "", "/app/app.js", http.Header{"Accept-Encoding": {"gzip, br;q=0"}})
+		require.Equal("app gz", body)
+		require.Equal("gzip", resp.Header.Get("Content-Encoding"))
+		resp, body = do(http.MethodGet, "", "/app/app.js", nil)
+		require.Equal("app", body)
+		require.Empty(resp.Header.Get("Content-Encoding"))
+	})
+
+	t.Run("index and SPA fallback", func(t *testing.T) {
+		for _, path := range []string{"/app", "/app/", "/app/orders/42"} {
+			resp, body := do(http.MethodGet, "", path, nil)
+			require.Equal(http.StatusOK, resp.StatusCode, path)
+			require.Equal("index", body, path)
+			require.Equal(defaultStaticIndexCacheControl, resp.Header.Get("Cache-Control"))
+		}
+		_, body := do(http.MethodGet, "", "/app/docs/", nil)
+		require.Equal("docs", body)
+		resp, _ := do(http.MethodGet, "", "/app/missing.js", nil)
+		require.Equal(http.StatusNotFound, resp.StatusCode)
+		resp, _ = do(http.MethodGet, "", "/plain/orders/42", nil)
+		require.Equal(http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("host", func(t *testing.T) {
+		_, body := do(http.MethodGet, "portal.untill.ru", "/style.css", nil)
+		require.Equal("style", body)
+	})
+
+	t.Run("forbidden", func(t *testing.T) {
+		resp, _ := do(http.MethodGet, "", "/app/.env", nil)
+		require.Equal(http.StatusNotFound, resp.StatusCode)
+		resp, _ = do(http.MethodGet, "", "/plain/../../etc/passwd", nil)
+		require.Equal(http.StatusNotFound, resp.StatusCode)
+		resp, _ = do(http.MethodPost, "", "/app/style.css", nil)
+		require.Equal(http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+
+	t.Run("wrong config", func(t *testing.T) {
+		for name, rp := range map[string]RouterParams{
+			"no dir":           {StaticRoutes: map[string]StaticRouteParams{"/app": {Dir: filepath.Join(dir, "missing")}}},
+			"file as dir":      {StaticRoutes: map[string]StaticRouteParams{"/app": {Dir: filepath.Join(dir, "app.js")}}},
+			"proxy route":      {Routes: map[string]string{"/app": "http://10.0.0.1"}, StaticRoutes: map[string]StaticRouteParams{"/app": {Dir: dir}}},
+			"host pattern":     {StaticRoutes: map[string]StaticRouteParams{"*.untill.ru": {Dir: dir}}},
+			"root and default": {RouteDefault: "http://10.0.0.1", StaticRoutes: map[string]StaticRouteParams{"/": {Dir: dir}}},
+		} {
+			t.Run(name, func(t *testing.T) {
+				_, err := (&httpService{RouterParams: rp}).getRedirectMatcher()
+				require.Error(err)
+			})
+		}
+	})
+}
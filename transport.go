@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/untillpro/goutils/logger"
+)
+
+func newProxyTransport(params ProxyTransportParams) (*http.Transport, error) {
+	if params.DialTimeout < 0 || params.TLSHandshakeTimeout < 0 || params.ResponseHeaderTimeout < 0 || params.MaxIdleConns < 0 || params.Retries < 0 {
+		return nil, errors.New("negative transport values are not allowed")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if params.DialTimeout > 0 {
+		dialer := &net.Dialer{Timeout: time.Duration(params.DialTimeout) * time.Second, KeepAlive: defaultProxyKeepAlive}
+		transport.DialContext = dialer.DialContext
+	}
+	if params.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = time.Duration(params.TLSHandshakeTimeout) * time.Second
+	}
+	transport.ResponseHeaderTimeout = time.Duration(params.ResponseHeaderTimeout) * time.Second
+	if params.MaxIdleConns > 0 {
+		transport.MaxIdleConnsPerHost = params.MaxIdleConns
+	}
+	if params.DisableHTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		// non-nil empty map disables HTTP/2
+		transport.TLSNextProto = map[string]func(authority string, c *tls.Conn) http.RoundTripper{}
+	}
+	if params.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} // nolint: gosec
+	}
+	return transport, nil
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	for attempt := 0; ; attempt++ {
+		resp, err = t.RoundTripper.RoundTrip(req)
+		if err == nil || attempt >= t.retries || !isRetriable(req, err) {
+			return resp, err
+		}
+		if logger.IsVerbose() {
+			logger.Verbose("reverse proxy: retrying ", req.Method, " ", req.URL, " after connection failure: ", err)
+		}
+	}
+}
+
+// idempotent request without body and connection failure, not timeout
+func isRetriable(req *http.Request, err error) bool {
+	if req.Context().Err() != nil || (req.Body != nil && req.Body != http.NoBody) {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return proxyErrorKindOf(err) == proxyErrorConnection
+	}
+	return false
+}
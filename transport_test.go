@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2023-present unTill Pro, Ltd.
+ */
+
+package router2
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+type testRoundTripper struct {
+	errs  []error // returned in turn, then success
+	calls int
+}
+
+func (rt *testRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.calls++
+	if rt.calls <= len(rt.errs) {
+		return nil, rt.errs[rt.calls-1]
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+}
+
+func TestRouteTransports(t *testing.T) {
+	require := require.New(t)
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-req.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	selfSigned := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("self-signed"))
+	}))
+	defer selfSigned.Close()
+	s := &httpService{RouterParams: RouterParams{
+		Routes: map[string]string{"/slow": slow.URL, "/tls": selfSigned.URL, "/tls-verified": selfSigned.URL},
+		RouteTransports: map[string]ProxyTransportParams{
+			"/slow": {ResponseHeaderTimeout: 1},
+			"/tls":  {InsecureSkipVerify: true, DisableHTTP2: true, MaxIdleConns: 10, DialTimeout: 5, Retries: 2},
+		},
+		RouteErrorPages: map[string]ProxyErrorParams{"/slow": {On: []string{"timeout"}, Body: "timeout"}},
+	}}
+	redirectMatcher, err := s.getRedirectMatcher()
+	require.NoError(err)
+	router := mux.NewRouter()
+	router.MatcherFunc(redirectMatcher)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/slow/foo")
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(http.StatusGatewayTimeout, resp.StatusCode)
+
+	resp, err = http.Get(server.URL + "/tls/foo")
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(http.StatusOK, resp.StatusCode)
+
+	// certificate is verified by default
+	resp, err = http.Get(server.URL + "/tls-verified/foo")
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(http.StatusBadGateway, resp.StatusCode)
+
+	t.Run("transport settings", func(t *testing.T) {
+		transport, err := newProxyTransport(ProxyTransportParams{TLSHandshakeTimeout: 3, MaxIdleConns: 10, DisableHTTP2: true})
+		require.NoError(err)
+		require.Equal(3*time.Second, transport.TLSHandshakeTimeout)
+		require.Equal(10, transport.MaxIdleConnsPerHost)
+		require.False(transport.ForceAttemptHTTP2)
+		require.NotNil(transport.TLSNextProto)
+		require.Empty(transport.TLSNextProto)
+		_, err = newProxyTransport(ProxyTransportParams{DialTimeout: -1})
+		require.Error(err)
+	})
+
+	t.Run("retries", func(t *testing.T) {
+		connErr := errors.New("connection refused")
+		rt := &testRoundTripper{errs: []error{connErr, connErr}}
+		resp, err := (&retryTransport{RoundTripper: rt, retries: 2}).RoundTrip(httptest.NewRequest(http.MethodGet, "/", http.NoBody))
+		require.NoError(err)
+		require.Equal(http.StatusOK, resp.StatusCode)
+		require.Equal(3, rt.calls)
+
+		// retries are exceeded
+		rt = &testRoundTripper{errs: []error{connErr, connErr}}
+		_, err = (&retryTransport{RoundTripper: rt, retries: 1}).RoundTrip(httptest.NewRequest(http.MethodGet, "/", http.NoBody))
+		require.ErrorIs(err, connErr)
+		require.Equal(2, rt.calls)
+
+		// not idempotent, with body or timeout -> not retried
+		for _, req := range []*http.Request{
+			httptest.NewRequest(http.MethodPost, "/", http.NoBody),
+			httptest.NewRequest(http.MethodPut, "/", strings.NewReader("data")),
+		} {
+			rt = &testRoundTripper{errs: []error{connErr}}
+			_, err = (&retryTransport{RoundTripper: rt, retries: 2}).RoundTrip(req)
+			require.Error(err)
+			require.Equal(1, rt.calls)
+		}
+		rt = &testRoundTripper{errs: []error{testTimeoutError{}}}
+		_, err = (&retryTransport{RoundTripper: rt, retries: 2}).RoundTrip(httptest.NewRequest(http.MethodGet, "/", http.NoBody))
+		require.Error(err)
+		require.Equal(1, rt.calls)
+	})
+}
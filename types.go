@@ -5,12 +5,16 @@
 package router2
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"net/url"
+	"regexp"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/voedger/voedger/pkg/appdef"
 	"github.com/voedger/voedger/pkg/iblobstorage"
 	"github.com/voedger/voedger/pkg/in10n"
 	"github.com/voedger/voedger/pkg/iprocbus"
@@ -36,10 +40,178 @@ type RouterParams struct {
 	UseBP3               bool // impacts on router handlers
 	HTTP01ChallengeHosts []string
 	CertDir              string
-	RouteDefault         string            // http://10.0.0.3:3000/not-found : https://alpha.dev.untill.ru/unknown/foo -> http://10.0.0.3:3000/not-found/unknown/foo
-	Routes               map[string]string // /grafana=http://10.0.0.3:3000 : https://alpha.dev.untill.ru/grafana/foo -> http://10.0.0.3:3000/grafana/foo
-	RoutesRewrite        map[string]string // /grafana-rewrite=http://10.0.0.3:3000/rewritten : https://alpha.dev.untill.ru/grafana-rewrite/foo -> http://10.0.0.3:3000/rewritten/foo
-	RouteDomains         map[string]string // resellerportal.dev.untill.ru=http://resellerportal : https://resellerportal.dev.untill.ru/foo -> http://resellerportal/foo
+	RouteDefault         string                          // http://10.0.0.3:3000/not-found : https://alpha.dev.untill.ru/unknown/foo -> http://10.0.0.3:3000/not-found/unknown/foo
+	Routes               map[string]string               // /grafana=http://10.0.0.3:3000 : https://alpha.dev.untill.ru/grafana/foo -> http://10.0.0.3:3000/grafana/foo
+	RoutesRewrite        map[string]string               // /grafana-rewrite=http://10.0.0.3:3000/rewritten : https://alpha.dev.untill.ru/grafana-rewrite/foo -> http://10.0.0.3:3000/rewritten/foo
+	RouteDomains         map[string]string               // resellerportal.dev.untill.ru=http://resellerportal : https://resellerportal.dev.untill.ru/foo -> http://resellerportal/foo
+	RouteBalancing       map[string]string               // route prefix or domain -> round-robin (default), least-conn, hash-ip, hash-header:<name>, hash-cookie:<name>. Targets of the route are separated by ";"
+	RouteHealthChecks    map[string]HealthCheckParams    // route prefix or domain -> active health check of the route targets
+	RouteErrorPages      map[string]ProxyErrorParams     // route prefix or domain -> response on the upstream failure
+	RouteTransports      map[string]ProxyTransportParams // route prefix or domain -> transport to the route targets
+	RouteHeaders         map[string]ProxyHeadersParams   // route prefix, domain or rule name -> request and response headers
+	TrustedProxies       []string                        // CIDRs or IPs, e.g. 10.0.0.0/8. X-Forwarded-* of these peers are accepted. Empty -> the connection peer is the client
+	Redirects            map[string]string               // [<host>][<path prefix>]=[<status> ]<location>, e.g. www.untill.ru=301 https://untill.ru{path}{query}. Evaluated before the reverse proxy
+	HTTPSRedirectStatus  int                             // http -> https redirect status of the port 80 server, 0 -> 302
+	StaticRoutes         map[string]StaticRouteParams    // route prefix or exact host -> local directory. Checked with the reverse proxy routes of the same prefix or host
+	RouteRules           []RouteRule                     // evaluated by Priority before the routes above. Rule Name is the key of RouteBalancing etc
+
+	IdempotencyKeyTTL int               // seconds, 0 -> Idempotency-Key header is ignored
+	IdempotencyStore  IIdempotencyStore `json:"-"` // nil -> in-memory store is used
+	CORS              CORSParams
+	SecurityHeaders   SecurityHeadersParams
+
+	// principal tokens are validated by the router before the request is sent to the bus
+	EdgeAuth        bool
+	AppKeysResource string           // query function that returns the app principal token keys as JWKS. Empty and no AppKeysProvider -> edge auth is disabled
+	AppKeysProvider IAppKeysProvider `json:"-"` // nil -> keys are fetched via the bus by AppKeysResource
+
+	AuthPolicies map[string]string // route name -> required, optional, forbidden. E.g. "blob read=required"
+
+	// query function executed in each workspace of the n10n projections to check the principal access. Empty -> access is not checked
+	N10NAuthResource             string
+	N10NResumeTimeout            int            // seconds the n10n channel is kept after SSE client disconnect to resume by Last-Event-ID, 0 -> closed on disconnect
+	SSERetry                     int            // SSE client reconnection time, milliseconds. 0 -> not sent
+	SSEHeartbeatInterval         int            // seconds, 0 -> no heartbeats
+	N10NChannelTTL               int            // seconds, 0 -> DefaultN10NChannelTTL
+	N10NChannelTTLByApp          map[string]int // app -> seconds, e.g. "untill/airs-bp=3600". The least TTL of the channel projections apps is used
+	N10NMaxChannelsPerSubject    int            // 0 -> unlimited by the router
+	N10NMaxProjectionsPerChannel int            // 0 -> unlimited by the router
+	N10NCoalesceWindow           int            // milliseconds, the latest offset per projection is sent once per window. 0 -> sent at once, skipped if the client can not keep up
+	SSEHeartbeatEvent            bool           // `event: heartbeat` instead of the comment, e.g. to detect the dead connection on the client side
+
+	// internal listener for admin endpoints, e.g. 127.0.0.1:8081. Empty -> no admin listener, n10n updates are not accepted
+	AdminAddress     string
+	N10NUpdateSecret string // not empty -> `Authorization: Bearer <secret>` is required by /n10n/update
+}
+
+// values may contain {client_ip}, {host} (as requested by the client) and {prefix} (matched path prefix of the route)
+type ProxyHeadersParams struct {
+	Request      HeaderRules // applied to the request sent to the target
+	Response     HeaderRules // applied to the target response
+	PreserveHost bool        // the Host header of the client is sent to the target instead of the target host
+}
+
+// applied in the order: Remove, Set, Add
+type HeaderRules struct {
+	Remove []string
+	Set    map[string]string // replaces the values
+	Add    map[string]string // appended to the values
+}
+
+// files are served with ETag and Last-Modified, <file>.br and <file>.gz are served if accepted by the client
+type StaticRouteParams struct {
+	Dir               string
+	Index             string // directory index, empty -> index.html
+	SPAFallback       bool   // unknown path without the extension -> Index, e.g. for the client side routing
+	CacheControl      string // Cache-Control of the files, empty -> not sent
+	IndexCacheControl string // Cache-Control of Index, empty -> no-cache
+}
+
+// empty matcher -> any. Host is exact, *.<suffix> or ~<regex> as RouteDomains keys, its groups may be used in Target
+type RouteRule struct {
+	Name       string // unique, used in logs and as the key of RouteBalancing, RouteHealthChecks, RouteErrorPages, RouteTransports
+	Priority   int    // higher first, equal -> in the order of RouteRules
+	Host       string
+	PathPrefix string            // /grafana matches /grafana and /grafana/foo, not /grafanafoo
+	Methods    []string          // GET, POST etc
+	Headers    map[string]string // header -> value, empty value -> the header is present
+	Target     string            // targets separated by ";"
+	Rewrite    bool              // PathPrefix is replaced by the Target path, otherwise the path is kept
+}
+
+// zero values -> http.DefaultTransport values
+type ProxyTransportParams struct {
+	DialTimeout           int // seconds
+	TLSHandshakeTimeout   int // seconds
+	ResponseHeaderTimeout int // seconds, 0 -> no timeout
+	MaxIdleConns          int // per target
+	DisableHTTP2          bool
+	Retries               int  // idempotent requests without body are retried on connection failure
+	InsecureSkipVerify    bool // self-signed certificates of the targets are accepted
+}
+
+// one of File, Body, Redirect is used. Fallback is tried first if specified
+type ProxyErrorParams struct {
+	On          []string // connection, timeout, 5xx. Empty -> all
+	File        string   // response body file, read on start
+	Body        string   // inline response body
+	ContentType string   // of File or Body, empty -> text/html; charset=utf-8
+	Redirect    string   // 302 Location
+	Fallback    string   // upstream the request without body is retried on
+}
+
+// unhealthy targets are taken out of the route rotation
+type HealthCheckParams struct {
+	Path               string // GET <target scheme>://<target host><Path>, 2xx or 3xx -> healthy
+	Interval           int    // seconds, 0 -> DefaultHealthCheckInterval
+	Timeout            int    // seconds, 0 -> DefaultHealthCheckTimeout
+	HealthyThreshold   int    // consecutive successes to bring the target back, 0 -> DefaultHealthyThreshold
+	UnhealthyThreshold int    // consecutive failures to take the target out, 0 -> DefaultUnhealthyThreshold
+}
+
+// zero value -> any origin, DefaultCORSAllowedHeaders, no credentials
+type CORSParams struct {
+	AllowedOrigins   []string // https://web.untill.com, https://*.untill.com, http://localhost:*, *. Empty -> any origin
+	AllowedHeaders   []string // empty -> DefaultCORSAllowedHeaders
+	ExposedHeaders   []string
+	AllowCredentials bool              // true -> the request Origin is returned instead of *. Requires explicit AllowedOrigins
+	MaxAge           int               // seconds, preflight result cache time. 0 -> Access-Control-Max-Age is not sent
+	RouteMethods     map[string]string // route name -> methods separated by spaces, must be allowed by the route. E.g. "blob read=GET". Not specified -> all route methods
+}
+
+// empty value -> header is not sent
+type SecurityHeaders struct {
+	FrameOptions          string // X-Frame-Options
+	ReferrerPolicy        string // Referrer-Policy
+	ContentSecurityPolicy string // Content-Security-Policy
+	PermissionsPolicy     string // Permissions-Policy
+}
+
+type SecurityHeadersParams struct {
+	HSTSMaxAge            int // seconds, Strict-Transport-Security is sent over HTTPS only. 0 -> DefaultHSTSMaxAge, negative -> not sent
+	HSTSIncludeSubDomains bool
+	Default               SecurityHeaders // for all route types
+	API                   SecurityHeaders // /api, /n10n. Non-empty values override Default
+	BLOB                  SecurityHeaders // /blob. Non-empty values override Default
+	Proxy                 SecurityHeaders // reverse proxy routes. Non-empty values override Default
+	ProxyOverride         bool            // true -> replace upstream values, false -> upstream values are kept
+}
+
+type routeType int
+
+type authPolicy int
+
+type principalTokenSource int
+
+type principalKeyType string
+
+type proxyHeaderVarsKeyType string
+
+type clientKeyType string
+
+type proxyInboundKeyType string
+
+// the request received by the route proxy, before the Director
+type proxyInbound struct {
+	req *http.Request
+}
+
+// resolved from the connection and the X-Forwarded-* of the trusted proxies
+type clientInfo struct {
+	ip           string // the real client IP
+	host         string // requested by the client
+	proto        string // http or https as requested by the client
+	peer         string // IP of the connection
+	requestHost  string // Host header as received
+	requestProto string // scheme of the connection
+	trustedPeer  bool   // the peer is the trusted proxy -> its X-Forwarded-* are accepted
+}
+
+// attached to the request context by authHandler
+type principal struct {
+	token  string
+	claims *principalTokenClaims // nil -> not validated at the edge
+	source principalTokenSource
 }
 
 type BlobberServiceChannels []iprocbusmem.ChannelGroup
@@ -58,15 +230,39 @@ type BlobberParams struct {
 type httpService struct {
 	RouterParams
 	*BlobberParams
-	router       *mux.Router
-	server       *http.Server
-	listener     net.Listener
-	queues       ibusnats.QueuesPartitionsMap
-	n10n         in10n.IN10nBroker
-	blobWG       sync.WaitGroup
-	bus          ibus.IBus
-	busTimeout   time.Duration
-	appsWSAmount map[istructs.AppQName]istructs.AppWSAmount
+	router         *mux.Router
+	server         *http.Server
+	listener       net.Listener
+	queues         ibusnats.QueuesPartitionsMap
+	n10n           in10n.IN10nBroker
+	blobWG         sync.WaitGroup
+	bus            ibus.IBus
+	busTimeout     time.Duration
+	appsWSAmount   map[istructs.AppQName]istructs.AppWSAmount
+	cors           *corsPolicy
+	n10nChannels   n10nChannels
+	ctx            context.Context // the one Run() is called with, n10n channels outlive the requests
+	stopping       chan struct{}   // closed on Stop(), SSE clients are notified
+	admin          adminService
+	metrics        routerMetrics
+	upstreams      []*upstreamPool // reverse proxy routes
+	trustedProxies []*net.IPNet    // parsed RouterParams.TrustedProxies
+}
+
+// serves the internal endpoints on RouterParams.AdminAddress
+type adminService struct {
+	router   *mux.Router
+	server   *http.Server
+	listener net.Listener
+}
+
+// exposed by /metrics of the admin listener
+type routerMetrics struct {
+	n10nUpdateRequests         atomic.Int64
+	n10nUpdateRejectedRequests atomic.Int64
+	n10nUpdates                atomic.Int64
+	n10nDroppedEvents          atomic.Int64 // offsets replaced by the newer ones before sent to the client
+	healthCheckFailures        atomic.Int64
 }
 
 type httpsService struct {
@@ -88,15 +284,257 @@ type createChannelParamsType struct {
 	ProjectionKey []in10n.ProjectionKey
 }
 
+// n10n channels created by the router
+type n10nChannels struct {
+	sync.Mutex
+	channels map[in10n.ChannelID]*n10nChannel
+}
+
+// watched until closed. Stream could be detached and attached again, e.g. SSE reconnect
+type n10nChannel struct {
+	sync.Mutex
+	id          in10n.ChannelID
+	owner       istructs.SubjectLogin
+	cancel      context.CancelFunc
+	watchDone   chan struct{}
+	seq         uint64
+	offsets     map[in10n.ProjectionKey]n10nEvent // latest offset per projection, replayed on reattach
+	stream      *n10nStream
+	polledSeq   uint64 // the latest seq returned by poll
+	closeTimer  *time.Timer
+	dropped     *atomic.Int64
+	projections map[in10n.ProjectionKey]bool // subscribed
+	// the token accepted by the access check on poll, re-checked when changed or expired
+	authorizedToken string
+	authorizedUntil time.Time
+}
+
+type n10nEvent struct {
+	UpdateUnit
+	seq       uint64
+	timestamp istructs.UnixMilli // received by the router
+}
+
+// data of the v2 SSE update event
+type sseUpdateData struct {
+	App        istructs.AppQName
+	Projection appdef.QName
+	WS         istructs.WSID
+	Offset     istructs.Offset
+	Timestamp  istructs.UnixMilli
+}
+
+type n10nStream struct {
+	ready    chan struct{} // there are offsets to send
+	detached chan struct{} // closed when another stream is attached
+	sentSeq  uint64
+}
+
+// n10n websocket frame. Type: subscribe, unsubscribe, ping, pong from the client; channel, update, ack, error, ping, pong from the router
+type wsMessage struct {
+	Type          string
+	ID            string                `json:",omitempty"` // request frame ID, repeated in the ack or error frame
+	Channel       in10n.ChannelID       `json:",omitempty"`
+	ProjectionKey []in10n.ProjectionKey `json:",omitempty"`
+	Projection    *in10n.ProjectionKey  `json:",omitempty"`
+	Offset        istructs.Offset       `json:",omitempty"`
+	Status        int                   `json:",omitempty"`
+	Error         string                `json:",omitempty"`
+}
+
 type subscriberParamsType struct {
 	Channel       in10n.ChannelID
 	ProjectionKey []in10n.ProjectionKey
 }
 
+// one item of the n10n subscribe/unsubscribe POST batch result
+type n10nProjectionResult struct {
+	Channel    in10n.ChannelID
+	Projection *in10n.ProjectionKey `json:",omitempty"`
+	Status     int
+	Error      string `json:",omitempty"`
+}
+
+type n10nBatchResponse struct {
+	Results []n10nProjectionResult
+}
+
+type n10nWorkspace struct {
+	app istructs.AppQName
+	ws  istructs.WSID
+}
+
+type n10nAccess struct {
+	status int
+	err    error
+}
+
+type pollChannelResponse struct {
+	Channel in10n.ChannelID
+}
+
+type pollResponse struct {
+	Updates []UpdateUnit
+}
+
 type route struct {
-	targetURL  *url.URL
+	pool       *upstreamPool
 	isRewrite  bool
 	fromDomain string
 }
 
+type balancingStrategy int
+
+// reverse proxy targets of the route
+type upstreamPool struct {
+	route       string // prefix or domain
+	upstreams   []*upstream
+	strategy    balancingStrategy
+	hashKey     string // header or cookie name
+	next        atomic.Uint64
+	healthCheck *HealthCheckParams // nil -> all targets are in rotation
+	proxy       http.Handler
+	transport   *http.Transport // nil -> http.DefaultTransport
+	headers     *proxyHeaders   // nil -> headers are proxied as is
+}
+
+type proxyHeaders struct {
+	request      HeaderRules
+	response     HeaderRules
+	preserveHost bool
+}
+
+// captured before the request is redirected to the target
+type proxyHeaderVars struct {
+	clientIP string
+	host     string
+	prefix   string
+}
+
+type domainRoutes struct {
+	exact    map[string]*upstreamPool
+	patterns []domainPattern // wildcards by the longest suffix, then regexes in the lexicographic order
+}
+
+type routeRule struct {
+	RouteRule
+	hostRe  *regexp.Regexp  // nil -> Host is exact or empty
+	methods map[string]bool // nil -> any
+	pool    *upstreamPool
+}
+
+type staticRoutes struct {
+	prefixes map[string]*staticRoute
+	hosts    map[string]*staticRoute
+}
+
+type staticRoute struct {
+	StaticRouteParams
+	root http.FileSystem
+}
+
+type staticPrecompressedVariant struct {
+	ext      string
+	encoding string
+}
+
+type redirectHostRank int
+
+type redirectRule struct {
+	from       string
+	host       string
+	hostRe     *regexp.Regexp // nil -> host is exact or empty
+	hostRank   redirectHostRank
+	pathPrefix string
+	status     int
+	location   string // with {scheme}, {host}, {path}, {rest}, {query} and the host groups
+}
+
+type domainPattern struct {
+	key      string // *.dev.untill.ru or ~<regex>
+	re       *regexp.Regexp
+	pool     *upstreamPool
+	wildcard bool
+}
+
+// retries idempotent requests on connection failure
+type retryTransport struct {
+	http.RoundTripper
+	retries int
+}
+
+// reverse proxy error handling of the route
+type proxyErrorPage struct {
+	route       string
+	on          map[proxyErrorKind]bool // empty -> all
+	body        []byte
+	contentType string
+	redirect    string
+	fallback    *url.URL
+}
+
+type proxyErrorKind string
+
+// upstream responded 5xx and the error page is configured for 5xx
+type upstreamStatusError struct {
+	status int
+}
+
+type upstream struct {
+	targetURL *url.URL
+	template  string       // route domain target with placeholders, e.g. http://{sub}.internal:8080. Empty -> targetURL is used as is
+	active    atomic.Int64 // requests in progress
+	unhealthy atomic.Bool
+	successes int // consecutive, used by the health checker only
+	failures  int
+}
+
+// item of the admin /upstreams
+type upstreamStatus struct {
+	Route   string
+	Target  string
+	Healthy bool
+	Active  int64
+}
+
 type implIBusBP2 struct{}
+
+// IdempotentResponse is the first response on a request with Idempotency-Key. Replayed on retries
+type IdempotentResponse struct {
+	StatusCode         int
+	ContentType        string
+	Data               []byte
+	RequestFingerprint string // the same Idempotency-Key for a different request -> 422
+}
+
+// IIdempotencyStore keeps responses on requests with Idempotency-Key
+// keys are already scoped per app, WSID and principal
+type IIdempotencyStore interface {
+	// stored == nil -> the key is acquired by the caller, Store() or Release() must be called then
+	// the key is acquired by another request -> waits until Store() or Release() is called for it
+	// Errors: ctx.Err()
+	// @ConcurrentAccess
+	Acquire(ctx context.Context, key string) (stored *IdempotentResponse, err error)
+
+	// remembers the response and releases the key
+	// @ConcurrentAccess
+	Store(key string, resp IdempotentResponse, ttl time.Duration)
+
+	// releases the key without storing the response so the next request with the same key will be handled
+	// @ConcurrentAccess
+	Release(key string)
+}
+
+// AppKey is a key to verify principal tokens of an app
+type AppKey struct {
+	KeyID     string      // empty -> key is used for any token key id
+	Algorithm string      // HS256, RS256, ES256 etc. Empty -> any algorithm matching the key type
+	Key       interface{} // []byte for HS*, *rsa.PublicKey for RS*, *ecdsa.PublicKey for ES*
+}
+
+// IAppKeysProvider provides keys to validate principal tokens at the edge
+type IAppKeysProvider interface {
+	// refresh -> cached keys should be fetched again, e.g. token key id is unknown
+	// @ConcurrentAccess
+	GetKeys(ctx context.Context, app istructs.AppQName, refresh bool) (keys []AppKey, err error)
+}